@@ -6,7 +6,10 @@ import (
 	"github.com/telemetryapp/gotelemetry_agent/agent/aggregations"
 	"github.com/telemetryapp/gotelemetry_agent/agent/config"
 	"github.com/telemetryapp/gotelemetry_agent/agent/graphite"
+	"github.com/telemetryapp/gotelemetry_agent/agent/httpclient"
 	"github.com/telemetryapp/gotelemetry_agent/agent/job"
+	"github.com/telemetryapp/gotelemetry_agent/agent/lua"
+	"github.com/telemetryapp/gotelemetry_agent/agent/mockapi"
 	"github.com/telemetryapp/gotelemetry_agent/agent/oauth"
 	"io/ioutil"
 	"log"
@@ -63,6 +66,11 @@ func main() {
 
 	config.Init(VERSION, SOURCE_DATE)
 
+	if config.CLIConfig.IsMockingAPI {
+		log.Printf("Mock Telemetry API listening on http://%s", config.CLIConfig.MockAPIListen)
+		log.Fatal(mockapi.ListenAndServe(config.CLIConfig.MockAPIListen, config.CLIConfig.MockAPIToken))
+	}
+
 	configFile, err = config.NewConfigFile()
 
 	if err != nil {
@@ -79,9 +87,12 @@ func main() {
 	go handleErrors(errorChannel, wg)
 	go run()
 
+	// Commands report failure by sending false
+	var success bool
+
 	for {
 		select {
-		case <-completionChannel:
+		case success = <-completionChannel:
 			goto Done
 		}
 	}
@@ -94,7 +105,13 @@ Done:
 	close(errorChannel)
 	wg.Wait()
 
+	lua.ClosePools()
+
 	log.Println("No more jobs to run; exiting.")
+
+	if !success {
+		os.Exit(1)
+	}
 }
 
 func run() {
@@ -106,6 +123,18 @@ func run() {
 		log.Fatalf("Initialization error: %s", err)
 	}
 
+	if err := httpclient.Init(configFile.HTTPConfig()); err != nil {
+		log.Fatalf("Initialization error: %s", err)
+	}
+
+	if err := lua.InitDatabases(configFile.DatabaseConfig()); err != nil {
+		log.Fatalf("Initialization error: %s", err)
+	}
+
+	if err := lua.InitRedis(configFile.RedisConfig()); err != nil {
+		log.Fatalf("Initialization error: %s", err)
+	}
+
 	oauth.Init(configFile.OAuthConfig())
 
 	if config.CLIConfig.IsPiping {
@@ -116,15 +145,23 @@ func run() {
 		}
 
 		agent.ProcessPipeRequest(configFile, errorChannel, completionChannel, payload)
+	} else if config.CLIConfig.IsValidating {
+		agent.ProcessValidateRequest(configFile, errorChannel, completionChannel)
+	} else if config.CLIConfig.IsReplaying {
+		agent.ProcessReplayRequest(configFile, errorChannel, completionChannel, config.CLIConfig.ReplayFile)
 	} else if config.CLIConfig.IsNotifying {
 		agent.ProcessNotificationRequest(configFile, errorChannel, completionChannel, config.CLIConfig.NotificationChannel, config.CLIConfig.NotificationFlow, config.CLIConfig.Notification)
 	} else if config.CLIConfig.OAuthCommand != config.OAuthCommands.None {
 		oauth.RunCommand(config.CLIConfig, errorChannel, completionChannel)
 	} else {
-		_, err := job.NewJobManager(configFile, errorChannel, completionChannel)
+		manager, err := job.NewJobManager(configFile, errorChannel, completionChannel)
 
 		if err != nil {
 			log.Fatalf("Initialization error: %s", err)
 		}
+
+		if err := agent.StartReceiver(configFile, manager, errorChannel); err != nil {
+			log.Fatalf("Initialization error: %s", err)
+		}
 	}
 }
@@ -42,6 +42,14 @@ type CLIConfigType struct {
 	OAuthCode           string
 	OAuthVerifier       string
 	OAuthRealmID        string
+	Sinks               []string
+	IsMockingAPI        bool
+	MockAPIListen       string
+	MockAPIToken        string
+	RecordDir           string
+	IsReplaying         bool
+	ReplayFile          string
+	IsValidating        bool
 }
 
 var CLIConfig CLIConfigType
@@ -72,6 +80,7 @@ func Init(VERSION string, SOURCE_DATE string) {
 	logLevel := app.Flag("verbosity", "Set the verbosity level (`debug`, `info`, `error`).").Short('v').Default("info").Enum("debug", "info", "error")
 	filter := app.Flag("filter", "Run only the jobs whose IDs (or tags if no ID is specified) match the given regular expression").Default(".").String()
 	app.Flag("debug", "Run scripts in debug mode. No API calls will be made. All output will be printed to the console.").BoolVar(&CLIConfig.DebugMode)
+	app.Flag("record", "Record the inputs of each process job run to the given directory, for use with the replay command.").StringVar(&CLIConfig.RecordDir)
 
 	once := app.Command("once", "Run all jobs exactly once and exit.")
 
@@ -79,6 +88,7 @@ func Init(VERSION string, SOURCE_DATE string) {
 	pipe.Flag("channel", "The tag of the channel to which the update is sent.").StringVar(&CLIConfig.ChannelTag)
 	pipe.Flag("jsonpatch", "With --pipe, submit the package as a JSON-Patch request instead. Ignored otherwise.").BoolVar(&CLIConfig.UseJSONPatch)
 	pipe.Flag("post", "With --pipe, submit the package as a POST request instead. Ignored otherwise.").BoolVar(&CLIConfig.UsePOST)
+	pipe.Flag("sink", "The name of a sink to which the package is sent (use `api` for the Telemetry API). Can be repeated.").StringsVar(&CLIConfig.Sinks)
 
 	notify := app.Command("notify", "Send a channel notification.")
 	notify.Flag("channel", "The tag of the channel to which the notification is sent. Either channel or flow is required.").StringVar(&CLIConfig.NotificationChannel)
@@ -98,6 +108,15 @@ func Init(VERSION string, SOURCE_DATE string) {
 	oauthExchange.Flag("verifier", "The verifier code received from the provider").Short('e').StringVar(&CLIConfig.OAuthVerifier)
 	oauthExchange.Flag("realm", "The realm ID received from the provider").Short('r').StringVar(&CLIConfig.OAuthRealmID)
 
+	mockAPI := app.Command("mock-api", "Run an in-memory stand-in for the Telemetry API, for testing jobs without network access.")
+	mockAPI.Flag("listen", "The address on which the server listens.").Default("127.0.0.1:3030").StringVar(&CLIConfig.MockAPIListen)
+	mockAPI.Flag("token", "If set, the API token that clients must use.").StringVar(&CLIConfig.MockAPIToken)
+
+	replay := app.Command("replay", "Run a recorded job again against its recorded inputs and print its output.")
+	replay.Arg("recording", "The path to a recording created with --record.").Required().StringVar(&CLIConfig.ReplayFile)
+
+	validate := app.Command("validate", "Check the configuration file and test the connections to the databases it declares.")
+
 	run := app.Command("run", "Runs the jobs scheduled in the configuration file provided.")
 
 	switch kingpin.MustParse(app.Parse(os.Args[1:])) {
@@ -116,6 +135,15 @@ func Init(VERSION string, SOURCE_DATE string) {
 	case oauthExchange.FullCommand():
 		CLIConfig.OAuthCommand = OAuthCommands.Exchange
 
+	case mockAPI.FullCommand():
+		CLIConfig.IsMockingAPI = true
+
+	case replay.FullCommand():
+		CLIConfig.IsReplaying = true
+
+	case validate.FullCommand():
+		CLIConfig.IsValidating = true
+
 	case run.FullCommand():
 	default:
 		// Do nothing, runs normally
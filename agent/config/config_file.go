@@ -43,9 +43,35 @@ func (j Job) ChannelTag() string {
 	return ""
 }
 
+// Sinks returns the names of the sinks to which the job sends its updates, or nil
+// if the job does not override the default sinks.
+func (j Job) Sinks() []string {
+	switch sinks := j["sinks"].(type) {
+	case string:
+		return []string{sinks}
+
+	case []string:
+		return sinks
+
+	case []interface{}:
+		result := []string{}
+
+		for _, s := range sinks {
+			if name, ok := s.(string); ok {
+				result = append(result, name)
+			}
+		}
+
+		return result
+	}
+
+	return nil
+}
+
 type ServerConfig struct {
 	APIToken              string      `toml:"api_token"`
 	RawSubmissionInterval interface{} `toml:"submission_interval"`
+	Sinks                 []string    `toml:"sinks"`
 }
 
 type DataConfig struct {
@@ -54,11 +80,67 @@ type DataConfig struct {
 	Listen       *string `toml:"listen"`
 }
 
+type SpoolConfig struct {
+	Path        *string `toml:"path"`
+	MaxEntries  int     `toml:"max_entries"`
+	DropPolicy  string  `toml:"drop_policy"`
+	StatsListen string  `toml:"stats_listen"`
+}
+
+type SinkConfig struct {
+	Type    string            `toml:"type"`
+	Path    string            `toml:"path"`
+	URL     string            `toml:"url"`
+	Token   string            `toml:"token"`
+	Timeout string            `toml:"timeout"`
+	Headers map[string]string `toml:"headers"`
+}
+
+type ReceiverConfig struct {
+	Listen string `toml:"listen"`
+	Token  string `toml:"token"`
+}
+
 type GraphiteConfig struct {
 	TCPListenPort string `toml:"listen_tcp"`
 	UDPListenPort string `toml:"listen_udp"`
 }
 
+// HTTPClientConfig is a named HTTP client profile. Durations use the same format as job
+// intervals; certificate and key paths point to PEM files.
+type HTTPClientConfig struct {
+	Proxy              string `toml:"proxy"`
+	CACert             string `toml:"ca_cert"`
+	ClientCert         string `toml:"client_cert"`
+	ClientKey          string `toml:"client_key"`
+	InsecureSkipVerify bool   `toml:"insecure_skip_verify"`
+	Timeout            string `toml:"timeout"`
+	ConnectTimeout     string `toml:"connect_timeout"`
+	UserAgent          string `toml:"user_agent"`
+}
+
+// DatabaseConfig declares a SQL database that scripts open by name. Environment variables in
+// the data source, written as $NAME or ${NAME}, are expanded when the agent starts, so that
+// passwords need not be stored in the configuration file.
+type DatabaseConfig struct {
+	Driver      string `toml:"driver"`
+	DSN         string `toml:"dsn"`
+	MaxOpen     int    `toml:"max_open"`
+	MaxIdle     int    `toml:"max_idle"`
+	MaxLifetime string `toml:"max_lifetime"`
+}
+
+// RedisConfig declares a Redis server that scripts open by name. Environment variables in the
+// password are expanded when the agent starts.
+type RedisConfig struct {
+	Address     string `toml:"address"`
+	Password    string `toml:"password"`
+	DB          int    `toml:"db"`
+	MaxIdle     int    `toml:"max_idle"`
+	MaxActive   int    `toml:"max_active"`
+	IdleTimeout string `toml:"idle_timeout"`
+}
+
 type OAuthConfigEntry struct {
 	Version          int               `toml:"version"`
 	ClientID         string            `toml:"client_id"`
@@ -70,6 +152,7 @@ type OAuthConfigEntry struct {
 	Header           map[string]string `toml:"header"`
 	SignatureMethod  string            `toml:"signature_method"`
 	PrivateKey       string            `toml:"private_key"`
+	HTTPProfile      string            `toml:"http_profile"`
 }
 
 type ConfigInterface interface {
@@ -78,19 +161,35 @@ type ConfigInterface interface {
 	ChannelTag() string
 	DataConfig() DataConfig
 	GraphiteConfig() GraphiteConfig
+	SpoolConfig() SpoolConfig
+	SinkConfig() map[string]SinkConfig
+	SinksForChannel(channelTag string) []string
+	ReceiverConfig() ReceiverConfig
+	LuaPath() []string
+	HTTPConfig() map[string]HTTPClientConfig
+	DatabaseConfig() map[string]DatabaseConfig
+	RedisConfig() map[string]RedisConfig
 	SubmissionInterval() time.Duration
 	OAuthConfig() map[string]OAuthConfigEntry
 	Jobs() []Job
 }
 
 type ConfigFile struct {
-	Server    ServerConfig                `toml:"server"`
-	Graphite  GraphiteConfig              `toml:"graphite"`
-	Data      DataConfig                  `toml:"data"`
-	Listen    string                      `toml:"listen"`
-	JobsField []Job                       `toml:"jobs"`
-	FlowField []Job                       `toml:"flow"`
-	OAuth     map[string]OAuthConfigEntry `toml:"oauth"`
+	Server       ServerConfig                `toml:"server"`
+	Graphite     GraphiteConfig              `toml:"graphite"`
+	Data         DataConfig                  `toml:"data"`
+	Spool        SpoolConfig                 `toml:"spool"`
+	Sinks        map[string]SinkConfig       `toml:"sinks"`
+	ChannelSinks map[string][]string         `toml:"channel_sinks"`
+	Receiver     ReceiverConfig              `toml:"receiver"`
+	Listen       string                      `toml:"listen"`
+	LuaPathField []string                    `toml:"lua_path"`
+	HTTP         map[string]HTTPClientConfig `toml:"http"`
+	Databases    map[string]DatabaseConfig   `toml:"databases"`
+	Redis        map[string]RedisConfig      `toml:"redis"`
+	JobsField    []Job                       `toml:"jobs"`
+	FlowField    []Job                       `toml:"flow"`
+	OAuth        map[string]OAuthConfigEntry `toml:"oauth"`
 }
 
 var _ ConfigInterface = &ConfigFile{}
@@ -99,7 +198,7 @@ func NewConfigFile() (*ConfigFile, error) {
 	source, err := ioutil.ReadFile(CLIConfig.ConfigFileLocation)
 
 	if err != nil {
-		if CLIConfig.IsPiping || CLIConfig.IsNotifying {
+		if CLIConfig.IsPiping || CLIConfig.IsNotifying || CLIConfig.IsReplaying {
 			return &ConfigFile{
 				Data:      DataConfig{},
 				Graphite:  GraphiteConfig{},
@@ -160,6 +259,48 @@ func (c *ConfigFile) GraphiteConfig() GraphiteConfig {
 	return c.Graphite
 }
 
+func (c *ConfigFile) SpoolConfig() SpoolConfig {
+	return c.Spool
+}
+
+func (c *ConfigFile) SinkConfig() map[string]SinkConfig {
+	return c.Sinks
+}
+
+// SinksForChannel returns the names of the sinks used by default for updates sent to
+// the given channel. An empty result means that updates only go to the Telemetry API.
+func (c *ConfigFile) SinksForChannel(channelTag string) []string {
+	if sinks, ok := c.ChannelSinks[channelTag]; ok {
+		return sinks
+	}
+
+	return c.Server.Sinks
+}
+
+func (c *ConfigFile) ReceiverConfig() ReceiverConfig {
+	return c.Receiver
+}
+
+// LuaPath returns the directories in which Lua scripts look for modules
+func (c *ConfigFile) LuaPath() []string {
+	return c.LuaPathField
+}
+
+// HTTPConfig returns the HTTP client profiles, indexed by name
+func (c *ConfigFile) HTTPConfig() map[string]HTTPClientConfig {
+	return c.HTTP
+}
+
+// DatabaseConfig returns the SQL databases declared in the configuration, indexed by name
+func (c *ConfigFile) DatabaseConfig() map[string]DatabaseConfig {
+	return c.Databases
+}
+
+// RedisConfig returns the Redis servers declared in the configuration, indexed by name
+func (c *ConfigFile) RedisConfig() map[string]RedisConfig {
+	return c.Redis
+}
+
 func (c *ConfigFile) SubmissionInterval() time.Duration {
 	if s, ok := c.Server.RawSubmissionInterval.(string); ok {
 		d, err := ParseTimeInterval(s)
@@ -0,0 +1,204 @@
+// Package httpclient builds the HTTP clients used by the agent from the profiles in the
+// `[http]` section of the configuration file.
+//
+// A profile named `default`, if present, is used whenever a caller does not select one.
+// Without it, such callers get a plain client whose requests time out after DefaultTimeout.
+package httpclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// DefaultProfile is the name of the profile used when none is specified
+const DefaultProfile = "default"
+
+// DefaultTimeout bounds the requests made without a profile, so that a server that stops
+// responding cannot stall a job forever
+const DefaultTimeout = time.Minute
+
+var (
+	mutex    sync.RWMutex
+	clients  = map[string]*http.Client{}
+	fallback = newFallbackClient()
+)
+
+// newFallbackClient builds the client used when there is no default profile
+func newFallbackClient() *http.Client {
+	client, _ := New(config.HTTPClientConfig{})
+	client.Timeout = DefaultTimeout
+
+	return client
+}
+
+// Init builds a client for each profile. It replaces any profiles set up previously.
+func Init(profiles map[string]config.HTTPClientConfig) error {
+	result := map[string]*http.Client{}
+
+	for name, profile := range profiles {
+		client, err := New(profile)
+
+		if err != nil {
+			return fmt.Errorf("Invalid HTTP profile %s: %s", name, err)
+		}
+
+		result[name] = client
+	}
+
+	mutex.Lock()
+	clients = result
+	mutex.Unlock()
+
+	return nil
+}
+
+// Get returns the client for the given profile. An empty name selects the default
+// profile, or a plain client with a timeout of DefaultTimeout if there is none.
+func Get(name string) (*http.Client, error) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	if name == "" {
+		if client, ok := clients[DefaultProfile]; ok {
+			return client, nil
+		}
+
+		return fallback, nil
+	}
+
+	if client, ok := clients[name]; ok {
+		return client, nil
+	}
+
+	return nil, fmt.Errorf("HTTP profile %s not found", name)
+}
+
+// New builds a client from a profile
+func New(profile config.HTTPClientConfig) (*http.Client, error) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	if profile.ConnectTimeout != "" {
+		t, err := config.ParseTimeInterval(profile.ConnectTimeout)
+
+		if err != nil {
+			return nil, err
+		}
+
+		dialer.Timeout = t
+	}
+
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		Dial:                dialer.Dial,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+
+	if profile.Proxy != "" {
+		proxyURL, err := url.Parse(profile.Proxy)
+
+		if err != nil {
+			return nil, err
+		}
+
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig, err := tlsConfig(profile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	transport.TLSClientConfig = tlsConfig
+
+	client := &http.Client{Transport: transport}
+
+	if profile.UserAgent != "" {
+		client.Transport = &userAgentTransport{userAgent: profile.UserAgent, next: transport}
+	}
+
+	if profile.Timeout != "" {
+		t, err := config.ParseTimeInterval(profile.Timeout)
+
+		if err != nil {
+			return nil, err
+		}
+
+		client.Timeout = t
+	}
+
+	return client, nil
+}
+
+func tlsConfig(profile config.HTTPClientConfig) (*tls.Config, error) {
+	result := &tls.Config{InsecureSkipVerify: profile.InsecureSkipVerify}
+
+	if profile.CACert != "" {
+		pem, err := ioutil.ReadFile(profile.CACert)
+
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates found in " + profile.CACert)
+		}
+
+		result.RootCAs = pool
+	}
+
+	if profile.ClientCert != "" || profile.ClientKey != "" {
+		if profile.ClientCert == "" || profile.ClientKey == "" {
+			return nil, errors.New("Both `client_cert` and `client_key` are required for client certificates")
+		}
+
+		cert, err := tls.LoadX509KeyPair(profile.ClientCert, profile.ClientKey)
+
+		if err != nil {
+			return nil, err
+		}
+
+		result.Certificates = []tls.Certificate{cert}
+	}
+
+	return result, nil
+}
+
+// userAgentTransport sets the User-Agent header of requests that do not have one
+type userAgentTransport struct {
+	userAgent string
+	next      http.RoundTripper
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") != "" {
+		return t.next.RoundTrip(req)
+	}
+
+	// RoundTrippers must not modify the request they are given
+	r := new(http.Request)
+	*r = *req
+	r.Header = http.Header{}
+
+	for key, values := range req.Header {
+		r.Header[key] = values
+	}
+
+	r.Header.Set("User-Agent", t.userAgent)
+
+	return t.next.RoundTrip(r)
+}
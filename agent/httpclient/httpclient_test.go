@@ -0,0 +1,98 @@
+package httpclient
+
+import (
+	"encoding/pem"
+	"fmt"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProfiles(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(2 * time.Second)
+		}
+
+		fmt.Fprint(w, r.Header.Get("User-Agent"))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "httpclient")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	caPath := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	if err := ioutil.WriteFile(caPath, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err = Init(map[string]config.HTTPClientConfig{
+		"default": {CACert: caPath, UserAgent: "telemetry-agent", Timeout: "1s"},
+		"plain":   {},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer Init(nil)
+
+	client, err := Get("")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := client.Get(server.URL)
+
+	if err != nil {
+		t.Fatalf("The default profile should trust the configured CA, got %s", err)
+	}
+
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if string(body) != "telemetry-agent" {
+		t.Errorf("Expected the profile's user agent, got `%s`", body)
+	}
+
+	if _, err := client.Get(server.URL + "/slow"); err == nil {
+		t.Error("Requests should time out after the profile's timeout")
+	}
+
+	plain, _ := Get("plain")
+
+	if _, err := plain.Get(server.URL); err == nil {
+		t.Error("A profile without the CA should not trust the test server")
+	}
+
+	if _, err := Get("missing"); err == nil {
+		t.Error("Unknown profiles should return an error")
+	}
+
+	Init(nil)
+
+	if client, err := Get(""); err != nil || client.Timeout != DefaultTimeout {
+		t.Errorf("Requests without a default profile should time out after %s, got %#v (%v)", DefaultTimeout, client, err)
+	}
+
+	if err := Init(map[string]config.HTTPClientConfig{"bad": {CACert: filepath.Join(dir, "missing.pem")}}); err == nil {
+		t.Error("Profiles with missing CA files should be rejected")
+	}
+
+	if err := Init(map[string]config.HTTPClientConfig{"bad": {ClientCert: caPath}}); err == nil {
+		t.Error("Client certificates without a key should be rejected")
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"fmt"
 	"github.com/telemetryapp/gotelemetry"
 	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"github.com/telemetryapp/gotelemetry_agent/agent/sink"
+	"github.com/telemetryapp/gotelemetry_agent/agent/spool"
 	"net/http"
 )
 
@@ -21,6 +23,8 @@ type Job struct {
 	config            map[string]interface{}   // The configuration associated with the job
 	completionChannel chan string              // To be pinged when the job has finished running, so that the manager knows when to quit
 	manager           *JobManager              // The manager that owns this job
+	sinks             []sink.Sink              // Additional destinations for the job's data updates
+	useAPI            bool                     // Whether data updates are sent to the Telemetry API
 }
 
 // newJob creates and starts a new Job
@@ -34,6 +38,18 @@ func newJob(manager *JobManager, credentials gotelemetry.Credentials, stream *go
 		config:            config,
 		completionChannel: jobCompletionChannel,
 		manager:           manager,
+		sinks:             []sink.Sink{},
+		useAPI:            true,
+	}
+
+	if manager != nil {
+		var err error
+
+		result.sinks, result.useAPI, err = manager.sinksForJob(config)
+
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if wait {
@@ -70,6 +86,16 @@ func (j *Job) Config() map[string]interface{} {
 	return j.config
 }
 
+// AgentConfig returns the configuration of the agent running this job, or nil if the job
+// is not managed by an agent
+func (j *Job) AgentConfig() config.ConfigInterface {
+	if j.manager == nil {
+		return nil
+	}
+
+	return j.manager.config
+}
+
 // GetOrCreateBoard either creates a board based on an exported template, or retrieves it
 // if a board with the same name already exists.
 //
@@ -165,8 +191,32 @@ func (j *Job) PostImmediateFlowUpdate(flow *gotelemetry.Flow) error {
 
 // PostDataUpdate queues a data update. The update can contain arbitrary data that is
 // sent to the API without any client-side validation.
+//
+// The update is first delivered to the sinks selected for the job, if any, and then queued for
+// the API by the job manager.
 func (j *Job) QueueDataUpdate(tag string, data interface{}, updateType gotelemetry.BatchType) {
-	j.stream.SendData(tag, data, updateType)
+	channelTag := config.Job(j.config).ChannelTag()
+
+	if len(j.sinks) > 0 {
+		if err := sink.WriteAll(j.sinks, sink.NewUpdate(j.ID, channelTag, tag, data, updateType)); err != nil {
+			j.ReportError(err)
+		}
+	}
+
+	if !j.useAPI {
+		return
+	}
+
+	if j.manager == nil {
+		j.stream.SendData(tag, data, updateType)
+		return
+	}
+
+	if err := j.manager.QueueDataUpdate(channelTag, tag, data, updateType); err == spool.ErrFull {
+		j.ReportError(fmt.Errorf("%s; the update to flow %s has been dropped", err, tag))
+	} else if err != nil {
+		j.ReportError(err)
+	}
 }
 
 // ReportError sends a formatted error to the agent's global error log. This should be
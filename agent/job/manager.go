@@ -3,12 +3,21 @@ package job
 import (
 	"github.com/telemetryapp/gotelemetry"
 	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"github.com/telemetryapp/gotelemetry_agent/agent/sink"
+	"github.com/telemetryapp/gotelemetry_agent/agent/spool"
+	"sync"
 	"time"
 )
 
 type JobManager struct {
 	credentials          gotelemetry.Credentials
+	submissionInterval   time.Duration
+	errorChannel         chan error
 	accountStreams       map[string]*gotelemetry.BatchStream
+	streamsMutex         sync.Mutex
+	spool                *spool.Spool
+	sinks                *sink.Registry
+	config               config.ConfigInterface
 	jobs                 map[string]*Job
 	completionChannel    chan bool
 	jobCompletionChannel chan string
@@ -28,7 +37,9 @@ func createJob(manager *JobManager, credentials gotelemetry.Credentials, account
 
 func NewJobManager(jobConfig config.ConfigInterface, errorChannel chan error, completionChannel chan bool) (*JobManager, error) {
 	result := &JobManager{
+		config:               jobConfig,
 		jobs:                 map[string]*Job{},
+		errorChannel:         errorChannel,
 		completionChannel:    completionChannel,
 		jobCompletionChannel: make(chan string),
 	}
@@ -58,8 +69,27 @@ func NewJobManager(jobConfig config.ConfigInterface, errorChannel chan error, co
 		errorChannel <- gotelemetry.NewLogError("Submission interval set to %ds", submissionInterval/time.Second)
 	}
 
+	result.submissionInterval = submissionInterval
 	result.accountStreams = map[string]*gotelemetry.BatchStream{}
 
+	result.sinks, err = sink.NewRegistry(jobConfig.SinkConfig(), errorChannel)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if jobConfig.SpoolConfig().Path != nil {
+		s, err := spool.Open(jobConfig.SpoolConfig(), credentials, submissionInterval, errorChannel)
+
+		if err != nil {
+			return nil, err
+		}
+
+		errorChannel <- gotelemetry.NewLogError("Data updates are spooled to %s", *jobConfig.SpoolConfig().Path)
+
+		result.spool = s
+	}
+
 	for _, jobDescription := range jobConfig.Jobs() {
 		jobId := jobDescription.ID()
 
@@ -75,20 +105,10 @@ func NewJobManager(jobConfig config.ConfigInterface, errorChannel chan error, co
 			delete(jobDescription, "refresh")
 		}
 
-		channelTag := jobDescription.ChannelTag()
-
-		accountStream, ok := result.accountStreams[channelTag]
-
-		if !ok {
-			var err error
+		accountStream, err := result.streamForChannel(jobDescription.ChannelTag())
 
-			accountStream, err = gotelemetry.NewBatchStream(credentials, channelTag, submissionInterval, errorChannel)
-
-			if err != nil {
-				return nil, err
-			}
-
-			result.accountStreams[channelTag] = accountStream
+		if err != nil {
+			return nil, err
 		}
 
 		job, err := createJob(result, credentials, accountStream, errorChannel, jobDescription, result.jobCompletionChannel, false)
@@ -103,8 +123,9 @@ func NewJobManager(jobConfig config.ConfigInterface, errorChannel chan error, co
 	}
 
 	if len(result.jobs) == 0 {
+		// The manager still submits the updates received from other agents, if any
 		errorChannel <- gotelemetry.NewLogError("No jobs are being scheduled.")
-		return nil, nil
+		return result, nil
 	}
 
 	go result.monitorDoneChannel()
@@ -112,6 +133,58 @@ func NewJobManager(jobConfig config.ConfigInterface, errorChannel chan error, co
 	return result, nil
 }
 
+// streamForChannel returns the batch stream that submits updates to a channel, creating it
+// if needed
+func (m *JobManager) streamForChannel(channelTag string) (*gotelemetry.BatchStream, error) {
+	m.streamsMutex.Lock()
+	defer m.streamsMutex.Unlock()
+
+	if stream, ok := m.accountStreams[channelTag]; ok {
+		return stream, nil
+	}
+
+	stream, err := gotelemetry.NewBatchStream(m.credentials, channelTag, m.submissionInterval, m.errorChannel)
+
+	if err != nil {
+		return nil, err
+	}
+
+	m.accountStreams[channelTag] = stream
+
+	return stream, nil
+}
+
+// QueueDataUpdate submits an update to the Telemetry API at the next submission interval.
+// If the agent is configured with a spool, the update is written to disk and submitted from
+// there; should that fail for any reason other than the spool being full, it falls back to
+// the in-memory stream of its channel.
+func (m *JobManager) QueueDataUpdate(channelTag, tag string, data interface{}, updateType gotelemetry.BatchType) error {
+	if m.spool != nil {
+		err := m.spool.Enqueue(channelTag, tag, data, updateType)
+
+		if err == nil || err == spool.ErrFull {
+			return err
+		}
+
+		m.errorChannel <- err
+	}
+
+	stream, err := m.streamForChannel(channelTag)
+
+	if err != nil {
+		return err
+	}
+
+	stream.SendData(tag, data, updateType)
+
+	return nil
+}
+
+// Sinks returns the sinks declared in the configuration
+func (m *JobManager) Sinks() *sink.Registry {
+	return m.sinks
+}
+
 func (m *JobManager) addJob(job *Job) error {
 	if _, found := m.jobs[job.ID]; found {
 		return gotelemetry.NewError(500, "Duplicate job `"+job.ID+"`")
@@ -122,6 +195,19 @@ func (m *JobManager) addJob(job *Job) error {
 	return nil
 }
 
+// sinksForJob returns the sinks to which a job sends its updates, and whether the updates
+// should also be sent to the Telemetry API. Unless the job specifies its own sinks, those
+// configured for its channel are used.
+func (m *JobManager) sinksForJob(jobDescription config.Job) ([]sink.Sink, bool, error) {
+	names := jobDescription.Sinks()
+
+	if names == nil {
+		names = m.config.SinksForChannel(jobDescription.ChannelTag())
+	}
+
+	return m.sinks.Resolve(names)
+}
+
 func (m *JobManager) monitorDoneChannel() {
 	for {
 		select {
@@ -129,10 +215,24 @@ func (m *JobManager) monitorDoneChannel() {
 			delete(m.jobs, id)
 
 			if len(m.jobs) == 0 {
+				m.streamsMutex.Lock()
+
 				for _, accountStream := range m.accountStreams {
 					accountStream.Flush()
 				}
 
+				m.streamsMutex.Unlock()
+
+				if m.spool != nil {
+					if err := m.spool.Drain(); err != nil {
+						m.spool.Errorf("Unable to submit updates: %s. They will be submitted the next time the agent runs.", err)
+					}
+
+					m.spool.Close()
+				}
+
+				m.sinks.Close()
+
 				m.completionChannel <- true
 				return
 			}
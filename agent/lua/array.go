@@ -1,7 +1,12 @@
 package lua
 
 import (
+	"fmt"
 	"github.com/telemetryapp/go-lua"
+	"github.com/telemetryapp/goluago/util"
+	"math"
+	"strconv"
+	"time"
 )
 
 func pushArray(l *lua.State) {
@@ -12,3 +17,138 @@ func pushArray(l *lua.State) {
 	l.SetField(-2, arrayMarkerField)
 	l.SetMetaTable(-2)
 }
+
+// pulledList returns the items of a table pulled from Lua if it is a sequence
+func pulledList(value interface{}) ([]interface{}, bool) {
+	switch v := value.(type) {
+	case []interface{}:
+		return v, true
+
+	case map[string]interface{}:
+		if len(v) == 0 {
+			return nil, false
+		}
+
+		result := make([]interface{}, len(v))
+
+		for key, item := range v {
+			index, err := strconv.Atoi(key)
+
+			if err != nil || index < 1 || index > len(v) {
+				return nil, false
+			}
+
+			result[index-1] = item
+		}
+
+		return result, true
+	}
+
+	return nil, false
+}
+
+// pulledValue prepares a value pulled from Lua for encoding: sequences become slices, and
+// numbers without a fractional part become integers
+func pulledValue(value interface{}) interface{} {
+	if list, ok := pulledList(value); ok {
+		result := make([]interface{}, len(list))
+
+		for index, item := range list {
+			result[index] = pulledValue(item)
+		}
+
+		return result
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := map[string]interface{}{}
+
+		for key, item := range v {
+			result[key] = pulledValue(item)
+		}
+
+		return result
+
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v)
+		}
+	}
+
+	return value
+}
+
+// checkEncodable pulls the value to encode at the given index
+func checkEncodable(l *lua.State, index int) interface{} {
+	lua.CheckAny(l, index)
+
+	if !l.IsTable(index) {
+		return pulledValue(l.ToValue(index))
+	}
+
+	v, err := util.PullTable(l, index)
+
+	if err != nil {
+		lua.Errorf(l, "%s", err)
+		panic("unreachable")
+	}
+
+	return pulledValue(v)
+}
+
+// pushValue pushes a decoded value, using arrays for lists so that they can be told apart
+// from tables when they are encoded again. Dates are pushed as ISO 8601 strings.
+func pushValue(l *lua.State, value interface{}) {
+	switch v := value.(type) {
+	case nil:
+		l.PushNil()
+
+	case []interface{}:
+		pushArray(l)
+
+		for index, item := range v {
+			pushValue(l, item)
+			l.RawSetInt(-2, index+1)
+		}
+
+	case []map[string]interface{}:
+		pushArray(l)
+
+		for index, item := range v {
+			pushValue(l, item)
+			l.RawSetInt(-2, index+1)
+		}
+
+	case map[string]interface{}:
+		l.NewTable()
+
+		for key, item := range v {
+			pushValue(l, item)
+			l.SetField(-2, key)
+		}
+
+	case map[interface{}]interface{}:
+		l.NewTable()
+
+		for key, item := range v {
+			pushValue(l, item)
+			l.SetField(-2, fmt.Sprint(key))
+		}
+
+	case int:
+		l.PushNumber(float64(v))
+
+	case int64:
+		l.PushNumber(float64(v))
+
+	case uint64:
+		l.PushNumber(float64(v))
+
+	case time.Time:
+		l.PushString(v.Format(time.RFC3339Nano))
+
+	default:
+		util.DeepPush(l, v)
+	}
+}
@@ -0,0 +1,74 @@
+package lua
+
+import (
+	"github.com/telemetryapp/go-lua"
+	"github.com/telemetryapp/gotelemetry_agent/agent/record"
+)
+
+// States are reused across runs, so everything that is specific to a run is kept in the
+// registry rather than captured when the libraries are opened.
+const runContextRegistryKey = "telemetry.run"
+
+// runResource is something a script holds, such as a connection or a transaction, that
+// must be released when the run ends if the script has not released it itself
+type runResource interface {
+	release()
+}
+
+// runContext holds what the libraries need to know about the current run
+type runContext struct {
+	np        notificationProvider
+	tape      *record.Tape
+	variants  map[string]string // The variants of the flows the script has updated
+	resources []runResource
+}
+
+// track registers a resource to be released when the run ends
+func (c *runContext) track(r runResource) {
+	c.resources = append(c.resources, r)
+}
+
+// releaseResources releases the resources of the run, most recent first, so that
+// transactions and statements are done with before their connections are released
+func (c *runContext) releaseResources() {
+	for index := len(c.resources) - 1; index >= 0; index-- {
+		c.resources[index].release()
+	}
+
+	c.resources = nil
+}
+
+// setRunContext makes the notification provider and tape of a run available to the libraries
+func setRunContext(l *lua.State, np notificationProvider, t *record.Tape) {
+	l.PushLightUserData(&runContext{np: np, tape: t, variants: map[string]string{}})
+	l.SetField(lua.RegistryIndex, runContextRegistryKey)
+}
+
+// clearRunContext removes the context of the run that has just ended
+func clearRunContext(l *lua.State) {
+	l.PushNil()
+	l.SetField(lua.RegistryIndex, runContextRegistryKey)
+}
+
+// runContextFor returns the context of the current run. Outside of a run, it returns an
+// empty context.
+func runContextFor(l *lua.State) *runContext {
+	l.Field(lua.RegistryIndex, runContextRegistryKey)
+	defer l.Pop(1)
+
+	if c, ok := l.ToUserData(-1).(*runContext); ok {
+		return c
+	}
+
+	return &runContext{variants: map[string]string{}}
+}
+
+// tapeFor returns the tape of the run, or nil if the run is neither recorded nor replayed
+func tapeFor(l *lua.State) *record.Tape {
+	return runContextFor(l).tape
+}
+
+// notificationProviderFor returns the notification provider of the run
+func notificationProviderFor(l *lua.State) notificationProvider {
+	return runContextFor(l).np
+}
@@ -0,0 +1,142 @@
+package lua
+
+import (
+	"fmt"
+	"github.com/telemetryapp/go-lua"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const tracebackHeader = "\nstack traceback:"
+
+// locationRegex splits a Lua error message into the chunk, line and message
+var locationRegex = regexp.MustCompile(`(?s)^(.+?):(\d+): (.*)$`)
+
+// ScriptError describes an error raised while loading or running a script
+type ScriptError struct {
+	Kind      string                 // `Parse` or `Runtime`
+	Script    string                 // The file in which the error was raised, if known
+	Line      string                 // The line at which the error was raised, if known
+	Message   string                 // The error message, without location
+	Traceback string                 // The stack traceback, for runtime errors
+	Job       string                 // The ID of the job that ran the script
+	Args      map[string]interface{} // The arguments passed to the script, which are never reported
+}
+
+func newScriptError(kind, message string) *ScriptError {
+	result := &ScriptError{Kind: kind}
+
+	if index := strings.Index(message, tracebackHeader); index != -1 {
+		result.Traceback = strings.TrimSpace(message[index+1:])
+		message = message[:index]
+	}
+
+	if matches := locationRegex.FindStringSubmatch(message); matches != nil {
+		result.Script = strings.TrimPrefix(matches[1], "@")
+		result.Line = matches[2]
+		message = matches[3]
+	}
+
+	result.Message = message
+
+	return result
+}
+
+// Summary returns the error on a single line
+func (e *ScriptError) Summary() string {
+	switch {
+	case e.Script != "" && e.Line != "":
+		return fmt.Sprintf("%s error in %s on line %s: %s", e.Kind, e.Script, e.Line, e.Message)
+
+	case e.Script != "":
+		return fmt.Sprintf("%s error in %s: %s", e.Kind, e.Script, e.Message)
+	}
+
+	return fmt.Sprintf("%s error: %s", e.Kind, e.Message)
+}
+
+func (e *ScriptError) Error() string {
+	result := e.Summary()
+
+	if e.Traceback != "" {
+		result += "\n" + e.Traceback
+	}
+
+	if len(e.Args) > 0 {
+		result += "\nscript arguments: " + strings.Join(e.argumentNames(), ", ")
+	}
+
+	return result
+}
+
+// argumentNames returns the sorted names of the script's arguments. Their values often
+// hold credentials, so errors only ever mention the names.
+func (e *ScriptError) argumentNames() []string {
+	result := []string{}
+
+	for name := range e.Args {
+		result = append(result, name)
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+// Fields returns the error in a form suitable for a flow's error status
+func (e *ScriptError) Fields() map[string]interface{} {
+	result := map[string]interface{}{
+		"message": e.Summary(),
+	}
+
+	if e.Traceback != "" {
+		result["traceback"] = e.Traceback
+	}
+
+	if e.Job != "" {
+		result["job"] = e.Job
+	}
+
+	if len(e.Args) > 0 {
+		result["args"] = e.argumentNames()
+	}
+
+	return result
+}
+
+// withContext attaches the job and arguments of a run to script errors
+func withContext(err error, options ExecOptions, args map[string]interface{}) error {
+	if e, ok := err.(*ScriptError); ok {
+		e.Job = options.JobID
+		e.Args = args
+	}
+
+	return err
+}
+
+// errorMessage returns the message of the error at the top of the stack
+func errorMessage(l *lua.State, err error) string {
+	if message, ok := l.ToString(-1); ok {
+		return message
+	}
+
+	if l.Top() > 0 && !l.IsNil(-1) {
+		return fmt.Sprintf("%v", l.ToValue(-1))
+	}
+
+	return err.Error()
+}
+
+// messageHandler adds a stack traceback to runtime errors
+func messageHandler(l *lua.State) int {
+	message, ok := l.ToString(1)
+
+	if !ok {
+		message = fmt.Sprintf("%v", l.ToValue(1))
+	}
+
+	lua.Traceback(l, l, message, 1)
+
+	return 1
+}
@@ -2,65 +2,131 @@ package lua
 
 import (
 	"errors"
-	"fmt"
 	"github.com/telemetryapp/go-lua"
 	"github.com/telemetryapp/goluago"
 	"github.com/telemetryapp/goluago/util"
-	"regexp"
+	"github.com/telemetryapp/gotelemetry_agent/agent/record"
 )
 
 const arrayMarkerField = "_is_array"
 
-var errorRegex = regexp.MustCompile(`:([^:]+)+:(.+)$`)
+// ExecOptions controls how a script is run
+type ExecOptions struct {
+	// Tape, if set, records the results of the script's HTTP, SQL, MongoDB, Redis, flow
+	// and notification calls, or serves them from a recording
+	Tape *record.Tape
 
-func Exec(source string, np notificationProvider, args map[string]interface{}) (map[string]interface{}, error) {
-	l := lua.NewState()
+	// Sandbox selects the sandbox profile: empty for none, or SandboxStrict
+	Sandbox string
 
-	lua.OpenLibraries(l)
-	goluago.Open(l)
+	// Modules lists the modules that can be required in the strict sandbox in addition to
+	// the standard ones
+	Modules []string
 
-	openOAuthLibrary(l)
-	openJSONLibrary(l)
-	openHTTPLibrary(l)
-	openStorageLibrary(l)
-	openExcelLibrary(l)
-	openNotificationsLibrary(l, np)
-	openSQLLibrary(l)
-	openMongoLibrary(l)
-	openXMLLibrary(l)
+	// Limits bounds the resources used by the script
+	Limits Limits
 
-	util.DeepPush(l, args)
+	// LuaPath lists the directories in which `require` looks for modules
+	LuaPath []string
 
-	l.SetGlobal("args")
+	// Name is the file name under which a script run from source appears in errors
+	Name string
 
-	util.DeepPush(l, map[string]interface{}{})
+	// JobID is the ID of the job running the script, which is attached to its errors
+	JobID string
+}
 
-	l.SetGlobal("output")
+func parseError(l *lua.State, err error) error {
+	return newScriptError("Parse", errorMessage(l, err))
+}
+
+func Exec(source string, np notificationProvider, args map[string]interface{}) (map[string]interface{}, error) {
+	return ExecWithOptions(source, np, args, ExecOptions{})
+}
 
-	err := lua.LoadString(l, source)
+// ExecWithOptions runs a script given as source code
+func ExecWithOptions(source string, np notificationProvider, args map[string]interface{}, options ExecOptions) (map[string]interface{}, error) {
+	s, err := acquireState(options)
 
 	if err != nil {
-		matches := errorRegex.FindStringSubmatch(lua.CheckString(l, -1))
+		return nil, err
+	}
 
-		if len(matches) != 3 {
-			return nil, err
-		}
+	defer releaseState(s)
 
-		return nil, fmt.Errorf("Parse error on line %s: %s", matches[1], matches[2])
+	chunkName := "=script"
+
+	if options.Name != "" {
+		chunkName = "@" + options.Name
+	}
+
+	if err := lua.LoadBuffer(s.l, source, chunkName, "t"); err != nil {
+		return nil, withContext(parseError(s.l, err), options, args)
 	}
 
-	err = l.ProtectedCall(0, 0, 0)
+	output, err := s.run(np, args, options)
+
+	return output, withContext(err, options, args)
+}
+
+// ExecFile runs the script at the given path. The script is only compiled again when its
+// contents change.
+func ExecFile(path string, np notificationProvider, args map[string]interface{}, options ExecOptions) (map[string]interface{}, error) {
+	sc, err := loadScript(path)
 
 	if err != nil {
-		matches := errorRegex.FindStringSubmatch(lua.CheckString(l, -1))
+		return nil, err
+	}
 
-		if len(matches) != 3 {
-			return nil, err
-		}
+	options.Tape.SetScript(path, sc.source, args)
+	options.Tape.SetLuaOptions(options.Sandbox, options.Modules, options.LuaPath)
+
+	s, err := acquireState(options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer releaseState(s)
+
+	if err := s.loadChunk(path, sc); err != nil {
+		return nil, withContext(err, options, args)
+	}
+
+	output, err := s.run(np, args, options)
+
+	return output, withContext(err, options, args)
+}
+
+// run calls the function at the top of the stack and returns the contents of the output global
+func (s *state) run(np notificationProvider, args map[string]interface{}, options ExecOptions) (map[string]interface{}, error) {
+	l := s.l
+
+	setRunContext(l, np, options.Tape)
+
+	util.DeepPush(l, args)
+
+	l.SetGlobal("args")
+
+	util.DeepPush(l, map[string]interface{}{})
+
+	l.SetGlobal("output")
+
+	l.PushGoFunction(messageHandler)
+	l.Insert(-2)
 
-		return nil, fmt.Errorf("Runtime error on line %s: %s", matches[1], matches[2])
+	err := l.ProtectedCall(0, 0, l.Top()-1)
+
+	if s.exceeded != nil {
+		return nil, s.exceeded
 	}
 
+	if err != nil {
+		return nil, newScriptError("Runtime", errorMessage(l, err))
+	}
+
+	l.Pop(1)
+
 	l.Global("output")
 
 	defer l.Pop(1)
@@ -81,3 +147,24 @@ func Exec(source string, np notificationProvider, args map[string]interface{}) (
 		return nil, err
 	}
 }
+
+func openLibraries(l *lua.State) {
+	lua.OpenLibraries(l)
+	goluago.Open(l)
+
+	openOAuthLibrary(l)
+	openJSONLibrary(l)
+	openHTTPLibrary(l)
+	openStorageLibrary(l)
+	openExcelLibrary(l)
+	openNotificationsLibrary(l)
+	openFlowsLibrary(l)
+	openSQLLibrary(l)
+	openMongoLibrary(l)
+	openRedisLibrary(l)
+	openXMLLibrary(l)
+	openCSVLibrary(l)
+	openYAMLLibrary(l)
+	openTOMLLibrary(l)
+	openCryptoLibrary(l)
+}
@@ -0,0 +1,493 @@
+package lua
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/telemetryapp/go-lua"
+	"hash"
+	"strings"
+	"time"
+)
+
+// JWT algorithms supported by crypto.jwtSign and crypto.jwtVerify
+const (
+	jwtHS256 = "HS256"
+	jwtRS256 = "RS256"
+)
+
+var cryptoHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// cryptoEncode encodes binary data as `hex`, `base64`, `base64url` (without padding), or
+// leaves it as is for `raw`
+func cryptoEncode(data []byte, encoding string) (string, error) {
+	switch encoding {
+	case "hex":
+		return hex.EncodeToString(data), nil
+
+	case "base64":
+		return base64.StdEncoding.EncodeToString(data), nil
+
+	case "base64url":
+		return base64.RawURLEncoding.EncodeToString(data), nil
+
+	case "raw":
+		return string(data), nil
+	}
+
+	return "", fmt.Errorf("Unknown encoding `%s`. Must be one of `hex`, `base64`, `base64url` or `raw`.", encoding)
+}
+
+// decodeBase64URL accepts base64url data with or without padding
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func pushEncoded(l *lua.State, data []byte, encoding string) int {
+	s, err := cryptoEncode(data, encoding)
+
+	if err != nil {
+		lua.Errorf(l, "%s", err)
+		panic("unreachable")
+	}
+
+	l.PushString(s)
+
+	return 1
+}
+
+func checkHash(l *lua.State, index int) func() hash.Hash {
+	name := lua.CheckString(l, index)
+	h, ok := cryptoHashes[strings.ToLower(name)]
+
+	if !ok {
+		lua.Errorf(l, "Unknown hash algorithm `%s`. Must be one of `md5`, `sha1`, `sha256` or `sha512`.", name)
+		panic("unreachable")
+	}
+
+	return h
+}
+
+func hashFunction(name string) lua.Function {
+	return func(l *lua.State) int {
+		h := cryptoHashes[name]()
+		h.Write([]byte(lua.CheckString(l, 1)))
+
+		return pushEncoded(l, h.Sum(nil), lua.OptString(l, 2, "hex"))
+	}
+}
+
+func decodeFunction(decode func(string) ([]byte, error)) lua.Function {
+	return func(l *lua.State) int {
+		data, err := decode(lua.CheckString(l, 1))
+
+		if err != nil {
+			lua.Errorf(l, "%s", err)
+			panic("unreachable")
+		}
+
+		l.PushString(string(data))
+
+		return 1
+	}
+}
+
+func encodeFunction(encoding string) lua.Function {
+	return func(l *lua.State) int {
+		return pushEncoded(l, []byte(lua.CheckString(l, 1)), encoding)
+	}
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+func parseRSAPrivateKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+
+	if block == nil {
+		return nil, errors.New("The key must be a PEM-encoded RSA private key")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+		return rsaKey, nil
+	}
+
+	return nil, errors.New("The key must be a PEM-encoded RSA private key")
+}
+
+// parseRSAPublicKey reads a PEM-encoded public key or certificate. It returns nil without
+// an error if data is not PEM-encoded.
+func parseRSAPublicKey(data string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+
+	if block == nil {
+		return nil, nil
+	}
+
+	var key interface{}
+	var err error
+
+	switch block.Type {
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if rsaKey, ok := key.(*rsa.PublicKey); ok {
+		return rsaKey, nil
+	}
+
+	return nil, errors.New("The key must be a PEM-encoded RSA public key or certificate")
+}
+
+// signJWT signs claims with either a shared secret (HS256) or a PEM-encoded RSA private key
+// (RS256). Fields of header are added to the token's header.
+func signJWT(claims interface{}, header map[string]interface{}, algorithm, key string) (string, error) {
+	h := map[string]interface{}{}
+
+	for name, value := range header {
+		h[name] = value
+	}
+
+	h["alg"] = algorithm
+
+	if _, ok := h["typ"]; !ok {
+		h["typ"] = "JWT"
+	}
+
+	encodedHeader, err := json.Marshal(h)
+
+	if err != nil {
+		return "", err
+	}
+
+	encodedClaims, err := json.Marshal(claims)
+
+	if err != nil {
+		return "", err
+	}
+
+	input := base64.RawURLEncoding.EncodeToString(encodedHeader) + "." + base64.RawURLEncoding.EncodeToString(encodedClaims)
+
+	var signature []byte
+
+	switch algorithm {
+	case jwtHS256:
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(input))
+		signature = mac.Sum(nil)
+
+	case jwtRS256:
+		privateKey, err := parseRSAPrivateKey(key)
+
+		if err != nil {
+			return "", err
+		}
+
+		digest := sha256.Sum256([]byte(input))
+
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, digest[:]); err != nil {
+			return "", err
+		}
+
+	default:
+		return "", fmt.Errorf("Unsupported JWT algorithm `%s`. Must be either `HS256` or `RS256`.", algorithm)
+	}
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// verifyJWT checks the signature of a token and its `exp` and `nbf` claims, and returns the
+// claims. The caller names the algorithm it expects, and tokens whose header names another
+// one are rejected: RS256 tokens are verified with a PEM-encoded public key or certificate,
+// and HS256 tokens with a shared secret, which cannot be a public key.
+func verifyJWT(token, key, algorithm string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+
+	if len(parts) != 3 {
+		return nil, errors.New("Malformed token")
+	}
+
+	publicKey, err := parseRSAPublicKey(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch algorithm {
+	case jwtHS256:
+		if publicKey != nil {
+			return nil, errors.New("HS256 tokens cannot be verified with a public key")
+		}
+
+	case jwtRS256:
+		if publicKey == nil {
+			return nil, errors.New("RS256 tokens must be verified with a PEM-encoded public key or certificate")
+		}
+
+	default:
+		return nil, fmt.Errorf("Unsupported JWT algorithm `%s`. Must be either `HS256` or `RS256`.", algorithm)
+	}
+
+	encodedHeader, err := decodeBase64URL(parts[0])
+
+	if err != nil {
+		return nil, errors.New("Malformed token header")
+	}
+
+	header := map[string]interface{}{}
+
+	if err := json.Unmarshal(encodedHeader, &header); err != nil {
+		return nil, errors.New("Malformed token header")
+	}
+
+	if header["alg"] != algorithm {
+		return nil, fmt.Errorf("Unexpected algorithm %v; expected %s", header["alg"], algorithm)
+	}
+
+	signature, err := decodeBase64URL(parts[2])
+
+	if err != nil {
+		return nil, errors.New("Malformed token signature")
+	}
+
+	input := parts[0] + "." + parts[1]
+
+	if algorithm == jwtHS256 {
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(input))
+
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, errors.New("Invalid signature")
+		}
+	} else {
+		digest := sha256.Sum256([]byte(input))
+
+		if rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature) != nil {
+			return nil, errors.New("Invalid signature")
+		}
+	}
+
+	encodedClaims, err := decodeBase64URL(parts[1])
+
+	if err != nil {
+		return nil, errors.New("Malformed token claims")
+	}
+
+	claims := map[string]interface{}{}
+
+	if err := json.Unmarshal(encodedClaims, &claims); err != nil {
+		return nil, errors.New("Malformed token claims")
+	}
+
+	if exp, ok := claims["exp"].(float64); ok && now.Unix() >= int64(exp) {
+		return nil, errors.New("The token has expired")
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Unix() < int64(nbf) {
+		return nil, errors.New("The token is not valid yet")
+	}
+
+	return claims, nil
+}
+
+var cryptoLibrary = []lua.RegistryFunction{
+	{"md5", hashFunction("md5")},
+	{"sha1", hashFunction("sha1")},
+	{"sha256", hashFunction("sha256")},
+	{"sha512", hashFunction("sha512")},
+
+	{
+		"hmac",
+		func(l *lua.State) int {
+			h := checkHash(l, 1)
+			mac := hmac.New(h, []byte(lua.CheckString(l, 2)))
+			mac.Write([]byte(lua.CheckString(l, 3)))
+
+			return pushEncoded(l, mac.Sum(nil), lua.OptString(l, 4, "hex"))
+		},
+	},
+
+	{"base64Encode", encodeFunction("base64")},
+	{"base64Decode", decodeFunction(base64.StdEncoding.DecodeString)},
+	{"base64URLEncode", encodeFunction("base64url")},
+	{"base64URLDecode", decodeFunction(decodeBase64URL)},
+	{"hexEncode", encodeFunction("hex")},
+	{"hexDecode", decodeFunction(hex.DecodeString)},
+
+	{
+		"uuid",
+		func(l *lua.State) int {
+			uuid, err := newUUID()
+
+			if err != nil {
+				lua.Errorf(l, "%s", err)
+				panic("unreachable")
+			}
+
+			l.PushString(uuid)
+
+			return 1
+		},
+	},
+
+	{
+		// randomBytes returns n bytes from the system's secure random generator, as a raw
+		// string unless an encoding is given
+		"randomBytes",
+		func(l *lua.State) int {
+			n := lua.CheckInteger(l, 1)
+
+			if n < 0 || n > 1<<20 {
+				lua.ArgumentError(l, 1, "must be between 0 and 1048576")
+				panic("unreachable")
+			}
+
+			b := make([]byte, n)
+
+			if _, err := rand.Read(b); err != nil {
+				lua.Errorf(l, "%s", err)
+				panic("unreachable")
+			}
+
+			return pushEncoded(l, b, lua.OptString(l, 2, "raw"))
+		},
+	},
+
+	{
+		"jwtSign",
+		func(l *lua.State) int {
+			lua.CheckType(l, 1, lua.TypeTable)
+
+			claims, ok := checkEncodable(l, 1).(map[string]interface{})
+
+			if !ok {
+				claims = map[string]interface{}{}
+			}
+
+			key := lua.CheckString(l, 2)
+			algorithm := jwtHS256
+			var header map[string]interface{}
+
+			if !l.IsNoneOrNil(3) {
+				lua.CheckType(l, 3, lua.TypeTable)
+
+				if a := optionString(l, 3, "algorithm"); a != "" {
+					algorithm = a
+				}
+
+				header = optionTable(l, 3, "header")
+			}
+
+			token, err := signJWT(claims, header, algorithm, key)
+
+			if err != nil {
+				lua.Errorf(l, "%s", err)
+				panic("unreachable")
+			}
+
+			l.PushString(token)
+
+			return 1
+		},
+	},
+
+	{
+		// jwtVerify returns the claims of a valid token, or nil and the reason the token
+		// was rejected. The `algorithm` option names the algorithm the token must use, HS256
+		// by default.
+		"jwtVerify",
+		func(l *lua.State) int {
+			token := lua.CheckString(l, 1)
+			key := lua.CheckString(l, 2)
+			algorithm := jwtHS256
+
+			if !l.IsNoneOrNil(3) {
+				lua.CheckType(l, 3, lua.TypeTable)
+
+				if a := optionString(l, 3, "algorithm"); a != "" {
+					algorithm = a
+				}
+			}
+
+			if algorithm != jwtHS256 && algorithm != jwtRS256 {
+				lua.Errorf(l, "Unsupported JWT algorithm `%s`. Must be either `HS256` or `RS256`.", algorithm)
+				panic("unreachable")
+			}
+
+			claims, err := verifyJWT(token, key, algorithm, time.Now())
+
+			if err != nil {
+				l.PushNil()
+				l.PushString(err.Error())
+
+				return 2
+			}
+
+			pushValue(l, claims)
+
+			return 1
+		},
+	},
+}
+
+func openCryptoLibrary(l *lua.State) {
+	open := func(l *lua.State) int {
+		lua.NewLibrary(l, cryptoLibrary)
+		return 1
+	}
+
+	lua.Require(l, "telemetry/crypto", open, false)
+	l.Pop(1)
+}
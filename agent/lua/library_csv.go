@@ -0,0 +1,441 @@
+package lua
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"github.com/telemetryapp/go-lua"
+	"github.com/telemetryapp/goluago/util"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// csvOptions are the options shared by decode, encode and open. When decoding, rows are
+// keyed by column if there is a header or if the columns are given.
+type csvOptions struct {
+	Header     bool
+	Delimiter  rune
+	Comment    rune
+	Trim       bool
+	LazyQuotes bool
+	Columns    []string
+}
+
+// csvFile is a file opened with csv.open, read one row at a time. Files that are still open
+// when the run ends are closed.
+type csvFile struct {
+	file    *os.File
+	reader  *csv.Reader
+	columns []string
+}
+
+func optionRune(l *lua.State, index int, name string) rune {
+	s := optionString(l, index, name)
+
+	if s == "" {
+		return 0
+	}
+
+	if utf8.RuneCountInString(s) != 1 {
+		lua.Errorf(l, "The `%s` option must be a single character", name)
+		panic("unreachable")
+	}
+
+	r, _ := utf8.DecodeRuneInString(s)
+
+	return r
+}
+
+// checkCSVOptions reads the options table at the given index, if any. The delimiter
+// defaults to a comma.
+func checkCSVOptions(l *lua.State, index int) csvOptions {
+	result := csvOptions{Delimiter: ','}
+
+	if l.IsNoneOrNil(index) {
+		return result
+	}
+
+	lua.CheckType(l, index, lua.TypeTable)
+
+	l.Field(index, "header")
+	result.Header = l.ToBoolean(-1)
+	l.Pop(1)
+
+	l.Field(index, "trim")
+	result.Trim = l.ToBoolean(-1)
+	l.Pop(1)
+
+	l.Field(index, "lazy_quotes")
+	result.LazyQuotes = l.ToBoolean(-1)
+	l.Pop(1)
+
+	if r := optionRune(l, index, "delimiter"); r != 0 {
+		result.Delimiter = r
+	}
+
+	result.Comment = optionRune(l, index, "comment")
+
+	l.Field(index, "columns")
+
+	if l.IsTable(-1) {
+		result.Columns = checkStringList(l, l.Top())
+	}
+
+	l.Pop(1)
+
+	return result
+}
+
+// checkStringList reads a list of strings; numbers are converted
+func checkStringList(l *lua.State, index int) []string {
+	result := []string{}
+
+	for i := 1; i <= l.RawLength(index); i++ {
+		l.RawGetInt(index, i)
+		s, ok := l.ToString(-1)
+		l.Pop(1)
+
+		if !ok {
+			lua.Errorf(l, "Expected a list of strings")
+			panic("unreachable")
+		}
+
+		result = append(result, s)
+	}
+
+	return result
+}
+
+func (o csvOptions) reader(r io.Reader) *csv.Reader {
+	reader := csv.NewReader(r)
+
+	reader.Comma = o.Delimiter
+	reader.Comment = o.Comment
+	reader.TrimLeadingSpace = o.Trim
+	reader.LazyQuotes = o.LazyQuotes
+	reader.FieldsPerRecord = -1
+
+	return reader
+}
+
+// pushCSVRecord pushes a record as an array, or as a table keyed by column if there is a
+// header. Fields beyond the header are dropped, and missing fields are nil.
+func pushCSVRecord(l *lua.State, record []string, columns []string) {
+	if columns == nil {
+		pushStringArray(l, record)
+		return
+	}
+
+	l.NewTable()
+
+	for index, column := range columns {
+		if index < len(record) {
+			l.PushString(record[index])
+			l.SetField(-2, column)
+		}
+	}
+}
+
+// csvText formats a value for a field
+func csvText(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+
+	case string:
+		return v
+
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+
+	case bool:
+		return strconv.FormatBool(v)
+	}
+
+	return fmt.Sprint(value)
+}
+
+// checkCSVRecords reads the rows to encode at the given index. Rows are either lists of
+// fields or tables keyed by column; the columns are taken from the options, from the
+// `columns` field of the rows as set by decode, or else from the keys of the rows, in
+// alphabetical order. Rows keyed by column are always encoded with a header.
+func checkCSVRecords(l *lua.State, index int, options csvOptions) (columns []string, records [][]string, keyed bool) {
+	lua.CheckType(l, index, lua.TypeTable)
+
+	columns = options.Columns
+
+	if columns == nil {
+		l.Field(index, "columns")
+
+		if l.IsTable(-1) {
+			columns = checkStringList(l, l.Top())
+		}
+
+		l.Pop(1)
+	}
+
+	lists := [][]string{}
+	tables := []map[string]interface{}{}
+	keys := map[string]bool{}
+
+	for i := 1; i <= l.RawLength(index); i++ {
+		l.RawGetInt(index, i)
+
+		if !l.IsTable(-1) {
+			lua.Errorf(l, "Each row must be a table")
+			panic("unreachable")
+		}
+
+		if l.RawLength(-1) > 0 {
+			record := []string{}
+
+			for j := 1; j <= l.RawLength(-1); j++ {
+				l.RawGetInt(-1, j)
+				record = append(record, csvText(l.ToValue(-1)))
+				l.Pop(1)
+			}
+
+			lists = append(lists, record)
+		} else {
+			value, err := util.PullTable(l, l.Top())
+
+			if err != nil {
+				lua.Errorf(l, "%s", err)
+				panic("unreachable")
+			}
+
+			row, _ := value.(map[string]interface{})
+
+			for key := range row {
+				keys[key] = true
+			}
+
+			tables = append(tables, row)
+		}
+
+		l.Pop(1)
+	}
+
+	if len(tables) > 0 && len(lists) > 0 {
+		lua.Errorf(l, "Rows must be either all lists or all tables keyed by column")
+		panic("unreachable")
+	}
+
+	if len(tables) == 0 {
+		return columns, lists, false
+	}
+
+	if columns == nil {
+		columns = []string{}
+
+		for key := range keys {
+			columns = append(columns, key)
+		}
+
+		sort.Strings(columns)
+	}
+
+	for _, row := range tables {
+		record := make([]string, len(columns))
+
+		for index, column := range columns {
+			record[index] = csvText(row[column])
+		}
+
+		lists = append(lists, record)
+	}
+
+	return columns, lists, true
+}
+
+var csvFileFunctions = map[string]func(f *csvFile) lua.Function{
+	"read": func(f *csvFile) lua.Function {
+		return func(l *lua.State) int {
+			return f.pushNext(l)
+		}
+	},
+
+	"rows": func(f *csvFile) lua.Function {
+		return func(l *lua.State) int {
+			l.PushGoFunction(func(l *lua.State) int {
+				return f.pushNext(l)
+			})
+
+			return 1
+		}
+	},
+
+	"close": func(f *csvFile) lua.Function {
+		return func(l *lua.State) int {
+			f.close()
+
+			return 0
+		}
+	},
+}
+
+// pushNext pushes the next row, or nil at the end of the file, at which point the file
+// is closed
+func (f *csvFile) pushNext(l *lua.State) int {
+	if f.file == nil {
+		l.PushNil()
+		return 1
+	}
+
+	record, err := f.reader.Read()
+
+	if err == io.EOF {
+		f.close()
+		l.PushNil()
+
+		return 1
+	}
+
+	if err != nil {
+		f.close()
+		lua.Errorf(l, "%s", err)
+		panic("unreachable")
+	}
+
+	pushCSVRecord(l, record, f.columns)
+
+	return 1
+}
+
+func (f *csvFile) close() {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+}
+
+// release closes the file, if the script has not read it to the end or closed it
+func (f *csvFile) release() {
+	f.close()
+}
+
+var csvLibrary = []lua.RegistryFunction{
+	{
+		"decode",
+		func(l *lua.State) int {
+			data := lua.CheckString(l, 1)
+			options := checkCSVOptions(l, 2)
+
+			records, err := options.reader(bytes.NewBufferString(data)).ReadAll()
+
+			if err != nil {
+				lua.Errorf(l, "%s", err)
+				panic("unreachable")
+			}
+
+			columns := options.Columns
+
+			if options.Header && len(records) > 0 {
+				if columns == nil {
+					columns = records[0]
+				}
+
+				records = records[1:]
+			}
+
+			pushArray(l)
+
+			for index, record := range records {
+				pushCSVRecord(l, record, columns)
+				l.RawSetInt(-2, index+1)
+			}
+
+			if columns != nil {
+				pushStringArray(l, columns)
+				l.SetField(-2, "columns")
+			}
+
+			return 1
+		},
+	},
+
+	{
+		"encode",
+		func(l *lua.State) int {
+			options := checkCSVOptions(l, 2)
+			columns, records, keyed := checkCSVRecords(l, 1, options)
+
+			if columns != nil && (keyed || options.Header) {
+				records = append([][]string{columns}, records...)
+			}
+
+			b := &bytes.Buffer{}
+			w := csv.NewWriter(b)
+			w.Comma = options.Delimiter
+
+			if err := w.WriteAll(records); err != nil {
+				lua.Errorf(l, "%s", err)
+				panic("unreachable")
+			}
+
+			l.PushString(b.String())
+
+			return 1
+		},
+	},
+
+	{
+		"open",
+		func(l *lua.State) int {
+			path := lua.CheckString(l, 1)
+			options := checkCSVOptions(l, 2)
+
+			file, err := os.Open(path)
+
+			if err != nil {
+				lua.Errorf(l, "%s", err)
+				panic("unreachable")
+			}
+
+			f := &csvFile{file: file, reader: options.reader(file), columns: options.Columns}
+
+			runContextFor(l).track(f)
+
+			if options.Header {
+				columns, err := f.reader.Read()
+
+				if err != nil && err != io.EOF {
+					f.close()
+					lua.Errorf(l, "%s", err)
+					panic("unreachable")
+				}
+
+				if f.columns == nil {
+					f.columns = columns
+				}
+			}
+
+			l.NewTable()
+
+			for name, fn := range csvFileFunctions {
+				l.PushGoFunction(fn(f))
+				l.SetField(-2, name)
+			}
+
+			if f.columns != nil {
+				pushStringArray(l, f.columns)
+				l.SetField(-2, "columns")
+			}
+
+			return 1
+		},
+	},
+}
+
+func openCSVLibrary(l *lua.State) {
+	open := func(l *lua.State) int {
+		lua.NewLibrary(l, csvLibrary)
+		return 1
+	}
+
+	lua.Require(l, "telemetry/csv", open, false)
+	l.Pop(1)
+}
@@ -1,11 +1,103 @@
 package lua
 
 import (
+	"fmt"
 	"github.com/tealeg/xlsx"
 	"github.com/telemetryapp/go-lua"
 	"github.com/telemetryapp/goluago/util"
+	"time"
 )
 
+// excelDateLayouts are the layouts accepted for the `date` of a cell written with excel.write
+var excelDateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// setExcelCell sets a cell from the value at the top of the stack: a number, a boolean, a
+// string, nil for an empty cell, or a table with either a `formula` or a `date` field
+func setExcelCell(l *lua.State, cell *xlsx.Cell) {
+	switch l.TypeOf(-1) {
+	case lua.TypeNil:
+
+	case lua.TypeNumber:
+		f, _ := l.ToNumber(-1)
+		cell.SetFloat(f)
+
+	case lua.TypeBoolean:
+		cell.SetBool(l.ToBoolean(-1))
+
+	case lua.TypeTable:
+		if formula := optionString(l, l.Top(), "formula"); formula != "" {
+			cell.SetFormula(formula)
+			return
+		}
+
+		if date := optionString(l, l.Top(), "date"); date != "" {
+			for _, layout := range excelDateLayouts {
+				if t, err := time.Parse(layout, date); err == nil {
+					cell.SetDateTime(t)
+					return
+				}
+			}
+
+			lua.Errorf(l, "Invalid date `%s`", date)
+			panic("unreachable")
+		}
+
+		lua.Errorf(l, "Tables written to cells must have either a `formula` or a `date`")
+		panic("unreachable")
+
+	default:
+		s, _ := l.ToString(-1)
+		cell.SetString(s)
+	}
+}
+
+// addExcelSheet adds the sheet described by the table at the top of the stack
+func addExcelSheet(l *lua.State, f *xlsx.File, index int) {
+	name := optionString(l, l.Top(), "name")
+
+	if name == "" {
+		name = fmt.Sprintf("Sheet%d", index)
+	}
+
+	sheet, err := f.AddSheet(name)
+
+	if err != nil {
+		lua.Errorf(l, "%s", err)
+		panic("unreachable")
+	}
+
+	l.Field(-1, "rows")
+	defer l.Pop(1)
+
+	if l.IsNil(-1) {
+		return
+	}
+
+	if !l.IsTable(-1) {
+		lua.Errorf(l, "The rows of the sheet %s must be a list", name)
+		panic("unreachable")
+	}
+
+	for i := 1; i <= l.RawLength(-1); i++ {
+		row := sheet.AddRow()
+
+		l.RawGetInt(-1, i)
+
+		for j := 1; j <= l.RawLength(-1); j++ {
+			l.RawGetInt(-1, j)
+			setExcelCell(l, row.AddCell())
+			l.Pop(1)
+		}
+
+		l.Pop(1)
+	}
+}
+
 var excelLibrary = []lua.RegistryFunction{
 	{
 		"import",
@@ -24,6 +116,56 @@ var excelLibrary = []lua.RegistryFunction{
 			return 1
 		},
 	},
+
+	{
+		"open",
+		func(l *lua.State) int {
+			f, err := xlsx.OpenFile(lua.CheckString(l, 1))
+
+			if err != nil {
+				lua.Errorf(l, "%s", err)
+				panic("unreachable")
+			}
+
+			pushExcelWorkbook(l, f)
+
+			return 1
+		},
+	},
+
+	{
+		"write",
+		func(l *lua.State) int {
+			path := lua.CheckString(l, 1)
+			lua.CheckType(l, 2, lua.TypeTable)
+
+			f := xlsx.NewFile()
+
+			for i := 1; i <= l.RawLength(2); i++ {
+				l.RawGetInt(2, i)
+
+				if !l.IsTable(-1) {
+					lua.Errorf(l, "Each sheet must be a table with a `name` and `rows`")
+					panic("unreachable")
+				}
+
+				addExcelSheet(l, f, i)
+				l.Pop(1)
+			}
+
+			if len(f.Sheets) == 0 {
+				lua.Errorf(l, "A workbook must have at least one sheet")
+				panic("unreachable")
+			}
+
+			if err := f.Save(path); err != nil {
+				lua.Errorf(l, "%s", err)
+				panic("unreachable")
+			}
+
+			return 0
+		},
+	},
 }
 
 func openExcelLibrary(l *lua.State) {
@@ -0,0 +1,316 @@
+package lua
+
+import (
+	"errors"
+	"github.com/tealeg/xlsx"
+	"github.com/telemetryapp/go-lua"
+	"github.com/telemetryapp/goluago/util"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The largest worksheet Excel supports, which ends at cell XFD1048576
+const (
+	excelMaxRows    = 1048576
+	excelMaxColumns = 16384
+)
+
+// excelRange is a rectangle of cells; indices start at 0
+type excelRange struct {
+	FirstRow, FirstCol, LastRow, LastCol int
+}
+
+// clamp restricts a range to the cells that exist in a sheet, so that a reference such
+// as `A1:XFD1048576` costs no more than the sheet itself. A range that lies entirely
+// outside of the sheet becomes empty.
+func (r excelRange) clamp(sheet *xlsx.Sheet) excelRange {
+	if r.LastRow >= len(sheet.Rows) {
+		r.LastRow = len(sheet.Rows) - 1
+	}
+
+	if maxCol := excelMaxCol(sheet); r.LastCol >= maxCol {
+		r.LastCol = maxCol - 1
+	}
+
+	return r
+}
+
+// parseExcelCell converts a reference such as `B12` into zero-based row and column indices.
+// References beyond the last cell Excel supports, XFD1048576, are rejected.
+func parseExcelCell(ref string) (int, int, error) {
+	ref = strings.ToUpper(strings.Replace(ref, "$", "", -1))
+	invalid := errors.New("Invalid cell reference `" + ref + "`")
+
+	col := 0
+	index := 0
+
+	for ; index < len(ref) && ref[index] >= 'A' && ref[index] <= 'Z'; index++ {
+		if col = col*26 + int(ref[index]-'A') + 1; col > excelMaxColumns {
+			return 0, 0, invalid
+		}
+	}
+
+	digits := ref[index:]
+
+	if index == 0 || digits == "" || digits[0] < '0' || digits[0] > '9' {
+		return 0, 0, invalid
+	}
+
+	row, err := strconv.Atoi(digits)
+
+	if err != nil || row < 1 || row > excelMaxRows {
+		return 0, 0, invalid
+	}
+
+	return row - 1, col - 1, nil
+}
+
+// parseExcelRange converts a reference such as `A1:D20`, or a single cell
+func parseExcelRange(ref string) (excelRange, error) {
+	parts := strings.Split(ref, ":")
+
+	if len(parts) > 2 {
+		return excelRange{}, errors.New("Invalid range `" + ref + "`")
+	}
+
+	firstRow, firstCol, err := parseExcelCell(parts[0])
+
+	if err != nil {
+		return excelRange{}, err
+	}
+
+	lastRow, lastCol := firstRow, firstCol
+
+	if len(parts) == 2 {
+		if lastRow, lastCol, err = parseExcelCell(parts[1]); err != nil {
+			return excelRange{}, err
+		}
+	}
+
+	if lastRow < firstRow {
+		firstRow, lastRow = lastRow, firstRow
+	}
+
+	if lastCol < firstCol {
+		firstCol, lastCol = lastCol, firstCol
+	}
+
+	return excelRange{firstRow, firstCol, lastRow, lastCol}, nil
+}
+
+// isExcelDateFormat reports whether a number format displays a date or a time. Literal text
+// in quotes and bracketed sections such as colors are ignored.
+func isExcelDateFormat(format string) bool {
+	quoted := false
+	bracketed := false
+
+	for index := 0; index < len(format); index++ {
+		c := format[index]
+
+		switch {
+		case c == '"':
+			quoted = !quoted
+
+		case quoted:
+
+		case c == '[':
+			bracketed = true
+
+		case c == ']':
+			bracketed = false
+
+		case bracketed:
+
+		case c == '\\' || c == '_' || c == '*':
+			index++
+
+		default:
+			switch c {
+			case 'y', 'Y', 'm', 'M', 'd', 'D', 'h', 'H', 's', 'S':
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// excelValue converts a cell into a number, a boolean, a string, or nil if the cell is
+// empty. Dates are ISO 8601 strings, and formulas are converted to their last computed
+// result.
+func excelValue(cell *xlsx.Cell, date1904 bool) interface{} {
+	if cell == nil || cell.Value == "" {
+		return nil
+	}
+
+	switch cell.Type() {
+	case xlsx.CellTypeString, xlsx.CellTypeInline, xlsx.CellTypeError:
+		return cell.Value
+
+	case xlsx.CellTypeBool:
+		return cell.Value == "1" || strings.ToLower(cell.Value) == "true"
+	}
+
+	f, err := strconv.ParseFloat(cell.Value, 64)
+
+	if err != nil {
+		return cell.Value
+	}
+
+	if isExcelDateFormat(cell.GetNumberFormat()) {
+		return xlsx.TimeFromExcelTime(f, date1904).Round(time.Millisecond).Format(time.RFC3339Nano)
+	}
+
+	return f
+}
+
+func excelCell(sheet *xlsx.Sheet, row, col int) *xlsx.Cell {
+	if row >= len(sheet.Rows) || sheet.Rows[row] == nil || col >= len(sheet.Rows[row].Cells) {
+		return nil
+	}
+
+	return sheet.Rows[row].Cells[col]
+}
+
+// pushExcelRange pushes the values of a range as an array of rows, each an array of
+// values; empty cells are nil
+func pushExcelRange(l *lua.State, sheet *xlsx.Sheet, r excelRange, date1904 bool) {
+	pushArray(l)
+
+	for row := r.FirstRow; row <= r.LastRow; row++ {
+		pushArray(l)
+
+		for col := r.FirstCol; col <= r.LastCol; col++ {
+			if value := excelValue(excelCell(sheet, row, col), date1904); value != nil {
+				util.DeepPush(l, value)
+				l.RawSetInt(-2, col-r.FirstCol+1)
+			}
+		}
+
+		l.RawSetInt(-2, row-r.FirstRow+1)
+	}
+}
+
+func excelMaxCol(sheet *xlsx.Sheet) int {
+	result := 0
+
+	for _, row := range sheet.Rows {
+		if row != nil && len(row.Cells) > result {
+			result = len(row.Cells)
+		}
+	}
+
+	return result
+}
+
+var excelSheetFunctions = map[string]func(sheet *xlsx.Sheet, date1904 bool) lua.Function{
+	"range": func(sheet *xlsx.Sheet, date1904 bool) lua.Function {
+		return func(l *lua.State) int {
+			r, err := parseExcelRange(lua.CheckString(l, 1))
+
+			if err != nil {
+				lua.Errorf(l, "%s", err)
+				panic("unreachable")
+			}
+
+			pushExcelRange(l, sheet, r.clamp(sheet), date1904)
+
+			return 1
+		}
+	},
+
+	"cell": func(sheet *xlsx.Sheet, date1904 bool) lua.Function {
+		return func(l *lua.State) int {
+			row, col, err := parseExcelCell(lua.CheckString(l, 1))
+
+			if err != nil {
+				lua.Errorf(l, "%s", err)
+				panic("unreachable")
+			}
+
+			if value := excelValue(excelCell(sheet, row, col), date1904); value != nil {
+				util.DeepPush(l, value)
+			} else {
+				l.PushNil()
+			}
+
+			return 1
+		}
+	},
+
+	"rows": func(sheet *xlsx.Sheet, date1904 bool) lua.Function {
+		return func(l *lua.State) int {
+			pushExcelRange(l, sheet, excelRange{0, 0, len(sheet.Rows) - 1, excelMaxCol(sheet) - 1}, date1904)
+
+			return 1
+		}
+	},
+}
+
+func pushExcelSheet(l *lua.State, sheet *xlsx.Sheet, date1904 bool) {
+	l.NewTable()
+
+	for name, fn := range excelSheetFunctions {
+		l.PushGoFunction(fn(sheet, date1904))
+		l.SetField(-2, name)
+	}
+
+	l.PushString(sheet.Name)
+	l.SetField(-2, "name")
+
+	l.PushInteger(len(sheet.Rows))
+	l.SetField(-2, "max_row")
+
+	l.PushInteger(excelMaxCol(sheet))
+	l.SetField(-2, "max_col")
+}
+
+var excelWorkbookFunctions = map[string]func(f *xlsx.File) lua.Function{
+	"sheets": func(f *xlsx.File) lua.Function {
+		return func(l *lua.State) int {
+			pushArray(l)
+
+			for index, sheet := range f.Sheets {
+				l.PushString(sheet.Name)
+				l.RawSetInt(-2, index+1)
+			}
+
+			return 1
+		}
+	},
+
+	"sheet": func(f *xlsx.File) lua.Function {
+		return func(l *lua.State) int {
+			var sheet *xlsx.Sheet
+
+			if l.IsNumber(1) {
+				index := lua.CheckInteger(l, 1)
+
+				if index >= 1 && index <= len(f.Sheets) {
+					sheet = f.Sheets[index-1]
+				}
+			} else {
+				sheet = f.Sheet[lua.CheckString(l, 1)]
+			}
+
+			if sheet == nil {
+				l.PushNil()
+				return 1
+			}
+
+			pushExcelSheet(l, sheet, f.Date1904)
+
+			return 1
+		}
+	},
+}
+
+func pushExcelWorkbook(l *lua.State, f *xlsx.File) {
+	l.NewTable()
+
+	for name, fn := range excelWorkbookFunctions {
+		l.PushGoFunction(fn(f))
+		l.SetField(-2, name)
+	}
+}
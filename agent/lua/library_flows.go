@@ -0,0 +1,345 @@
+package lua
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/telemetryapp/go-lua"
+	"github.com/telemetryapp/goluago/util"
+	"github.com/telemetryapp/gotelemetry"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"github.com/telemetryapp/gotelemetry_agent/agent/schema"
+	"github.com/telemetryapp/gotelemetry_agent/agent/sink"
+)
+
+// flowProvider is implemented by jobs, which are passed to scripts as their notification
+// provider
+type flowProvider interface {
+	GetFlowTagLayout(tag string) (*gotelemetry.Flow, error)
+	ReadFlow(f *gotelemetry.Flow) error
+	GetOrCreateFlow(tag, variant string, template interface{}) (*gotelemetry.Flow, error)
+	GetOrCreateBoard(name, prefix string, templateSource string) (*gotelemetry.Board, error)
+	SetFlowError(tag string, body interface{})
+	QueueDataUpdate(tag string, data interface{}, updateType gotelemetry.BatchType)
+}
+
+// flowProviderFor returns the job running the script. When replaying, there is no job;
+// the calls are then served by the tape, and writes are skipped.
+func flowProviderFor(l *lua.State) flowProvider {
+	p, ok := notificationProviderFor(l).(flowProvider)
+
+	if !ok && !tapeFor(l).Replaying() {
+		lua.Errorf(l, "Flows are not available in this context")
+		panic("unreachable")
+	}
+
+	return p
+}
+
+// getFlow looks up an existing flow of the given variant
+func getFlow(p flowProvider, tag, variant string) (interface{}, error) {
+	f, err := p.GetFlowTagLayout(tag)
+
+	if err != nil {
+		return nil, fmt.Errorf("The flow with the tag `%s` could not be found, and flows are not created in debug mode", tag)
+	}
+
+	if f.Variant != variant {
+		return nil, fmt.Errorf("Flow %s is of type %s instead of the expected %s", f.Id, f.Variant, variant)
+	}
+
+	return flowFields(f)
+}
+
+// flowFields converts a flow into a table that can be recorded and pushed to Lua
+func flowFields(f *gotelemetry.Flow) (interface{}, error) {
+	data, err := json.Marshal(f.Data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var d interface{}
+
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"id":      f.Id,
+		"tag":     f.Tag,
+		"variant": f.Variant,
+		"data":    d,
+	}, nil
+}
+
+// flowVariant returns the variant of a flow, looking it up at most once per run. Flows that
+// cannot be found have no variant, and their updates are not validated.
+func flowVariant(l *lua.State, p flowProvider, tag string) string {
+	c := runContextFor(l)
+
+	if variant, ok := c.variants[tag]; ok {
+		return variant
+	}
+
+	variant, _ := tapeFor(l).DoString("flow", "variant "+tag, func() (string, error) {
+		f, err := p.GetFlowTagLayout(tag)
+
+		if err != nil {
+			return "", err
+		}
+
+		return f.Variant, nil
+	})
+
+	c.variants[tag] = variant
+
+	return variant
+}
+
+// checkFlowData raises an error if a payload does not match the schema of a flow variant.
+// JSON-Patch operations are not validated.
+func checkFlowData(l *lua.State, tag, variant string, data interface{}, updateType gotelemetry.BatchType) {
+	d, ok := data.(map[string]interface{})
+
+	if !ok || updateType == gotelemetry.BatchTypeJSONPATCH {
+		return
+	}
+
+	if err := schema.Validate(variant, d, updateType == gotelemetry.BatchTypePATCH); err != nil {
+		lua.Errorf(l, "Invalid data for %s flow %s: %s", variant, tag, err)
+		panic("unreachable")
+	}
+}
+
+// recordKey builds the key under which a call is recorded from its name and arguments
+func recordKey(name string, args ...interface{}) string {
+	a, _ := json.Marshal(args)
+
+	return name + " " + string(a)
+}
+
+func optTable(l *lua.State, index int) interface{} {
+	if l.IsNoneOrNil(index) {
+		return nil
+	}
+
+	lua.CheckType(l, index, lua.TypeTable)
+
+	result, err := util.PullTable(l, index)
+
+	if err != nil {
+		lua.Errorf(l, "%s", err)
+		panic("unreachable")
+	}
+
+	return result
+}
+
+var flowsLibrary = []lua.RegistryFunction{
+	{
+		"read",
+		func(l *lua.State) int {
+			tag := lua.CheckString(l, 1)
+			p := flowProviderFor(l)
+
+			result, err := tapeFor(l).Do("flow", "read "+tag, func() (interface{}, error) {
+				f, err := p.GetFlowTagLayout(tag)
+
+				if err != nil {
+					return nil, err
+				}
+
+				if err := p.ReadFlow(f); err != nil {
+					return nil, err
+				}
+
+				return flowFields(f)
+			})
+
+			if err != nil {
+				lua.Errorf(l, "%s", err)
+				panic("unreachable")
+			}
+
+			util.DeepPush(l, result)
+
+			return 1
+		},
+	},
+
+	{
+		"getOrCreate",
+		func(l *lua.State) int {
+			tag := lua.CheckString(l, 1)
+			variant := lua.CheckString(l, 2)
+			template := optTable(l, 3)
+			p := flowProviderFor(l)
+
+			checkFlowData(l, tag, variant, template, gotelemetry.BatchTypePOST)
+
+			result, err := tapeFor(l).Do("flow", recordKey("getOrCreate", tag, variant, template), func() (interface{}, error) {
+				if config.CLIConfig.DebugMode {
+					// Flows are not created in debug mode
+					return getFlow(p, tag, variant)
+				}
+
+				f, err := p.GetOrCreateFlow(tag, variant, template)
+
+				if err != nil {
+					return nil, err
+				}
+
+				return flowFields(f)
+			})
+
+			if err != nil {
+				lua.Errorf(l, "%s", err)
+				panic("unreachable")
+			}
+
+			util.DeepPush(l, result)
+
+			return 1
+		},
+	},
+
+	{
+		"importBoard",
+		func(l *lua.State) int {
+			name := lua.CheckString(l, 1)
+			prefix := lua.CheckString(l, 2)
+
+			var template string
+
+			if l.IsTable(3) {
+				t, err := json.Marshal(optTable(l, 3))
+
+				if err != nil {
+					lua.Errorf(l, "%s", err)
+					panic("unreachable")
+				}
+
+				template = string(t)
+			} else {
+				template = lua.CheckString(l, 3)
+			}
+
+			p := flowProviderFor(l)
+
+			result, err := tapeFor(l).Do("flow", recordKey("importBoard", name, prefix, template), func() (interface{}, error) {
+				if config.CLIConfig.DebugMode {
+					return nil, fmt.Errorf("Board %s cannot be imported in debug mode", name)
+				}
+
+				b, err := p.GetOrCreateBoard(name, prefix, template)
+
+				if err != nil {
+					return nil, err
+				}
+
+				flows, err := b.MapWidgetsToFlows()
+
+				if err != nil {
+					return nil, err
+				}
+
+				tags := map[string]interface{}{}
+
+				for tag, f := range flows {
+					tags[tag] = f.Tag
+				}
+
+				return map[string]interface{}{
+					"id":    b.Id,
+					"name":  b.Name,
+					"flows": tags,
+				}, nil
+			})
+
+			if err != nil {
+				lua.Errorf(l, "%s", err)
+				panic("unreachable")
+			}
+
+			util.DeepPush(l, result)
+
+			return 1
+		},
+	},
+
+	{
+		"setError",
+		func(l *lua.State) int {
+			tag := lua.CheckString(l, 1)
+			message := lua.CheckString(l, 2)
+			p := flowProviderFor(l)
+
+			tapeFor(l).Do("flow", recordKey("setError", tag, message), func() (interface{}, error) {
+				if config.CLIConfig.DebugMode {
+					fmt.Printf("\nNot setting the error status of \"%s\" in debug mode: %s\n", tag, message)
+					return nil, nil
+				}
+
+				p.SetFlowError(tag, map[string]interface{}{"message": message})
+
+				return nil, nil
+			})
+
+			return 0
+		},
+	},
+
+	{
+		"queueUpdate",
+		func(l *lua.State) int {
+			tag := lua.CheckString(l, 1)
+			lua.CheckType(l, 2, lua.TypeTable)
+
+			// Sequences, such as the operations of a JSON-Patch update, are sent as arrays
+			data := pulledValue(optTable(l, 2))
+
+			updateType, err := sink.ParseType(lua.OptString(l, 3, "patch"))
+
+			if err != nil {
+				lua.Errorf(l, "%s", err)
+				panic("unreachable")
+			}
+
+			p := flowProviderFor(l)
+
+			checkFlowData(l, tag, flowVariant(l, p, tag), data, updateType)
+
+			tapeFor(l).Do("flow", recordKey("queueUpdate", tag, data, sink.TypeName(updateType)), func() (interface{}, error) {
+				if config.CLIConfig.DebugMode {
+					// Print the update instead of sending it
+					jsonOutput, err := json.MarshalIndent(data, "", "  ")
+
+					if err != nil {
+						return nil, err
+					}
+
+					fmt.Printf("\nPrinting the output results of \"%s\" (%s):\n", tag, sink.TypeName(updateType))
+					fmt.Println(string(jsonOutput))
+
+					return nil, nil
+				}
+
+				p.QueueDataUpdate(tag, data, updateType)
+
+				return nil, nil
+			})
+
+			return 0
+		},
+	},
+}
+
+func openFlowsLibrary(l *lua.State) {
+	open := func(l *lua.State) int {
+		lua.NewLibrary(l, flowsLibrary)
+		return 1
+	}
+
+	lua.Require(l, "telemetry/flows", open, false)
+	l.Pop(1)
+}
@@ -4,10 +4,15 @@ import (
 	"bytes"
 	"github.com/telemetryapp/go-lua"
 	"github.com/telemetryapp/goluago/util"
+	"github.com/telemetryapp/gotelemetry_agent/agent/httpclient"
 	"io/ioutil"
 	"net/http"
 )
 
+// httpLibrary holds http.request and http.all, and the older http.get, http.post and
+// http.custom. The older functions always use the default HTTP profile, or a plain client
+// that times out after a minute if there is none; scripts that need another profile, or
+// another timeout, use http.request.
 var httpLibrary = []lua.RegistryFunction{
 	{
 		"get",
@@ -46,21 +51,13 @@ var httpLibrary = []lua.RegistryFunction{
 				req.SetBasicAuth(username, password)
 			}
 
-			resp, err := http.DefaultClient.Do(req)
+			data, err := performHTTPRequest(l, req)
 			if err != nil {
 				lua.Errorf(l, "%s", err)
 				panic("unreachable")
 			}
 
-			defer resp.Body.Close()
-
-			data, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				lua.Errorf(l, "%s", err)
-				panic("unreachable")
-			}
-
-			util.DeepPush(l, string(data))
+			util.DeepPush(l, data)
 
 			return 1
 		},
@@ -104,21 +101,13 @@ var httpLibrary = []lua.RegistryFunction{
 				req.SetBasicAuth(username, password)
 			}
 
-			resp, err := http.DefaultClient.Do(req)
-			if err != nil {
-				lua.Errorf(l, "%s", err)
-				panic("unreachable")
-			}
-
-			defer resp.Body.Close()
-
-			data, err := ioutil.ReadAll(resp.Body)
+			data, err := performHTTPRequest(l, req)
 			if err != nil {
 				lua.Errorf(l, "%s", err)
 				panic("unreachable")
 			}
 
-			util.DeepPush(l, string(data))
+			util.DeepPush(l, data)
 
 			return 1
 		},
@@ -173,25 +162,52 @@ var httpLibrary = []lua.RegistryFunction{
 				req.SetBasicAuth(username, password)
 			}
 
-			resp, err := http.DefaultClient.Do(req)
-			if err != nil {
-				lua.Errorf(l, "%s", err)
-				panic("unreachable")
-			}
-
-			defer resp.Body.Close()
-
-			data, err := ioutil.ReadAll(resp.Body)
+			data, err := performHTTPRequest(l, req)
 			if err != nil {
 				lua.Errorf(l, "%s", err)
 				panic("unreachable")
 			}
 
-			util.DeepPush(l, string(data))
+			util.DeepPush(l, data)
 
 			return 1
 		},
 	},
+
+	{
+		"request",
+		httpRequestFunction,
+	},
+
+	{
+		"all",
+		httpAllFunction,
+	},
+}
+
+// performHTTPRequest returns the body of the response, going through the run's tape
+// when recording or replaying. Requests use the default HTTP profile, and are bounded by
+// httpclient.DefaultTimeout when there is none.
+func performHTTPRequest(l *lua.State, req *http.Request) (string, error) {
+	return tapeFor(l).DoString("http", req.Method+" "+req.URL.String(), func() (string, error) {
+		client, err := httpclient.Get("")
+
+		if err != nil {
+			return "", err
+		}
+
+		resp, err := client.Do(req)
+
+		if err != nil {
+			return "", err
+		}
+
+		defer resp.Body.Close()
+
+		data, err := ioutil.ReadAll(resp.Body)
+
+		return string(data), err
+	})
 }
 
 func openHTTPLibrary(l *lua.State) {
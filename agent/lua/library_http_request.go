@@ -0,0 +1,434 @@
+package lua
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/telemetryapp/go-lua"
+	"github.com/telemetryapp/goluago/util"
+	"github.com/telemetryapp/gotelemetry_agent/agent/httpclient"
+	"github.com/telemetryapp/gotelemetry_agent/agent/record"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// httpResponse is the result of http.request, in a form that can be recorded
+type httpResponse struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+// httpRequest is a request built from the options table of http.request
+type httpRequest struct {
+	req     *http.Request
+	client  *http.Client
+	timeout time.Duration
+}
+
+func optionString(l *lua.State, index int, name string) string {
+	l.Field(index, name)
+	defer l.Pop(1)
+
+	if l.IsNil(-1) {
+		return ""
+	}
+
+	if !l.IsString(-1) {
+		lua.Errorf(l, "The `%s` option must be a string", name)
+		panic("unreachable")
+	}
+
+	result, _ := l.ToString(-1)
+
+	return result
+}
+
+func optionTable(l *lua.State, index int, name string) map[string]interface{} {
+	l.Field(index, name)
+	defer l.Pop(1)
+
+	if l.IsNil(-1) {
+		return nil
+	}
+
+	if !l.IsTable(-1) {
+		lua.Errorf(l, "The `%s` option must be a table", name)
+		panic("unreachable")
+	}
+
+	value, err := util.PullTable(l, l.Top())
+
+	if err != nil {
+		lua.Errorf(l, "%s", err)
+		panic("unreachable")
+	}
+
+	result, _ := value.(map[string]interface{})
+
+	return result
+}
+
+// optionDuration reads a duration given either as a number of seconds or as a string
+// such as "1m30s"
+func optionDuration(l *lua.State, index int, name string) time.Duration {
+	l.Field(index, name)
+	defer l.Pop(1)
+
+	switch {
+	case l.IsNil(-1):
+		return 0
+
+	case l.IsNumber(-1):
+		seconds, _ := l.ToNumber(-1)
+		return time.Duration(seconds * float64(time.Second))
+
+	case l.IsString(-1):
+		s, _ := l.ToString(-1)
+		d, err := time.ParseDuration(s)
+
+		if err != nil {
+			lua.Errorf(l, "%s", err)
+			panic("unreachable")
+		}
+
+		return d
+	}
+
+	lua.Errorf(l, "The `%s` option must be a number of seconds or a duration", name)
+	panic("unreachable")
+}
+
+func appendValues(values url.Values, key string, value interface{}) {
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			values.Add(key, fmt.Sprint(item))
+		}
+
+	case map[string]interface{}:
+		for _, item := range v {
+			values.Add(key, fmt.Sprint(item))
+		}
+
+	default:
+		values.Add(key, fmt.Sprint(v))
+	}
+}
+
+// checkHTTPRequest builds a request from the options table at the given index. The
+// `profile` option selects one of the HTTP profiles of the agent's configuration, and
+// `timeout` overrides the profile's timeout.
+func checkHTTPRequest(l *lua.State, index int) httpRequest {
+	lua.CheckType(l, index, lua.TypeTable)
+
+	rawURL := optionString(l, index, "url")
+
+	if rawURL == "" {
+		lua.Errorf(l, "The `url` option is required")
+		panic("unreachable")
+	}
+
+	u, err := url.Parse(rawURL)
+
+	if err != nil {
+		lua.Errorf(l, "%s", err)
+		panic("unreachable")
+	}
+
+	if query := optionTable(l, index, "query"); query != nil {
+		values := u.Query()
+
+		for key, value := range query {
+			appendValues(values, key, value)
+		}
+
+		u.RawQuery = values.Encode()
+	}
+
+	var body io.Reader
+	contentType := ""
+
+	if b := optionString(l, index, "body"); b != "" {
+		body = strings.NewReader(b)
+	}
+
+	l.Field(index, "json")
+
+	if !l.IsNil(-1) {
+		var v interface{}
+
+		if l.IsTable(-1) {
+			if v, err = util.PullTable(l, l.Top()); err != nil {
+				lua.Errorf(l, "%s", err)
+				panic("unreachable")
+			}
+		} else {
+			v = l.ToValue(-1)
+		}
+
+		data, err := json.Marshal(v)
+
+		if err != nil {
+			lua.Errorf(l, "%s", err)
+			panic("unreachable")
+		}
+
+		body = bytes.NewReader(data)
+		contentType = "application/json"
+	}
+
+	l.Pop(1)
+
+	method := strings.ToUpper(optionString(l, index, "method"))
+
+	if method == "" {
+		method = "GET"
+
+		if body != nil {
+			method = "POST"
+		}
+	}
+
+	req, err := http.NewRequest(method, u.String(), body)
+
+	if err != nil {
+		lua.Errorf(l, "%s", err)
+		panic("unreachable")
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	for key, value := range optionTable(l, index, "headers") {
+		req.Header.Set(key, fmt.Sprint(value))
+	}
+
+	if auth := optionTable(l, index, "auth"); auth != nil {
+		if token, ok := auth["bearer"].(string); ok {
+			req.Header.Set("Authorization", "Bearer "+token)
+		} else {
+			username, _ := auth["username"].(string)
+			password, _ := auth["password"].(string)
+
+			req.SetBasicAuth(username, password)
+		}
+	}
+
+	client, err := httpclient.Get(optionString(l, index, "profile"))
+
+	if err != nil {
+		lua.Errorf(l, "%s", err)
+		panic("unreachable")
+	}
+
+	return httpRequest{req: req, client: client, timeout: optionDuration(l, index, "timeout")}
+}
+
+// do performs the request through the run's tape. Only network errors are returned as
+// errors; any response, whatever its status, is a result.
+func (r httpRequest) do(t *record.Tape) (httpResponse, error) {
+	value, err := t.Do("http", r.req.Method+" "+r.req.URL.String(), func() (interface{}, error) {
+		client := r.client
+
+		if r.timeout > 0 {
+			c := *client
+			c.Timeout = r.timeout
+			client = &c
+		}
+
+		resp, err := client.Do(r.req)
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer resp.Body.Close()
+
+		data, err := ioutil.ReadAll(resp.Body)
+
+		if err != nil {
+			return nil, err
+		}
+
+		result := httpResponse{
+			Status:  resp.StatusCode,
+			Headers: map[string]string{},
+			Body:    string(data),
+		}
+
+		for key, values := range resp.Header {
+			result.Headers[key] = strings.Join(values, ", ")
+		}
+
+		return result, nil
+	})
+
+	if err != nil {
+		return httpResponse{}, err
+	}
+
+	if result, ok := value.(httpResponse); ok {
+		return result, nil
+	}
+
+	// Recorded responses come back as generic JSON values
+	result := httpResponse{}
+	data, _ := json.Marshal(value)
+
+	return result, json.Unmarshal(data, &result)
+}
+
+func pushHTTPResponse(l *lua.State, r httpResponse) {
+	l.NewTable()
+
+	l.PushInteger(r.Status)
+	l.SetField(-2, "status")
+
+	l.PushBoolean(r.Status >= 200 && r.Status < 300)
+	l.SetField(-2, "ok")
+
+	util.DeepPush(l, r.Headers)
+	l.SetField(-2, "headers")
+
+	l.PushString(r.Body)
+	l.SetField(-2, "body")
+
+	l.PushGoFunction(func(l *lua.State) int {
+		var v interface{}
+
+		if err := json.Unmarshal([]byte(r.Body), &v); err != nil {
+			lua.Errorf(l, "Unable to decode the response body as JSON: %s", err)
+			panic("unreachable")
+		}
+
+		util.DeepPush(l, v)
+
+		return 1
+	})
+	l.SetField(-2, "json")
+}
+
+// httpRequestFunction implements http.request
+func httpRequestFunction(l *lua.State) int {
+	r := checkHTTPRequest(l, 1)
+
+	response, err := r.do(tapeFor(l))
+
+	if err != nil {
+		lua.Errorf(l, "%s", err)
+		panic("unreachable")
+	}
+
+	pushHTTPResponse(l, response)
+
+	return 1
+}
+
+// defaultHTTPConcurrency is the number of requests http.all performs at once unless the
+// script asks for another limit
+const defaultHTTPConcurrency = 8
+
+// httpAllFunction implements http.all, which performs a list of requests in parallel. Each
+// request is either a URL or an options table as accepted by http.request. The results are
+// returned in the order of the requests; a request that fails yields `{ok = false, error =
+// message}` instead of aborting the script.
+func httpAllFunction(l *lua.State) int {
+	lua.CheckType(l, 1, lua.TypeTable)
+
+	concurrency := defaultHTTPConcurrency
+
+	if l.IsTable(2) {
+		l.Field(2, "concurrency")
+
+		if l.IsNumber(-1) {
+			n, _ := l.ToInteger(-1)
+
+			if n < 1 {
+				lua.Errorf(l, "The `concurrency` option must be at least 1")
+				panic("unreachable")
+			}
+
+			concurrency = n
+		}
+
+		l.Pop(1)
+	}
+
+	count := l.RawLength(1)
+	requests := make([]httpRequest, count)
+
+	for index := range requests {
+		l.RawGetInt(1, index+1)
+
+		if u, ok := l.ToString(-1); ok && !l.IsNumber(-1) {
+			req, err := http.NewRequest("GET", u, nil)
+
+			if err != nil {
+				lua.Errorf(l, "%s", err)
+				panic("unreachable")
+			}
+
+			client, err := httpclient.Get("")
+
+			if err != nil {
+				lua.Errorf(l, "%s", err)
+				panic("unreachable")
+			}
+
+			requests[index] = httpRequest{req: req, client: client}
+		} else {
+			requests[index] = checkHTTPRequest(l, l.Top())
+		}
+
+		l.Pop(1)
+	}
+
+	t := tapeFor(l)
+	responses := make([]httpResponse, count)
+	errs := make([]error, count)
+	slots := make(chan bool, concurrency)
+	wg := sync.WaitGroup{}
+
+	for index, r := range requests {
+		wg.Add(1)
+		slots <- true
+
+		go func(index int, r httpRequest) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			responses[index], errs[index] = r.do(t)
+		}(index, r)
+	}
+
+	wg.Wait()
+
+	pushArray(l)
+
+	for index, response := range responses {
+		if errs[index] != nil {
+			l.NewTable()
+
+			l.PushBoolean(false)
+			l.SetField(-2, "ok")
+
+			l.PushString(errs[index].Error())
+			l.SetField(-2, "error")
+		} else {
+			pushHTTPResponse(l, response)
+		}
+
+		l.RawSetInt(-2, index+1)
+	}
+
+	return 1
+}
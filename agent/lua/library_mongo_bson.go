@@ -0,0 +1,217 @@
+package lua
+
+import (
+	"encoding/base64"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mongoValue converts a value decoded from BSON into one that maps naturally to Lua.
+// ObjectIds become their hex representation, dates become ISO 8601 strings in UTC,
+// numbers become floats, and binary data is encoded in base64.
+func mongoValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, bool, float64, string:
+		return v
+
+	case bson.ObjectId:
+		return v.Hex()
+
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+
+	case bson.M:
+		return mongoDocument(v)
+
+	case map[string]interface{}:
+		return mongoDocument(v)
+
+	case bson.D:
+		result := map[string]interface{}{}
+
+		for _, e := range v {
+			result[e.Name] = mongoValue(e.Value)
+		}
+
+		return result
+
+	case []interface{}:
+		result := make([]interface{}, len(v))
+
+		for index, item := range v {
+			result[index] = mongoValue(item)
+		}
+
+		return result
+
+	case bson.Binary:
+		return base64.StdEncoding.EncodeToString(v.Data)
+
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v)
+
+	case bson.RegEx:
+		return v.Pattern
+
+	case bson.Symbol:
+		return string(v)
+
+	case bson.MongoTimestamp:
+		return float64(v >> 32)
+	}
+
+	r := reflect.ValueOf(value)
+
+	switch r.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(r.Int())
+
+	case reflect.Float32:
+		return r.Float()
+	}
+
+	// Decimal128 values
+	if s, ok := value.(fmt.Stringer); ok {
+		if f, err := strconv.ParseFloat(s.String(), 64); err == nil {
+			return f
+		}
+
+		return s.String()
+	}
+
+	return value
+}
+
+func mongoDocument(document map[string]interface{}) map[string]interface{} {
+	result := map[string]interface{}{}
+
+	for key, value := range document {
+		result[key] = mongoValue(value)
+	}
+
+	return result
+}
+
+// mongoQueryValue converts a filter, projection or pipeline written in Lua into BSON.
+// ObjectIds and dates are written as in MongoDB's extended JSON, `{["$oid"] = "..."}` and
+// `{["$date"] = "2016-02-24T14:42:45Z"}` or `{["$date"] = milliseconds}`. Sequences become
+// arrays, and the value of `$sort` may be a list of field names, each prefixed with `-` for
+// a descending order, to keep the order of the keys.
+func mongoQueryValue(value interface{}) (interface{}, error) {
+	if list, ok := pulledList(value); ok {
+		result := make([]interface{}, len(list))
+
+		for index, item := range list {
+			v, err := mongoQueryValue(item)
+
+			if err != nil {
+				return nil, err
+			}
+
+			result[index] = v
+		}
+
+		return result, nil
+	}
+
+	document, ok := value.(map[string]interface{})
+
+	if !ok {
+		return value, nil
+	}
+
+	if oid, ok := document["$oid"].(string); ok && len(document) == 1 {
+		if !bson.IsObjectIdHex(oid) {
+			return nil, fmt.Errorf("Invalid ObjectId `%s`", oid)
+		}
+
+		return bson.ObjectIdHex(oid), nil
+	}
+
+	if date, ok := document["$date"]; ok && len(document) == 1 {
+		switch d := date.(type) {
+		case string:
+			return time.Parse(time.RFC3339Nano, d)
+
+		case float64:
+			return time.Unix(0, int64(d)*int64(time.Millisecond)).UTC(), nil
+		}
+
+		return nil, fmt.Errorf("Invalid date %v", date)
+	}
+
+	result := bson.M{}
+
+	for key, item := range document {
+		if key == "$sort" {
+			if list, ok := pulledList(item); ok {
+				result[key] = mongoSortDocument(list)
+				continue
+			}
+		}
+
+		v, err := mongoQueryValue(item)
+
+		if err != nil {
+			return nil, err
+		}
+
+		result[key] = v
+	}
+
+	return result, nil
+}
+
+// mongoSortFields converts a sort specification into the form expected by mgo: a field name,
+// a list of field names, or a table of fields and directions. Tables do not keep the order of
+// their keys, so lists should be used to sort on more than one field.
+func mongoSortFields(value interface{}) []string {
+	if s, ok := value.(string); ok {
+		return []string{s}
+	}
+
+	if list, ok := pulledList(value); ok {
+		result := []string{}
+
+		for _, item := range list {
+			result = append(result, fmt.Sprint(item))
+		}
+
+		return result
+	}
+
+	result := []string{}
+
+	if document, ok := value.(map[string]interface{}); ok {
+		for field, direction := range document {
+			if d, ok := direction.(float64); ok && d < 0 {
+				field = "-" + field
+			}
+
+			result = append(result, field)
+		}
+
+		sort.Strings(result)
+	}
+
+	return result
+}
+
+func mongoSortDocument(list []interface{}) bson.D {
+	result := bson.D{}
+
+	for _, field := range mongoSortFields(list) {
+		if strings.HasPrefix(field, "-") {
+			result = append(result, bson.DocElem{Name: field[1:], Value: -1})
+		} else {
+			result = append(result, bson.DocElem{Name: field, Value: 1})
+		}
+	}
+
+	return result
+}
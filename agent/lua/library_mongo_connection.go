@@ -17,9 +17,19 @@ var mongoConnectionFunctions = map[string]func(s *mgo.Session) lua.Function{
 
 	"live_servers": func(s *mgo.Session) lua.Function {
 		return func(l *lua.State) int {
+			servers, _ := tapeFor(l).Do("mongo", "live_servers", func() (interface{}, error) {
+				result := []interface{}{}
+
+				for _, server := range s.LiveServers() {
+					result = append(result, server)
+				}
+
+				return result, nil
+			})
+
 			pushArray(l)
 
-			for index, server := range s.LiveServers() {
+			for index, server := range servers.([]interface{}) {
 				util.DeepPush(l, server)
 				l.RawSetInt(-2, index+1)
 			}
@@ -30,7 +40,9 @@ var mongoConnectionFunctions = map[string]func(s *mgo.Session) lua.Function{
 
 	"close": func(s *mgo.Session) lua.Function {
 		return func(l *lua.State) int {
-			s.Close()
+			if s != nil {
+				s.Close()
+			}
 
 			return 0
 		}
@@ -38,11 +50,18 @@ var mongoConnectionFunctions = map[string]func(s *mgo.Session) lua.Function{
 }
 
 func pushGoConnection(l *lua.State, connectionString string) {
-	s, err := mgo.Dial(connectionString)
+	var s *mgo.Session
 
-	if err != nil {
-		lua.Errorf(l, "%s", err.Error())
-		panic("unreachable")
+	// When replaying, results come from the recording and no connection is made
+	if !tapeFor(l).Replaying() {
+		var err error
+
+		s, err = mgo.Dial(connectionString)
+
+		if err != nil {
+			lua.Errorf(l, "%s", err.Error())
+			panic("unreachable")
+		}
 	}
 
 	l.NewTable()
@@ -54,7 +73,9 @@ func pushGoConnection(l *lua.State, connectionString string) {
 
 	l.CreateTable(0, 1)
 	l.PushGoFunction(func(l *lua.State) int {
-		s.Close()
+		if s != nil {
+			s.Close()
+		}
 
 		return 0
 	})
@@ -9,7 +9,17 @@ import (
 var mongoDBFunctions = map[string]func(db *mgo.Database) lua.Function{
 	"collections": func(db *mgo.Database) lua.Function {
 		return func(l *lua.State) int {
-			names, err := db.CollectionNames()
+			names, err := tapeFor(l).Do("mongo", mongoRecordKey(db.Name, "collections"), func() (interface{}, error) {
+				names, err := db.CollectionNames()
+
+				result := []interface{}{}
+
+				for _, name := range names {
+					result = append(result, name)
+				}
+
+				return result, err
+			})
 
 			if err != nil {
 				lua.Errorf(l, "%s", err.Error())
@@ -18,7 +28,7 @@ var mongoDBFunctions = map[string]func(db *mgo.Database) lua.Function{
 
 			pushArray(l)
 
-			for index, value := range names {
+			for index, value := range names.([]interface{}) {
 				util.DeepPush(l, value)
 				l.RawSetInt(-2, index+1)
 			}
@@ -37,8 +47,6 @@ var mongoDBFunctions = map[string]func(db *mgo.Database) lua.Function{
 
 	"command": func(db *mgo.Database) lua.Function {
 		return func(l *lua.State) int {
-			var result interface{}
-
 			cmd, err := util.PullTable(l, 1)
 
 			if err != nil {
@@ -46,7 +54,13 @@ var mongoDBFunctions = map[string]func(db *mgo.Database) lua.Function{
 				panic("unreachable")
 			}
 
-			err = db.Run(cmd, &result)
+			result, err := tapeFor(l).Do("mongo", mongoRecordKey(db.Name, "command", cmd), func() (interface{}, error) {
+				var result interface{}
+
+				err := db.Run(cmd, &result)
+
+				return result, err
+			})
 
 			if err != nil {
 				lua.Errorf(l, "%s", err.Error())
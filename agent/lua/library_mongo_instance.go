@@ -1,85 +1,156 @@
 package lua
 
 import (
+	"encoding/json"
 	"github.com/telemetryapp/go-lua"
 	"github.com/telemetryapp/goluago/util"
 
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 var mongoCollectionFunctions = map[string]func(c *mgo.Collection) lua.Function{
 	"query": func(c *mgo.Collection) lua.Function {
 		return func(l *lua.State) int {
-			query, err := util.PullTable(l, 1)
+			query := checkMongoQuery(l, 1)
+			skip := lua.OptInteger(l, 2, 0)
+			limit := lua.OptInteger(l, 3, -1)
+
+			result, err := tapeFor(l).Do("mongo", mongoRecordKey(c.FullName, "query", query, skip, limit), func() (interface{}, error) {
+				return mongoFind(c, query, nil, nil, skip, limit)
+			})
 
 			if err != nil {
 				lua.Errorf(l, "%s", err.Error())
 				panic("unreachable")
 			}
 
-			skip := lua.OptInteger(l, 2, 0)
-			limit := lua.OptInteger(l, 3, -1)
+			pushMongoDocuments(l, result)
+
+			return 1
+		}
+	},
 
-			result := []map[string]interface{}{}
+	"find": func(c *mgo.Collection) lua.Function {
+		return func(l *lua.State) int {
+			lua.CheckType(l, 1, lua.TypeTable)
 
-			q := c.Find(query)
+			query := mongoOption(l, 1, "filter", true)
+			projection := mongoOption(l, 1, "projection", true)
+			sort := mongoSortFields(mongoOption(l, 1, "sort", false))
 
-			if skip > 0 {
-				q.Skip(skip)
-			}
+			l.Field(1, "skip")
+			skip, _ := l.ToInteger(-1)
+			l.Pop(1)
+
+			l.Field(1, "limit")
+			limit := -1
 
-			if limit >= 0 {
-				q.Limit(limit)
+			if l.IsNumber(-1) {
+				limit, _ = l.ToInteger(-1)
 			}
 
-			err = q.All(&result)
+			l.Pop(1)
+
+			result, err := tapeFor(l).Do("mongo", mongoRecordKey(c.FullName, "find", query, projection, sort, skip, limit), func() (interface{}, error) {
+				return mongoFind(c, query, projection, sort, skip, limit)
+			})
 
 			if err != nil {
 				lua.Errorf(l, "%s", err.Error())
 				panic("unreachable")
 			}
 
-			pushArray(l)
+			pushMongoDocuments(l, result)
+
+			return 1
+		}
+	},
+
+	"aggregate": func(c *mgo.Collection) lua.Function {
+		return func(l *lua.State) int {
+			lua.CheckType(l, 1, lua.TypeTable)
+
+			pipeline, ok := checkMongoQuery(l, 1).([]interface{})
 
-			for index, value := range result {
-				util.DeepPush(l, value)
-				l.RawSetInt(-2, index+1)
+			if !ok {
+				lua.ArgumentError(l, 1, "the pipeline must be a list of stages")
+				panic("unreachable")
 			}
 
+			result, err := tapeFor(l).Do("mongo", mongoRecordKey(c.FullName, "aggregate", pipeline), func() (interface{}, error) {
+				documents := []bson.M{}
+
+				if err := c.Pipe(pipeline).AllowDiskUse().All(&documents); err != nil {
+					return nil, err
+				}
+
+				return mongoDocuments(documents), nil
+			})
+
+			if err != nil {
+				lua.Errorf(l, "%s", err.Error())
+				panic("unreachable")
+			}
+
+			pushMongoDocuments(l, result)
+
 			return 1
 		}
 	},
 
-	"count": func(c *mgo.Collection) lua.Function {
+	"distinct": func(c *mgo.Collection) lua.Function {
 		return func(l *lua.State) int {
-			query, err := util.PullTable(l, 1)
+			field := lua.CheckString(l, 1)
+			query := checkMongoQuery(l, 2)
+
+			result, err := tapeFor(l).Do("mongo", mongoRecordKey(c.FullName, "distinct", field, query), func() (interface{}, error) {
+				values := []interface{}{}
+
+				if err := c.Find(query).Distinct(field, &values); err != nil {
+					return nil, err
+				}
+
+				return mongoValue(values), nil
+			})
 
 			if err != nil {
 				lua.Errorf(l, "%s", err.Error())
 				panic("unreachable")
 			}
 
+			pushMongoDocuments(l, result)
+
+			return 1
+		}
+	},
+
+	"count": func(c *mgo.Collection) lua.Function {
+		return func(l *lua.State) int {
+			query := checkMongoQuery(l, 1)
 			skip := lua.OptInteger(l, 2, 0)
 			limit := lua.OptInteger(l, 3, -1)
 
-			q := c.Find(query)
+			count, err := tapeFor(l).Do("mongo", mongoRecordKey(c.FullName, "count", query, skip, limit), func() (interface{}, error) {
+				q := c.Find(query)
 
-			if skip > 0 {
-				q.Skip(skip)
-			}
+				if skip > 0 {
+					q.Skip(skip)
+				}
 
-			if limit >= 0 {
-				q.Limit(limit)
-			}
+				if limit >= 0 {
+					q.Limit(limit)
+				}
 
-			count, err := q.Count()
+				return q.Count()
+			})
 
 			if err != nil {
 				lua.Errorf(l, "%s", err.Error())
 				panic("unreachable")
 			}
 
-			l.PushInteger(count)
+			util.DeepPush(l, count)
 
 			return 1
 		}
@@ -94,6 +165,117 @@ var mongoCollectionFunctions = map[string]func(c *mgo.Collection) lua.Function{
 	},
 }
 
+// checkMongoQuery reads a filter or pipeline from the table at the given index. A missing
+// filter matches all documents.
+func checkMongoQuery(l *lua.State, index int) interface{} {
+	if l.IsNoneOrNil(index) {
+		return bson.M{}
+	}
+
+	value, err := util.PullTable(l, index)
+
+	if err != nil {
+		lua.Errorf(l, "%s", err.Error())
+		panic("unreachable")
+	}
+
+	result, err := mongoQueryValue(value)
+
+	if err != nil {
+		lua.Errorf(l, "%s", err.Error())
+		panic("unreachable")
+	}
+
+	return result
+}
+
+// mongoOption reads a field of an options table. If query is true, tables are converted
+// to BSON.
+func mongoOption(l *lua.State, index int, name string, query bool) interface{} {
+	l.Field(index, name)
+	defer l.Pop(1)
+
+	if l.IsNil(-1) {
+		return nil
+	}
+
+	if l.IsTable(-1) {
+		if query {
+			return checkMongoQuery(l, l.Top())
+		}
+
+		value, err := util.PullTable(l, l.Top())
+
+		if err != nil {
+			lua.Errorf(l, "%s", err.Error())
+			panic("unreachable")
+		}
+
+		return value
+	}
+
+	return l.ToValue(-1)
+}
+
+func mongoFind(c *mgo.Collection, query, projection interface{}, sort []string, skip, limit int) (interface{}, error) {
+	documents := []bson.M{}
+
+	if query == nil {
+		query = bson.M{}
+	}
+
+	q := c.Find(query)
+
+	if projection != nil {
+		q.Select(projection)
+	}
+
+	if len(sort) > 0 {
+		q.Sort(sort...)
+	}
+
+	if skip > 0 {
+		q.Skip(skip)
+	}
+
+	if limit >= 0 {
+		q.Limit(limit)
+	}
+
+	if err := q.All(&documents); err != nil {
+		return nil, err
+	}
+
+	return mongoDocuments(documents), nil
+}
+
+func mongoDocuments(documents []bson.M) []interface{} {
+	result := []interface{}{}
+
+	for _, document := range documents {
+		result = append(result, mongoDocument(document))
+	}
+
+	return result
+}
+
+func pushMongoDocuments(l *lua.State, documents interface{}) {
+	pushArray(l)
+
+	items, _ := documents.([]interface{})
+
+	for index, value := range items {
+		util.DeepPush(l, value)
+		l.RawSetInt(-2, index+1)
+	}
+}
+
+func mongoRecordKey(name, operation string, args ...interface{}) string {
+	a, _ := json.Marshal(args)
+
+	return name + "." + operation + " " + string(a)
+}
+
 func pushMongoCollection(l *lua.State, db *mgo.Database, name string) {
 	c := db.C(name)
 
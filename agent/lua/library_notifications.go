@@ -10,7 +10,7 @@ type notificationProvider interface {
 	SendNotification(n gotelemetry.Notification, channelTag string, flowTag string) bool
 }
 
-func openNotificationsLibrary(l *lua.State, p notificationProvider) {
+func openNotificationsLibrary(l *lua.State) {
 	var notificationsLibrary = []lua.RegistryFunction{
 		{
 			"post",
@@ -47,7 +47,18 @@ func openNotificationsLibrary(l *lua.State, p notificationProvider) {
 				sound := lua.OptString(l, 7, "default")
 
 				notification := gotelemetry.NewNotification(title, message, icon, duration, sound)
-				l.PushBoolean(p.SendNotification(notification, channelTag, flowTag))
+
+				p := notificationProviderFor(l)
+
+				if p == nil && !tapeFor(l).Replaying() {
+					lua.Errorf(l, "Notifications are not available in this context")
+					panic("unreachable")
+				}
+				result, _ := tapeFor(l).Do("notification", channelTag+" "+flowTag, func() (interface{}, error) {
+					return p.SendNotification(notification, channelTag, flowTag), nil
+				})
+
+				l.PushBoolean(result == true)
 
 				return 1
 			},
@@ -0,0 +1,231 @@
+package lua
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/telemetryapp/go-lua"
+	"sync"
+	"time"
+)
+
+// redisPool is a connection pool shared by all the scripts that open the same server. Like
+// SQL pools, Redis pools outlive the runs that use them, and a pool that no script has used
+// for redisPoolIdleTimeout is closed.
+type redisPool struct {
+	pool *redis.Pool
+	refs int
+	idle *time.Timer
+}
+
+// redisOptions are the options of redis.open. The pool limits and the timeout apply to the
+// shared pool, and are set by the first script that opens it; zero values leave redigo's
+// defaults in place, except for the timeout, which defaults to ten seconds.
+type redisOptions struct {
+	Password    string
+	DB          int
+	MaxIdle     int
+	MaxActive   int
+	IdleTimeout time.Duration
+	Timeout     time.Duration
+}
+
+const (
+	defaultRedisMaxIdle = 3
+	defaultRedisTimeout = 10 * time.Second
+)
+
+var (
+	redisPoolsMutex      sync.Mutex
+	redisPools           = map[string]*redisPool{}
+	redisPoolIdleTimeout = 10 * time.Minute
+)
+
+// redisPoolKey identifies the pool for a server and database. Connections that authenticate
+// with different passwords do not share a pool, but the key only holds a hash of the
+// password.
+func redisPoolKey(address string, options redisOptions) string {
+	password := sha256.Sum256([]byte(options.Password))
+
+	return fmt.Sprintf("%s/%d %x", address, options.DB, password)
+}
+
+// acquireRedisPool returns the pool for a server and database, creating it if needed.
+// The pool limits and timeouts are those of the call that creates the pool; later calls
+// share the pool as it is. Connections are only made when a command runs. Each call must
+// be matched by a call to releaseRedisPool.
+func acquireRedisPool(address string, options redisOptions) (string, *redis.Pool) {
+	redisPoolsMutex.Lock()
+	defer redisPoolsMutex.Unlock()
+
+	key := redisPoolKey(address, options)
+	pool, ok := redisPools[key]
+
+	if !ok {
+		timeout := options.Timeout
+
+		if timeout <= 0 {
+			timeout = defaultRedisTimeout
+		}
+
+		dialOptions := []redis.DialOption{
+			redis.DialDatabase(options.DB),
+			redis.DialConnectTimeout(timeout),
+			redis.DialReadTimeout(timeout),
+			redis.DialWriteTimeout(timeout),
+		}
+
+		if options.Password != "" {
+			dialOptions = append(dialOptions, redis.DialPassword(options.Password))
+		}
+
+		pool = &redisPool{
+			pool: &redis.Pool{
+				MaxIdle:     defaultRedisMaxIdle,
+				MaxActive:   options.MaxActive,
+				IdleTimeout: options.IdleTimeout,
+				Dial: func() (redis.Conn, error) {
+					return redis.Dial("tcp", address, dialOptions...)
+				},
+			},
+		}
+
+		if options.MaxIdle > 0 {
+			pool.pool.MaxIdle = options.MaxIdle
+		}
+
+		redisPools[key] = pool
+	}
+
+	if pool.idle != nil {
+		pool.idle.Stop()
+		pool.idle = nil
+	}
+
+	pool.refs++
+
+	return key, pool.pool
+}
+
+// releaseRedisPool gives up a reference to a pool. Once no script holds the pool, it is
+// kept open for redisPoolIdleTimeout in case another run needs it.
+func releaseRedisPool(key string) {
+	redisPoolsMutex.Lock()
+	defer redisPoolsMutex.Unlock()
+
+	pool, ok := redisPools[key]
+
+	if !ok || pool.refs == 0 {
+		return
+	}
+
+	pool.refs--
+
+	if pool.refs > 0 {
+		return
+	}
+
+	pool.idle = time.AfterFunc(redisPoolIdleTimeout, func() {
+		redisPoolsMutex.Lock()
+		defer redisPoolsMutex.Unlock()
+
+		if redisPools[key] == pool && pool.refs == 0 {
+			delete(redisPools, key)
+			pool.pool.Close()
+		}
+	})
+}
+
+// closeRedisPools closes every pool, whether or not a script holds it
+func closeRedisPools() {
+	redisPoolsMutex.Lock()
+	defer redisPoolsMutex.Unlock()
+
+	for key, pool := range redisPools {
+		if pool.idle != nil {
+			pool.idle.Stop()
+		}
+
+		pool.pool.Close()
+		delete(redisPools, key)
+	}
+}
+
+// checkRedisOptions reads the options table at the given index, if any
+func checkRedisOptions(l *lua.State, index int) redisOptions {
+	result := redisOptions{}
+
+	if l.IsNoneOrNil(index) {
+		return result
+	}
+
+	lua.CheckType(l, index, lua.TypeTable)
+
+	result.Password = optionString(l, index, "password")
+
+	l.Field(index, "db")
+	result.DB, _ = l.ToInteger(-1)
+	l.Pop(1)
+
+	l.Field(index, "max_idle")
+	result.MaxIdle, _ = l.ToInteger(-1)
+	l.Pop(1)
+
+	l.Field(index, "max_active")
+	result.MaxActive, _ = l.ToInteger(-1)
+	l.Pop(1)
+
+	result.IdleTimeout = optionDuration(l, index, "idle_timeout")
+	result.Timeout = optionDuration(l, index, "timeout")
+
+	return result
+}
+
+var redisLibrary = []lua.RegistryFunction{
+	{
+		"open",
+		func(l *lua.State) int {
+			address := lua.CheckString(l, 1)
+			options := checkRedisOptions(l, 2)
+
+			pushRedisInstance(l, address, options)
+
+			return 1
+		},
+	},
+
+	{
+		"connect",
+		func(l *lua.State) int {
+			name := lua.CheckString(l, 1)
+
+			s, err := redisServerNamed(name)
+
+			if err != nil {
+				// Replays may run without the configuration file; commands are served
+				// by the tape anyway
+				if tapeFor(l).Replaying() {
+					pushRedisHandle(l, &redisInstance{})
+					return 1
+				}
+
+				lua.Errorf(l, "%s", err)
+				panic("unreachable")
+			}
+
+			pushRedisInstance(l, s.address, s.options)
+
+			return 1
+		},
+	},
+}
+
+func openRedisLibrary(l *lua.State) {
+	open := func(l *lua.State) int {
+		lua.NewLibrary(l, redisLibrary)
+		return 1
+	}
+
+	lua.Require(l, "telemetry/redis", open, false)
+	l.Pop(1)
+}
@@ -0,0 +1,558 @@
+package lua
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"github.com/telemetryapp/go-lua"
+	"github.com/telemetryapp/goluago/util"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// redisInstance is a script's handle on a shared connection pool
+type redisInstance struct {
+	key    string
+	pool   *redis.Pool
+	closed bool
+}
+
+var redisInstanceFunctions = map[string]func(i *redisInstance) lua.Function{
+	"get": func(i *redisInstance) lua.Function {
+		return func(l *lua.State) int {
+			key := lua.CheckString(l, 1)
+
+			pushRedisValue(l, i.do(l, "GET", key))
+
+			return 1
+		}
+	},
+
+	"mget": func(i *redisInstance) lua.Function {
+		return func(l *lua.State) int {
+			keys := checkRedisKeys(l, 1)
+
+			pushRedisValue(l, i.do(l, "MGET", keys...))
+
+			return 1
+		}
+	},
+
+	"hgetall": func(i *redisInstance) lua.Function {
+		return func(l *lua.State) int {
+			key := lua.CheckString(l, 1)
+
+			values, _ := i.do(l, "HGETALL", key).([]interface{})
+
+			l.NewTable()
+
+			for index := 0; index+1 < len(values); index += 2 {
+				util.DeepPush(l, values[index+1])
+				l.SetField(-2, redisString(values[index]))
+			}
+
+			return 1
+		}
+	},
+
+	"zrange": func(i *redisInstance) lua.Function {
+		return func(l *lua.State) int {
+			key := lua.CheckString(l, 1)
+			start := lua.CheckInteger(l, 2)
+			stop := lua.CheckInteger(l, 3)
+			withScores := l.ToBoolean(4)
+
+			if !withScores {
+				pushRedisValue(l, i.do(l, "ZRANGE", key, start, stop))
+				return 1
+			}
+
+			values, _ := i.do(l, "ZRANGE", key, start, stop, "WITHSCORES").([]interface{})
+
+			pushArray(l)
+
+			for index := 0; index+1 < len(values); index += 2 {
+				score, _ := strconv.ParseFloat(redisString(values[index+1]), 64)
+
+				util.DeepPush(l, map[string]interface{}{"member": values[index], "score": score})
+				l.RawSetInt(-2, index/2+1)
+			}
+
+			return 1
+		}
+	},
+
+	"llen": func(i *redisInstance) lua.Function {
+		return func(l *lua.State) int {
+			key := lua.CheckString(l, 1)
+
+			pushRedisValue(l, i.do(l, "LLEN", key))
+
+			return 1
+		}
+	},
+
+	"scan": func(i *redisInstance) lua.Function {
+		return func(l *lua.State) int {
+			match := "*"
+			count := 0
+			limit := -1
+
+			if !l.IsNoneOrNil(1) {
+				lua.CheckType(l, 1, lua.TypeTable)
+
+				if m := optionString(l, 1, "match"); m != "" {
+					match = m
+				}
+
+				l.Field(1, "count")
+				count, _ = l.ToInteger(-1)
+				l.Pop(1)
+
+				l.Field(1, "limit")
+
+				if l.IsNumber(-1) {
+					limit, _ = l.ToInteger(-1)
+				}
+
+				l.Pop(1)
+			}
+
+			pool := i.checkOpen(l)
+
+			keys, err := tapeFor(l).Do("redis", redisRecordKey("SCAN", []interface{}{match, count, limit}), func() (interface{}, error) {
+				conn := pool.Get()
+				defer conn.Close()
+
+				return redisScan(conn, match, count, limit)
+			})
+
+			if err != nil {
+				lua.Errorf(l, "%s", err.Error())
+				panic("unreachable")
+			}
+
+			pushRedisValue(l, keys)
+
+			return 1
+		}
+	},
+
+	"info": func(i *redisInstance) lua.Function {
+		return func(l *lua.State) int {
+			args := []interface{}{}
+
+			if section := lua.OptString(l, 1, ""); section != "" {
+				args = append(args, section)
+			}
+
+			util.DeepPush(l, parseRedisInfo(redisString(i.do(l, "INFO", args...))))
+
+			return 1
+		}
+	},
+
+	"command": func(i *redisInstance) lua.Function {
+		return func(l *lua.State) int {
+			name := lua.CheckString(l, 1)
+
+			pushRedisValue(l, i.do(l, strings.ToUpper(name), checkRedisArgs(l, 2)...))
+
+			return 1
+		}
+	},
+
+	"pipeline": func(i *redisInstance) lua.Function {
+		return func(l *lua.State) int {
+			commands := checkRedisCommands(l, 1)
+			pool := i.checkOpen(l)
+
+			results, err := tapeFor(l).Do("redis", redisRecordKey("PIPELINE", commands), func() (interface{}, error) {
+				conn := pool.Get()
+				defer conn.Close()
+
+				return redisPipeline(conn, commands)
+			})
+
+			if err != nil {
+				lua.Errorf(l, "%s", err.Error())
+				panic("unreachable")
+			}
+
+			pushRedisValue(l, results)
+
+			return 1
+		}
+	},
+
+	"ping": func(i *redisInstance) lua.Function {
+		return func(l *lua.State) int {
+			pool := i.checkOpen(l)
+
+			_, err := tapeFor(l).Do("redis", "PING", func() (interface{}, error) {
+				conn := pool.Get()
+				defer conn.Close()
+
+				_, err := conn.Do("PING")
+
+				return nil, err
+			})
+
+			l.PushBoolean(err == nil)
+
+			if err != nil {
+				l.PushString(err.Error())
+				return 2
+			}
+
+			return 1
+		}
+	},
+
+	"close": func(i *redisInstance) lua.Function {
+		return func(l *lua.State) int {
+			i.release()
+
+			return 0
+		}
+	},
+}
+
+// release gives up the handle's reference to its pool, if the script has not closed it
+func (i *redisInstance) release() {
+	if !i.closed {
+		i.closed = true
+		releaseRedisPool(i.key)
+	}
+}
+
+func (i *redisInstance) checkOpen(l *lua.State) *redis.Pool {
+	if i.closed {
+		lua.Errorf(l, "The Redis connection is closed")
+		panic("unreachable")
+	}
+
+	return i.pool
+}
+
+// do runs a command through the tape and returns its reply converted by redisValue
+func (i *redisInstance) do(l *lua.State, command string, args ...interface{}) interface{} {
+	pool := i.checkOpen(l)
+
+	result, err := tapeFor(l).Do("redis", redisRecordKey(command, args), func() (interface{}, error) {
+		conn := pool.Get()
+		defer conn.Close()
+
+		reply, err := conn.Do(command, args...)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return redisValue(reply), nil
+	})
+
+	if err != nil {
+		lua.Errorf(l, "%s", err.Error())
+		panic("unreachable")
+	}
+
+	return result
+}
+
+// redisArgument converts a value passed by a script into a command argument. Lua numbers
+// are floats, which redigo would otherwise send in exponent notation once they are large.
+func redisArgument(value interface{}) interface{} {
+	if f, ok := value.(float64); ok && f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+		return int64(f)
+	}
+
+	return value
+}
+
+func checkRedisArgs(l *lua.State, first int) []interface{} {
+	args := []interface{}{}
+
+	for i := first; i <= l.Top(); i++ {
+		args = append(args, redisArgument(l.ToValue(i)))
+	}
+
+	return args
+}
+
+// checkRedisKeys reads keys given either as arguments or as a single list
+func checkRedisKeys(l *lua.State, first int) []interface{} {
+	if !l.IsTable(first) {
+		lua.CheckString(l, first)
+
+		return checkRedisArgs(l, first)
+	}
+
+	keys := []interface{}{}
+
+	for index := 1; index <= l.RawLength(first); index++ {
+		l.RawGetInt(first, index)
+		key, ok := l.ToString(-1)
+		l.Pop(1)
+
+		if !ok {
+			lua.Errorf(l, "Keys must be strings")
+			panic("unreachable")
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// checkRedisCommands reads a list of commands, each a list made of the name of the command
+// followed by its arguments
+func checkRedisCommands(l *lua.State, index int) [][]interface{} {
+	lua.CheckType(l, index, lua.TypeTable)
+
+	commands := [][]interface{}{}
+
+	for i := 1; i <= l.RawLength(index); i++ {
+		l.RawGetInt(index, i)
+
+		if !l.IsTable(-1) || l.RawLength(-1) == 0 {
+			lua.Errorf(l, "Each command of a pipeline must be a list made of the command's name followed by its arguments")
+			panic("unreachable")
+		}
+
+		command := []interface{}{}
+
+		for j := 1; j <= l.RawLength(-1); j++ {
+			l.RawGetInt(-1, j)
+			command = append(command, redisArgument(l.ToValue(-1)))
+			l.Pop(1)
+		}
+
+		command[0] = strings.ToUpper(redisString(command[0]))
+		commands = append(commands, command)
+
+		l.Pop(1)
+	}
+
+	return commands
+}
+
+// redisValue converts a reply so that it can be recorded and pushed: bulk strings become
+// strings, integers become numbers, and error replies nested in arrays become tables with
+// an `error` field
+func redisValue(reply interface{}) interface{} {
+	switch v := reply.(type) {
+	case []byte:
+		return string(v)
+
+	case int64:
+		return float64(v)
+
+	case redis.Error:
+		return map[string]interface{}{"error": v.Error()}
+
+	case []interface{}:
+		result := make([]interface{}, len(v))
+
+		for index, item := range v {
+			result[index] = redisValue(item)
+		}
+
+		return result
+	}
+
+	return reply
+}
+
+func redisString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+
+	case []byte:
+		return string(v)
+
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+
+	case int64:
+		return strconv.FormatInt(v, 10)
+	}
+
+	return ""
+}
+
+// redisScan iterates over the keyspace with SCAN and returns up to limit matching keys, or
+// all of them if limit is negative
+func redisScan(conn redis.Conn, match string, count, limit int) ([]interface{}, error) {
+	keys := []interface{}{}
+	cursor := "0"
+
+	for {
+		args := []interface{}{cursor, "MATCH", match}
+
+		if count > 0 {
+			args = append(args, "COUNT", count)
+		}
+
+		reply, err := redis.Values(conn.Do("SCAN", args...))
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(reply) != 2 {
+			return nil, errors.New("Unexpected reply to SCAN")
+		}
+
+		batch, err := redis.Strings(reply[1], nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range batch {
+			if limit >= 0 && len(keys) >= limit {
+				return keys, nil
+			}
+
+			keys = append(keys, key)
+		}
+
+		if cursor = redisString(reply[0]); cursor == "0" {
+			return keys, nil
+		}
+	}
+}
+
+// redisPipeline sends all the commands before reading any reply. A command that fails
+// does not stop the others; its result is a table with an `error` field.
+func redisPipeline(conn redis.Conn, commands [][]interface{}) ([]interface{}, error) {
+	for _, command := range commands {
+		if err := conn.Send(command[0].(string), command[1:]...); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+
+	results := make([]interface{}, len(commands))
+
+	for index := range commands {
+		reply, err := conn.Receive()
+
+		if e, ok := err.(redis.Error); ok {
+			reply, err = e, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		results[index] = redisValue(reply)
+	}
+
+	return results, nil
+}
+
+// parseRedisInfo parses the reply to INFO into a table of sections, each a table of fields.
+// Numeric values become numbers, and values made of comma-separated assignments, such as
+// the keyspace's `keys=1,expires=0`, become tables.
+func parseRedisInfo(text string) map[string]interface{} {
+	result := map[string]interface{}{}
+	section := result
+
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			section = map[string]interface{}{}
+			result[strings.ToLower(strings.TrimSpace(line[1:]))] = section
+			continue
+		}
+
+		if index := strings.Index(line, ":"); index != -1 {
+			section[line[:index]] = redisInfoValue(line[index+1:])
+		}
+	}
+
+	return result
+}
+
+func redisInfoValue(value string) interface{} {
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return f
+	}
+
+	if !strings.Contains(value, "=") {
+		return value
+	}
+
+	result := map[string]interface{}{}
+
+	for _, field := range strings.Split(value, ",") {
+		parts := strings.SplitN(field, "=", 2)
+
+		if len(parts) != 2 {
+			return value
+		}
+
+		result[parts[0]] = redisInfoValue(parts[1])
+	}
+
+	return result
+}
+
+// pushRedisValue pushes a converted reply, using arrays for lists
+func pushRedisValue(l *lua.State, value interface{}) {
+	switch v := value.(type) {
+	case nil:
+		l.PushNil()
+
+	case []interface{}:
+		pushArray(l)
+
+		for index, item := range v {
+			if item != nil {
+				pushRedisValue(l, item)
+				l.RawSetInt(-2, index+1)
+			}
+		}
+
+	default:
+		util.DeepPush(l, v)
+	}
+}
+
+func redisRecordKey(command string, args interface{}) string {
+	a, _ := json.Marshal(args)
+
+	return command + " " + string(a)
+}
+
+// pushRedisInstance pushes a handle on the shared pool for a server. Closing the handle,
+// or the end of the run, gives the handle's reference to the pool back.
+func pushRedisInstance(l *lua.State, address string, options redisOptions) {
+	key, pool := acquireRedisPool(address, options)
+	instance := &redisInstance{key: key, pool: pool}
+
+	runContextFor(l).track(instance)
+	pushRedisHandle(l, instance)
+}
+
+func pushRedisHandle(l *lua.State, instance *redisInstance) {
+	l.NewTable()
+
+	for name, fn := range redisInstanceFunctions {
+		l.PushGoFunction(fn(instance))
+		l.SetField(-2, name)
+	}
+}
@@ -0,0 +1,109 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"os"
+	"sort"
+	"sync"
+)
+
+// redisServer is a Redis server declared in the configuration file
+type redisServer struct {
+	address string
+	options redisOptions
+}
+
+var (
+	redisServersMutex sync.RWMutex
+	redisServers      = map[string]redisServer{}
+)
+
+// InitRedis sets the Redis servers that scripts can open with redis.connect
+func InitRedis(servers map[string]config.RedisConfig) error {
+	result := map[string]redisServer{}
+
+	for name, cfg := range servers {
+		if cfg.Address == "" {
+			return fmt.Errorf("The Redis server %s must have an `address`", name)
+		}
+
+		s := redisServer{
+			address: cfg.Address,
+			options: redisOptions{
+				Password:  os.ExpandEnv(cfg.Password),
+				DB:        cfg.DB,
+				MaxIdle:   cfg.MaxIdle,
+				MaxActive: cfg.MaxActive,
+			},
+		}
+
+		if cfg.IdleTimeout != "" {
+			timeout, err := config.ParseTimeInterval(cfg.IdleTimeout)
+
+			if err != nil {
+				return fmt.Errorf("Invalid `idle_timeout` for the Redis server %s: %s", name, err)
+			}
+
+			s.options.IdleTimeout = timeout
+		}
+
+		result[name] = s
+	}
+
+	redisServersMutex.Lock()
+	redisServers = result
+	redisServersMutex.Unlock()
+
+	return nil
+}
+
+func redisServerNamed(name string) (redisServer, error) {
+	redisServersMutex.RLock()
+	defer redisServersMutex.RUnlock()
+
+	s, ok := redisServers[name]
+
+	if !ok {
+		return s, errors.New("Redis server " + name + " not found. Servers must be declared in the `redis` section of the configuration file.")
+	}
+
+	return s, nil
+}
+
+// RedisNames returns the names of the declared Redis servers, in alphabetical order
+func RedisNames() []string {
+	redisServersMutex.RLock()
+	defer redisServersMutex.RUnlock()
+
+	result := []string{}
+
+	for name := range redisServers {
+		result = append(result, name)
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+// PingRedis checks that a declared Redis server can be reached
+func PingRedis(name string) error {
+	s, err := redisServerNamed(name)
+
+	if err != nil {
+		return err
+	}
+
+	key, pool := acquireRedisPool(s.address, s.options)
+
+	defer releaseRedisPool(key)
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("PING")
+
+	return err
+}
@@ -1,17 +1,202 @@
 package lua
 
 import (
+	"github.com/jmoiron/sqlx"
 	"github.com/telemetryapp/go-lua"
+	"sync"
+	"time"
 )
 
+// sqlPool is a connection pool shared by all the scripts that open the same database. Pools
+// outlive the runs that use them, so that a job reuses its connections from one run to the
+// next; a pool that no script has used for sqlPoolIdleTimeout is closed.
+type sqlPool struct {
+	db   *sqlx.DB
+	refs int
+	idle *time.Timer
+}
+
+// sqlOptions are the options of sql.open. The pool limits are set by the first script that
+// opens the shared pool; zero values leave the driver's defaults in place.
+type sqlOptions struct {
+	MaxOpen     int
+	MaxIdle     int
+	MaxLifetime time.Duration
+	Timestamps  string // `iso` (the default) or `epoch`
+}
+
+var (
+	sqlPoolsMutex      sync.Mutex
+	sqlPools           = map[string]*sqlPool{}
+	sqlPoolIdleTimeout = 10 * time.Minute
+)
+
+// acquireSQLPool returns the pool for a driver and data source, opening it if needed. The
+// pool limits are those of the call that opens the pool; later calls share the pool as it
+// is. Each call must be matched by a call to releaseSQLPool.
+func acquireSQLPool(driverName, dataSourceName string, options sqlOptions) (string, *sqlx.DB, error) {
+	sqlPoolsMutex.Lock()
+	defer sqlPoolsMutex.Unlock()
+
+	key := driverName + " " + dataSourceName
+	pool, ok := sqlPools[key]
+
+	if !ok {
+		db, err := sqlx.Open(driverName, dataSourceName)
+
+		if err != nil {
+			return "", nil, err
+		}
+
+		if options.MaxOpen > 0 {
+			db.SetMaxOpenConns(options.MaxOpen)
+		}
+
+		if options.MaxIdle > 0 {
+			db.SetMaxIdleConns(options.MaxIdle)
+		}
+
+		if options.MaxLifetime > 0 {
+			db.SetConnMaxLifetime(options.MaxLifetime)
+		}
+
+		pool = &sqlPool{db: db}
+		sqlPools[key] = pool
+	}
+
+	if pool.idle != nil {
+		pool.idle.Stop()
+		pool.idle = nil
+	}
+
+	pool.refs++
+
+	return key, pool.db, nil
+}
+
+// releaseSQLPool gives up a reference to a pool. Once no script holds the pool, it is kept
+// open for sqlPoolIdleTimeout in case another run needs it.
+func releaseSQLPool(key string) {
+	sqlPoolsMutex.Lock()
+	defer sqlPoolsMutex.Unlock()
+
+	pool, ok := sqlPools[key]
+
+	if !ok || pool.refs == 0 {
+		return
+	}
+
+	pool.refs--
+
+	if pool.refs > 0 {
+		return
+	}
+
+	pool.idle = time.AfterFunc(sqlPoolIdleTimeout, func() {
+		sqlPoolsMutex.Lock()
+		defer sqlPoolsMutex.Unlock()
+
+		if sqlPools[key] == pool && pool.refs == 0 {
+			delete(sqlPools, key)
+			pool.db.Close()
+		}
+	})
+}
+
+// closeSQLPools closes every pool, whether or not a script holds it
+func closeSQLPools() {
+	sqlPoolsMutex.Lock()
+	defer sqlPoolsMutex.Unlock()
+
+	for key, pool := range sqlPools {
+		if pool.idle != nil {
+			pool.idle.Stop()
+		}
+
+		pool.db.Close()
+		delete(sqlPools, key)
+	}
+}
+
+// ClosePools closes the database and Redis connections that scripts have left open for
+// later runs. It is called when the agent exits.
+func ClosePools() {
+	closeSQLPools()
+	closeRedisPools()
+}
+
+// checkSQLOptions reads the options table at the given index, if any
+func checkSQLOptions(l *lua.State, index int) sqlOptions {
+	result := sqlOptions{Timestamps: sqlTimestampsISO}
+
+	if l.IsNoneOrNil(index) {
+		return result
+	}
+
+	lua.CheckType(l, index, lua.TypeTable)
+
+	l.Field(index, "max_open")
+	result.MaxOpen, _ = l.ToInteger(-1)
+	l.Pop(1)
+
+	l.Field(index, "max_idle")
+	result.MaxIdle, _ = l.ToInteger(-1)
+	l.Pop(1)
+
+	result.MaxLifetime = optionDuration(l, index, "max_lifetime")
+
+	switch timestamps := optionString(l, index, "timestamps"); timestamps {
+	case "":
+
+	case sqlTimestampsISO, sqlTimestampsEpoch:
+		result.Timestamps = timestamps
+
+	default:
+		lua.Errorf(l, "Invalid `timestamps` option `%s`. Must be either `iso` or `epoch`.", timestamps)
+		panic("unreachable")
+	}
+
+	return result
+}
+
 var sqlLibrary = []lua.RegistryFunction{
 	{
 		"open",
 		func(l *lua.State) int {
 			driver := lua.CheckString(l, 1)
 			connString := lua.CheckString(l, 2)
+			options := checkSQLOptions(l, 3)
+
+			pushSQLInstance(l, driver, connString, options)
+
+			return 1
+		},
+	},
+
+	{
+		"connect",
+		func(l *lua.State) int {
+			name := lua.CheckString(l, 1)
+			options := checkSQLOptions(l, 2)
+
+			d, err := sqlDatabaseNamed(name)
+
+			if err != nil {
+				// Replays may run without the configuration file; queries are served
+				// by the tape anyway
+				if tapeFor(l).Replaying() {
+					pushSQLHandle(l, &sqlInstance{timestamps: options.Timestamps})
+					return 1
+				}
+
+				lua.Errorf(l, "%s", err)
+				panic("unreachable")
+			}
+
+			// Pool limits come from the configuration file
+			d.options.Timestamps = options.Timestamps
 
-			pushSQLInstance(l, driver, connString)
+			pushSQLInstance(l, d.driver, d.dsn, d.options)
 
 			return 1
 		},
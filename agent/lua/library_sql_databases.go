@@ -0,0 +1,146 @@
+package lua
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"os"
+	"sort"
+	"sync"
+)
+
+// sqlDatabase is a database declared in the configuration file. Declared databases hold a
+// reference to their pool for the life of the agent, so that their connections are shared
+// by every job and kept between runs however rarely the jobs run.
+type sqlDatabase struct {
+	driver  string
+	dsn     string
+	options sqlOptions
+	key     string
+	db      *sqlx.DB
+}
+
+var (
+	sqlDatabasesMutex sync.RWMutex
+	sqlDatabases      = map[string]sqlDatabase{}
+)
+
+func driverRegistered(name string) bool {
+	for _, driver := range sql.Drivers() {
+		if driver == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// InitDatabases sets the databases that scripts can open with sql.connect
+func InitDatabases(databases map[string]config.DatabaseConfig) error {
+	result := map[string]sqlDatabase{}
+
+	for name, cfg := range databases {
+		if cfg.Driver == "" || cfg.DSN == "" {
+			return fmt.Errorf("The database %s must have both a `driver` and a `dsn`", name)
+		}
+
+		if !driverRegistered(cfg.Driver) {
+			return fmt.Errorf("Unknown driver `%s` for the database %s", cfg.Driver, name)
+		}
+
+		d := sqlDatabase{
+			driver: cfg.Driver,
+			dsn:    os.ExpandEnv(cfg.DSN),
+			options: sqlOptions{
+				MaxOpen:    cfg.MaxOpen,
+				MaxIdle:    cfg.MaxIdle,
+				Timestamps: sqlTimestampsISO,
+			},
+		}
+
+		if cfg.MaxLifetime != "" {
+			lifetime, err := config.ParseTimeInterval(cfg.MaxLifetime)
+
+			if err != nil {
+				return fmt.Errorf("Invalid `max_lifetime` for the database %s: %s", name, err)
+			}
+
+			d.options.MaxLifetime = lifetime
+		}
+
+		result[name] = d
+	}
+
+	for name, d := range result {
+		key, db, err := acquireSQLPool(d.driver, d.dsn, d.options)
+
+		if err != nil {
+			releaseDatabases(result)
+			return fmt.Errorf("Unable to open the database %s: %s", name, err)
+		}
+
+		d.key, d.db = key, db
+		result[name] = d
+	}
+
+	sqlDatabasesMutex.Lock()
+	previous := sqlDatabases
+	sqlDatabases = result
+	sqlDatabasesMutex.Unlock()
+
+	releaseDatabases(previous)
+
+	return nil
+}
+
+// releaseDatabases gives up the references that declared databases hold to their pools
+func releaseDatabases(databases map[string]sqlDatabase) {
+	for _, d := range databases {
+		if d.db != nil {
+			releaseSQLPool(d.key)
+		}
+	}
+}
+
+func sqlDatabaseNamed(name string) (sqlDatabase, error) {
+	sqlDatabasesMutex.RLock()
+	defer sqlDatabasesMutex.RUnlock()
+
+	d, ok := sqlDatabases[name]
+
+	if !ok {
+		return d, errors.New("Database " + name + " not found. Databases must be declared in the `databases` section of the configuration file.")
+	}
+
+	return d, nil
+}
+
+// DatabaseNames returns the names of the declared databases, in alphabetical order
+func DatabaseNames() []string {
+	sqlDatabasesMutex.RLock()
+	defer sqlDatabasesMutex.RUnlock()
+
+	result := []string{}
+
+	for name := range sqlDatabases {
+		result = append(result, name)
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+// PingDatabase checks that a declared database can be reached, using the pool that the
+// scripts share
+func PingDatabase(name string) error {
+	d, err := sqlDatabaseNamed(name)
+
+	if err != nil {
+		return err
+	}
+
+	return d.db.Ping()
+}
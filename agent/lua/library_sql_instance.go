@@ -1,82 +1,290 @@
 package lua
 
 import (
+	_ "github.com/ClickHouse/clickhouse-go"
+	_ "github.com/denisenkom/go-mssqldb"
 	_ "github.com/go-sql-driver/mysql"
 	_ "github.com/lib/pq"
 
+	"database/sql"
+	"encoding/json"
 	"github.com/jmoiron/sqlx"
 	"github.com/telemetryapp/go-lua"
 	"github.com/telemetryapp/goluago/util"
 )
 
-var sqlInstanceFunctions = map[string]func(c *sqlx.DB) lua.Function{
-	"query": func(db *sqlx.DB) lua.Function {
+// sqlExecutor is implemented by connections and transactions
+type sqlExecutor interface {
+	Queryx(query string, args ...interface{}) (*sqlx.Rows, error)
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Preparex(query string) (*sqlx.Stmt, error)
+}
+
+// sqlInstance is a script's handle on a shared connection pool
+type sqlInstance struct {
+	key        string
+	db         *sqlx.DB
+	timestamps string
+	closed     bool
+}
+
+var sqlInstanceFunctions = map[string]func(i *sqlInstance) lua.Function{
+	"query": func(i *sqlInstance) lua.Function {
 		return func(l *lua.State) int {
-			args := l.Top()
+			return sqlQueryFunction(l, i.checkOpen(l), -1, i.timestamps)
+		}
+	},
 
-			query := lua.CheckString(l, 1)
-			params := make([]interface{}, args-1)
+	"queryRow": func(i *sqlInstance) lua.Function {
+		return func(l *lua.State) int {
+			return sqlQueryFunction(l, i.checkOpen(l), 1, i.timestamps)
+		}
+	},
 
-			for i := 2; i <= args; i++ {
-				params[i-2] = l.ToValue(i)
-			}
+	"exec": func(i *sqlInstance) lua.Function {
+		return func(l *lua.State) int {
+			return sqlExecFunction(l, i.checkOpen(l))
+		}
+	},
 
-			result := []map[string]interface{}{}
+	"prepare": func(i *sqlInstance) lua.Function {
+		return func(l *lua.State) int {
+			return sqlPrepareFunction(l, i.checkOpen(l), i.timestamps)
+		}
+	},
 
-			rs, err := db.Queryx(query, params...)
+	"begin": func(i *sqlInstance) lua.Function {
+		return func(l *lua.State) int {
+			db := i.checkOpen(l)
+			t := &sqlTransaction{timestamps: i.timestamps}
 
-			if err != nil {
-				lua.Errorf(l, "%s", err.Error())
-				panic("unreachable")
-			}
+			_, err := tapeFor(l).Do("sql", "BEGIN", func() (interface{}, error) {
+				tx, err := db.Beginx()
+				t.tx = tx
 
-			defer rs.Close()
+				return nil, err
+			})
 
 			if err != nil {
 				lua.Errorf(l, "%s", err.Error())
 				panic("unreachable")
 			}
 
-			for rs.Next() {
-				row := make(map[string]interface{})
-				err := rs.MapScan(row)
+			runContextFor(l).track(t)
+			pushSQLTransaction(l, t)
 
-				if err != nil {
-					lua.Errorf(l, "%s", err.Error())
-					panic("unreachable")
-				}
-
-				result = append(result, row)
-			}
+			return 1
+		}
+	},
 
-			l.CreateTable(len(result), 0)
+	"ping": func(i *sqlInstance) lua.Function {
+		return func(l *lua.State) int {
+			db := i.checkOpen(l)
 
-			pushArray(l)
+			_, err := tapeFor(l).Do("sql", "PING", func() (interface{}, error) {
+				return nil, db.Ping()
+			})
 
-			for index, value := range result {
-				for i, v := range value {
-					if vv, ok := v.([]byte); ok {
-						value[i] = string(vv)
-					}
-				}
+			l.PushBoolean(err == nil)
 
-				util.DeepPush(l, value)
-				l.RawSetInt(-2, index+1)
+			if err != nil {
+				l.PushString(err.Error())
+				return 2
 			}
 
 			return 1
 		}
 	},
+
+	"close": func(i *sqlInstance) lua.Function {
+		return func(l *lua.State) int {
+			i.release()
+
+			return 0
+		}
+	},
+}
+
+// release gives up the handle's reference to its pool, if the script has not closed it
+func (i *sqlInstance) release() {
+	if !i.closed {
+		i.closed = true
+		releaseSQLPool(i.key)
+	}
+}
+
+func (i *sqlInstance) checkOpen(l *lua.State) *sqlx.DB {
+	if i.closed {
+		lua.Errorf(l, "The database connection is closed")
+		panic("unreachable")
+	}
+
+	return i.db
+}
+
+func checkSQLParams(l *lua.State, first int) []interface{} {
+	params := []interface{}{}
+
+	for i := first; i <= l.Top(); i++ {
+		params = append(params, l.ToValue(i))
+	}
+
+	return params
+}
+
+// sqlQueryFunction runs the query given as first argument and pushes its rows. If limit is
+// 1, it pushes the first row, or nil if there is none.
+func sqlQueryFunction(l *lua.State, e sqlExecutor, limit int, timestamps string) int {
+	query := lua.CheckString(l, 1)
+	params := checkSQLParams(l, 2)
+
+	return pushSQLRows(l, query, params, limit, timestamps, func() (*sqlx.Rows, error) {
+		return e.Queryx(query, params...)
+	})
 }
 
-func pushSQLInstance(l *lua.State, driverName, dataSourceName string) {
-	instance, err := sqlx.Open(driverName, dataSourceName)
+func sqlExecFunction(l *lua.State, e sqlExecutor) int {
+	query := lua.CheckString(l, 1)
+	params := checkSQLParams(l, 2)
+
+	return pushSQLResult(l, query, params, func() (sql.Result, error) {
+		return e.Exec(query, params...)
+	})
+}
+
+func sqlPrepareFunction(l *lua.State, e sqlExecutor, timestamps string) int {
+	query := lua.CheckString(l, 1)
+	s := &sqlStatement{query: query, timestamps: timestamps}
+
+	_, err := tapeFor(l).Do("sql", "PREPARE "+query, func() (interface{}, error) {
+		stmt, err := e.Preparex(query)
+		s.stmt = stmt
+
+		return nil, err
+	})
 
 	if err != nil {
 		lua.Errorf(l, "%s", err.Error())
 		panic("unreachable")
 	}
 
+	runContextFor(l).track(s)
+	pushSQLStatement(l, s)
+
+	return 1
+}
+
+// pushSQLRows pushes the rows returned by a query, with the names of the columns in their
+// `columns` field. If limit is 1, it pushes the first row, or nil if there is none, followed
+// by the names of the columns.
+func pushSQLRows(l *lua.State, query string, params []interface{}, limit int, timestamps string, fn func() (*sqlx.Rows, error)) int {
+	value, err := tapeFor(l).Do("sql", sqlRecordKey(query, params), func() (interface{}, error) {
+		rs, err := fn()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return scanSQLRows(rs, limit, timestamps)
+	})
+
+	if err != nil {
+		lua.Errorf(l, "%s", err.Error())
+		panic("unreachable")
+	}
+
+	result := toSQLRows(value)
+
+	if limit == 1 {
+		if len(result.Rows) == 0 {
+			l.PushNil()
+		} else {
+			util.DeepPush(l, result.Rows[0])
+		}
+
+		pushStringArray(l, result.Columns)
+
+		return 2
+	}
+
+	pushArray(l)
+
+	for index, value := range result.Rows {
+		util.DeepPush(l, value)
+		l.RawSetInt(-2, index+1)
+	}
+
+	pushStringArray(l, result.Columns)
+	l.SetField(-2, "columns")
+
+	return 1
+}
+
+func pushStringArray(l *lua.State, values []string) {
+	pushArray(l)
+
+	for index, value := range values {
+		l.PushString(value)
+		l.RawSetInt(-2, index+1)
+	}
+}
+
+// pushSQLResult runs a statement that returns no rows and pushes the number of rows it
+// affected and, if the driver supports it, the ID of the last inserted row
+func pushSQLResult(l *lua.State, query string, params []interface{}, fn func() (sql.Result, error)) int {
+	result, err := tapeFor(l).Do("sql", sqlRecordKey(query, params), func() (interface{}, error) {
+		r, err := fn()
+
+		if err != nil {
+			return nil, err
+		}
+
+		result := map[string]interface{}{}
+
+		if affected, err := r.RowsAffected(); err == nil {
+			result["rows_affected"] = affected
+		}
+
+		if id, err := r.LastInsertId(); err == nil {
+			result["last_insert_id"] = id
+		}
+
+		return result, nil
+	})
+
+	if err != nil {
+		lua.Errorf(l, "%s", err.Error())
+		panic("unreachable")
+	}
+
+	util.DeepPush(l, result)
+
+	return 1
+}
+
+func sqlRecordKey(query string, params []interface{}) string {
+	p, _ := json.Marshal(params)
+
+	return query + " " + string(p)
+}
+
+// pushSQLInstance pushes a handle on the shared pool for a data source. Closing the handle,
+// or the end of the run, gives the handle's reference to the pool back.
+func pushSQLInstance(l *lua.State, driverName, dataSourceName string, options sqlOptions) {
+	key, db, err := acquireSQLPool(driverName, dataSourceName, options)
+
+	if err != nil {
+		lua.Errorf(l, "%s", err.Error())
+		panic("unreachable")
+	}
+
+	instance := &sqlInstance{key: key, db: db, timestamps: options.Timestamps}
+
+	runContextFor(l).track(instance)
+	pushSQLHandle(l, instance)
+}
+
+func pushSQLHandle(l *lua.State, instance *sqlInstance) {
 	l.NewTable()
 
 	for name, fn := range sqlInstanceFunctions {
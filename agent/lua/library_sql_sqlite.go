@@ -0,0 +1,8 @@
+//go:build sqlite
+// +build sqlite
+
+package lua
+
+// The SQLite driver needs cgo, which the cross-compiled releases are built without, so it
+// is only included when the agent is built with `-tags sqlite`.
+import _ "github.com/mattn/go-sqlite3"
@@ -0,0 +1,158 @@
+package lua
+
+import (
+	"database/sql"
+	"github.com/jmoiron/sqlx"
+	"github.com/telemetryapp/go-lua"
+)
+
+// sqlTransaction wraps a transaction. When replaying, tx is nil and every call is served
+// by the tape. Transactions that are still open when the run ends are rolled back.
+type sqlTransaction struct {
+	tx         *sqlx.Tx
+	timestamps string
+	done       bool
+}
+
+// sqlStatement wraps a prepared statement. When replaying, stmt is nil and every call is
+// served by the tape. Statements that are still open when the run ends are closed.
+type sqlStatement struct {
+	query      string
+	stmt       *sqlx.Stmt
+	timestamps string
+	closed     bool
+}
+
+// release rolls back the transaction, if the script has neither committed nor rolled it back
+func (t *sqlTransaction) release() {
+	if t.tx != nil && !t.done {
+		t.done = true
+		t.tx.Rollback()
+	}
+}
+
+// release closes the statement, if the script has not closed it
+func (s *sqlStatement) release() {
+	if s.stmt != nil && !s.closed {
+		s.closed = true
+		s.stmt.Close()
+	}
+}
+
+var sqlTransactionFunctions = map[string]func(t *sqlTransaction) lua.Function{
+	"query": func(t *sqlTransaction) lua.Function {
+		return func(l *lua.State) int {
+			return sqlQueryFunction(l, t.tx, -1, t.timestamps)
+		}
+	},
+
+	"queryRow": func(t *sqlTransaction) lua.Function {
+		return func(l *lua.State) int {
+			return sqlQueryFunction(l, t.tx, 1, t.timestamps)
+		}
+	},
+
+	"exec": func(t *sqlTransaction) lua.Function {
+		return func(l *lua.State) int {
+			return sqlExecFunction(l, t.tx)
+		}
+	},
+
+	"prepare": func(t *sqlTransaction) lua.Function {
+		return func(l *lua.State) int {
+			return sqlPrepareFunction(l, t.tx, t.timestamps)
+		}
+	},
+
+	"commit": func(t *sqlTransaction) lua.Function {
+		return func(l *lua.State) int {
+			_, err := tapeFor(l).Do("sql", "COMMIT", func() (interface{}, error) {
+				t.done = true
+
+				return nil, t.tx.Commit()
+			})
+
+			if err != nil {
+				lua.Errorf(l, "%s", err.Error())
+				panic("unreachable")
+			}
+
+			return 0
+		}
+	},
+
+	"rollback": func(t *sqlTransaction) lua.Function {
+		return func(l *lua.State) int {
+			_, err := tapeFor(l).Do("sql", "ROLLBACK", func() (interface{}, error) {
+				t.done = true
+
+				return nil, t.tx.Rollback()
+			})
+
+			if err != nil {
+				lua.Errorf(l, "%s", err.Error())
+				panic("unreachable")
+			}
+
+			return 0
+		}
+	},
+}
+
+var sqlStatementFunctions = map[string]func(s *sqlStatement) lua.Function{
+	"query": func(s *sqlStatement) lua.Function {
+		return func(l *lua.State) int {
+			params := checkSQLParams(l, 1)
+
+			return pushSQLRows(l, s.query, params, -1, s.timestamps, func() (*sqlx.Rows, error) {
+				return s.stmt.Queryx(params...)
+			})
+		}
+	},
+
+	"queryRow": func(s *sqlStatement) lua.Function {
+		return func(l *lua.State) int {
+			params := checkSQLParams(l, 1)
+
+			return pushSQLRows(l, s.query, params, 1, s.timestamps, func() (*sqlx.Rows, error) {
+				return s.stmt.Queryx(params...)
+			})
+		}
+	},
+
+	"exec": func(s *sqlStatement) lua.Function {
+		return func(l *lua.State) int {
+			params := checkSQLParams(l, 1)
+
+			return pushSQLResult(l, s.query, params, func() (sql.Result, error) {
+				return s.stmt.Exec(params...)
+			})
+		}
+	},
+
+	"close": func(s *sqlStatement) lua.Function {
+		return func(l *lua.State) int {
+			s.release()
+
+			return 0
+		}
+	},
+}
+
+func pushSQLTransaction(l *lua.State, t *sqlTransaction) {
+	l.NewTable()
+
+	for name, fn := range sqlTransactionFunctions {
+		l.PushGoFunction(fn(t))
+		l.SetField(-2, name)
+	}
+}
+
+func pushSQLStatement(l *lua.State, s *sqlStatement) {
+	l.NewTable()
+
+	for name, fn := range sqlStatementFunctions {
+		l.PushGoFunction(fn(s))
+		l.SetField(-2, name)
+	}
+}
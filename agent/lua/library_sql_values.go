@@ -0,0 +1,258 @@
+package lua
+
+import (
+	"encoding/json"
+	"github.com/jmoiron/sqlx"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Timestamp formats of sql.open
+const (
+	sqlTimestampsISO   = "iso"
+	sqlTimestampsEpoch = "epoch"
+)
+
+// sqlRows is the result of a query, in a form that can be recorded
+type sqlRows struct {
+	Columns []string      `json:"columns"`
+	Rows    []interface{} `json:"rows"`
+}
+
+// maxExactInteger is the largest integer that a Lua number holds exactly. Integers beyond it
+// are returned to scripts as strings.
+const maxExactInteger = 1 << 53
+
+// sqlTimeLayouts are the layouts tried when a driver returns a date or time as text
+var sqlTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999-07",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02",
+}
+
+// sqlTypeName reduces a column's database type to its base name, e.g. `Nullable(Decimal(10, 2))`
+// to `DECIMAL` and `UNSIGNED BIGINT` to `BIGINT`
+func sqlTypeName(name string) string {
+	name = strings.ToUpper(name)
+	name = strings.TrimPrefix(name, "UNSIGNED ")
+
+	if strings.HasPrefix(name, "NULLABLE(") {
+		name = name[len("NULLABLE(") : len(name)-1]
+	}
+
+	if index := strings.Index(name, "("); index != -1 {
+		name = name[:index]
+	}
+
+	return strings.TrimSpace(name)
+}
+
+func isSQLNumberType(name string) bool {
+	switch name {
+	case "DECIMAL", "DEC", "NUMERIC", "REAL", "DOUBLE", "MONEY", "SMALLMONEY", "SERIAL", "BIGSERIAL", "YEAR":
+		return true
+	}
+
+	return strings.HasPrefix(name, "INT") || strings.HasPrefix(name, "UINT") || strings.HasSuffix(name, "INT") || strings.HasPrefix(name, "FLOAT")
+}
+
+func isSQLTimeType(name string) bool {
+	switch name {
+	case "DATE", "DATETIME", "DATETIME2", "DATETIME64", "DATETIMEOFFSET", "SMALLDATETIME", "TIMESTAMP", "TIMESTAMPTZ":
+		return true
+	}
+
+	return false
+}
+
+// sqlTime converts a time to an ISO 8601 string in UTC, or to a number of seconds since
+// the Unix epoch
+func sqlTime(t time.Time, timestamps string) interface{} {
+	if timestamps == sqlTimestampsEpoch {
+		return float64(t.Unix()) + float64(t.Nanosecond())/1e9
+	}
+
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func sqlInteger(i int64) interface{} {
+	if i > maxExactInteger || i < -maxExactInteger {
+		return strconv.FormatInt(i, 10)
+	}
+
+	return float64(i)
+}
+
+func sqlUnsigned(u uint64) interface{} {
+	if u > maxExactInteger {
+		return strconv.FormatUint(u, 10)
+	}
+
+	return float64(u)
+}
+
+func isIntegerText(s string) bool {
+	digits := strings.TrimPrefix(s, "-")
+
+	if digits == "" {
+		return false
+	}
+
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sqlText converts a value that the driver returned as text according to its column type
+func sqlText(s, typeName, timestamps string) interface{} {
+	switch {
+	case isSQLNumberType(typeName) && isIntegerText(s):
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return sqlInteger(i)
+		}
+
+		if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+			return sqlUnsigned(u)
+		}
+
+		// Wider than 64 bits
+		return s
+
+	case isSQLNumberType(typeName):
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+
+	case typeName == "BOOL" || typeName == "BOOLEAN":
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b
+		}
+
+	case isSQLTimeType(typeName):
+		for _, layout := range sqlTimeLayouts {
+			if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+				return sqlTime(t, timestamps)
+			}
+		}
+	}
+
+	return s
+}
+
+// sqlValue converts a scanned value so that it maps to the same Lua type whatever the
+// driver: numbers for all numeric columns, except for integers too large to be held
+// exactly, strings or numbers for timestamps, and nil for NULL
+func sqlValue(value interface{}, typeName, timestamps string) interface{} {
+	switch v := value.(type) {
+	case nil, bool, float64:
+		return v
+
+	case string:
+		return sqlText(v, typeName, timestamps)
+
+	case []byte:
+		return sqlText(string(v), typeName, timestamps)
+
+	case time.Time:
+		return sqlTime(v, timestamps)
+
+	case *time.Time:
+		if v == nil {
+			return nil
+		}
+
+		return sqlTime(*v, timestamps)
+	}
+
+	r := reflect.ValueOf(value)
+
+	switch r.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return sqlInteger(r.Int())
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return sqlUnsigned(r.Uint())
+
+	case reflect.Float32:
+		return r.Float()
+
+	case reflect.Ptr:
+		if r.IsNil() {
+			return nil
+		}
+
+		return sqlValue(r.Elem().Interface(), typeName, timestamps)
+	}
+
+	// Decimal types usually implement fmt.Stringer
+	if s, ok := value.(interface {
+		String() string
+	}); ok {
+		return sqlText(s.String(), typeName, timestamps)
+	}
+
+	return value
+}
+
+// scanSQLRows reads up to limit rows, or all of them if limit is negative, and closes rs
+func scanSQLRows(rs *sqlx.Rows, limit int, timestamps string) (sqlRows, error) {
+	defer rs.Close()
+
+	result := sqlRows{Rows: []interface{}{}}
+
+	columns, err := rs.Columns()
+
+	if err != nil {
+		return result, err
+	}
+
+	result.Columns = columns
+	typeNames := make([]string, len(columns))
+
+	if types, err := rs.ColumnTypes(); err == nil {
+		for index, t := range types {
+			typeNames[index] = sqlTypeName(t.DatabaseTypeName())
+		}
+	}
+
+	for (limit < 0 || len(result.Rows) < limit) && rs.Next() {
+		values, err := rs.SliceScan()
+
+		if err != nil {
+			return result, err
+		}
+
+		row := map[string]interface{}{}
+
+		for index, value := range values {
+			row[columns[index]] = sqlValue(value, typeNames[index], timestamps)
+		}
+
+		result.Rows = append(result.Rows, row)
+	}
+
+	return result, rs.Err()
+}
+
+// toSQLRows converts the result of a query, which is the JSON form of the rows when it is
+// served by the tape
+func toSQLRows(value interface{}) sqlRows {
+	if v, ok := value.(sqlRows); ok {
+		return v
+	}
+
+	result := sqlRows{}
+	data, _ := json.Marshal(value)
+	json.Unmarshal(data, &result)
+
+	return result
+}
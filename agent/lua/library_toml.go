@@ -0,0 +1,58 @@
+package lua
+
+import (
+	"bytes"
+	"github.com/BurntSushi/toml"
+	"github.com/telemetryapp/go-lua"
+)
+
+var tomlLibrary = []lua.RegistryFunction{
+	{
+		"encode",
+		func(l *lua.State) int {
+			v, ok := checkEncodable(l, 1).(map[string]interface{})
+
+			if !ok {
+				lua.Errorf(l, "Only tables with string keys can be converted to TOML")
+				panic("unreachable")
+			}
+
+			b := &bytes.Buffer{}
+
+			if err := toml.NewEncoder(b).Encode(v); err != nil {
+				lua.Errorf(l, "%s", err)
+				panic("unreachable")
+			}
+
+			l.PushString(b.String())
+
+			return 1
+		},
+	},
+
+	{
+		"decode",
+		func(l *lua.State) int {
+			res := map[string]interface{}{}
+
+			if _, err := toml.Decode(lua.CheckString(l, 1), &res); err != nil {
+				lua.Errorf(l, "%s", err)
+				panic("unreachable")
+			}
+
+			pushValue(l, res)
+
+			return 1
+		},
+	},
+}
+
+func openTOMLLibrary(l *lua.State) {
+	open := func(l *lua.State) int {
+		lua.NewLibrary(l, tomlLibrary)
+		return 1
+	}
+
+	lua.Require(l, "telemetry/toml", open, false)
+	l.Pop(1)
+}
@@ -4,8 +4,51 @@ import (
 	"github.com/clbanning/mxj"
 	"github.com/telemetryapp/go-lua"
 	"github.com/telemetryapp/goluago/util"
+	"strings"
 )
 
+// xmlArrays turns the child elements of a decoded element into arrays, so that repeated
+// elements have the same shape whether they appear once or more. If names is nil, all the
+// child elements are converted; otherwise only those whose name, with or without its
+// namespace prefix, is in names. Attributes (`-name`) and text (`#text`) are left alone.
+func xmlArrays(value interface{}, names map[string]bool) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if strings.HasPrefix(key, "-") || strings.HasPrefix(key, "#") {
+				continue
+			}
+
+			child = xmlArrays(child, names)
+
+			if _, ok := child.([]interface{}); !ok && xmlArrayWanted(key, names) {
+				child = []interface{}{child}
+			}
+
+			v[key] = child
+		}
+
+	case []interface{}:
+		for index, item := range v {
+			v[index] = xmlArrays(item, names)
+		}
+	}
+
+	return value
+}
+
+func xmlArrayWanted(key string, names map[string]bool) bool {
+	if names == nil || names[key] {
+		return true
+	}
+
+	if index := strings.Index(key, ":"); index != -1 {
+		return names[key[index+1:]]
+	}
+
+	return false
+}
+
 var xmlLibrary = []lua.RegistryFunction{
 	{
 		"encode",
@@ -48,11 +91,37 @@ var xmlLibrary = []lua.RegistryFunction{
 				panic("unreachable")
 			}
 
-			util.DeepPush(l, res)
+			// The `arrays` option is either true, for all the repeatable elements, or a
+			// list of element names
+			if l.IsTable(2) {
+				l.Field(2, "arrays")
+
+				if l.IsTable(-1) {
+					names := map[string]bool{}
+
+					for _, name := range checkStringList(l, l.Top()) {
+						names[name] = true
+					}
+
+					for _, root := range res {
+						xmlArrays(root, names)
+					}
+				} else if l.ToBoolean(-1) {
+					for _, root := range res {
+						xmlArrays(root, nil)
+					}
+				}
+
+				l.Pop(1)
+			}
+
+			util.DeepPush(l, map[string]interface{}(res))
 
 			return 1
 		},
 	},
+
+	{"query", xmlQueryFunction},
 }
 
 func openXMLLibrary(l *lua.State) {
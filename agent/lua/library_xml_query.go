@@ -0,0 +1,111 @@
+package lua
+
+import (
+	"github.com/antchfx/xmlquery"
+	"github.com/antchfx/xpath"
+	"github.com/telemetryapp/go-lua"
+	"github.com/telemetryapp/goluago/util"
+	"strings"
+)
+
+// xmlQueryNode converts a node selected by a query into a table with its name, namespace,
+// text and, for elements, its attributes and markup
+func xmlQueryNode(nav *xmlquery.NodeNavigator) map[string]interface{} {
+	if nav.NodeType() == xpath.AttributeNode {
+		return map[string]interface{}{
+			"name":      nav.LocalName(),
+			"namespace": nav.NamespaceURL(),
+			"value":     nav.Value(),
+		}
+	}
+
+	node := nav.Current()
+
+	result := map[string]interface{}{
+		"name":  node.Data,
+		"value": node.InnerText(),
+	}
+
+	if node.Type != xmlquery.ElementNode {
+		result["name"] = ""
+
+		return result
+	}
+
+	result["namespace"] = node.NamespaceURI
+	result["xml"] = node.OutputXML(true)
+
+	attributes := map[string]interface{}{}
+
+	for _, attr := range node.Attr {
+		// Namespace declarations are not attributes
+		if attr.Name.Space == "xmlns" || (attr.Name.Space == "" && attr.Name.Local == "xmlns") {
+			continue
+		}
+
+		name := attr.Name.Local
+
+		if attr.Name.Space != "" {
+			name = attr.Name.Space + ":" + name
+		}
+
+		attributes[name] = attr.Value
+	}
+
+	result["attributes"] = attributes
+
+	return result
+}
+
+// xmlQueryFunction evaluates an XPath expression against a document. Expressions that
+// select nodes return an array of nodes; others, such as `count(//item)`, return a number,
+// a string or a boolean. Prefixes in the expression are resolved with the `namespaces`
+// option if it is given, and otherwise match the prefixes used in the document.
+func xmlQueryFunction(l *lua.State) int {
+	doc, err := xmlquery.Parse(strings.NewReader(lua.CheckString(l, 1)))
+
+	if err != nil {
+		lua.Errorf(l, "%s", err.Error())
+		panic("unreachable")
+	}
+
+	expression := lua.CheckString(l, 2)
+
+	var expr *xpath.Expr
+
+	if l.IsTable(3) {
+		namespaces := map[string]string{}
+
+		for prefix, uri := range optionTable(l, 3, "namespaces") {
+			if s, ok := uri.(string); ok {
+				namespaces[prefix] = s
+			}
+		}
+
+		expr, err = xpath.CompileWithNS(expression, namespaces)
+	} else {
+		expr, err = xpath.Compile(expression)
+	}
+
+	if err != nil {
+		lua.Errorf(l, "%s", err.Error())
+		panic("unreachable")
+	}
+
+	result := expr.Evaluate(xmlquery.CreateXPathNavigator(doc))
+	it, ok := result.(*xpath.NodeIterator)
+
+	if !ok {
+		util.DeepPush(l, result)
+		return 1
+	}
+
+	pushArray(l)
+
+	for index := 1; it.MoveNext(); index++ {
+		util.DeepPush(l, xmlQueryNode(it.Current().(*xmlquery.NodeNavigator)))
+		l.RawSetInt(-2, index)
+	}
+
+	return 1
+}
@@ -0,0 +1,80 @@
+package lua
+
+import (
+	"bytes"
+	"github.com/telemetryapp/go-lua"
+	"gopkg.in/yaml.v2"
+	"io"
+)
+
+var yamlLibrary = []lua.RegistryFunction{
+	{
+		"encode",
+		func(l *lua.State) int {
+			res, err := yaml.Marshal(checkEncodable(l, 1))
+
+			if err != nil {
+				lua.Errorf(l, "%s", err)
+				panic("unreachable")
+			}
+
+			l.PushString(string(res))
+
+			return 1
+		},
+	},
+
+	{
+		"decode",
+		func(l *lua.State) int {
+			var res interface{}
+			err := yaml.Unmarshal([]byte(lua.CheckString(l, 1)), &res)
+
+			if err != nil {
+				lua.Errorf(l, "%s", err)
+				panic("unreachable")
+			}
+
+			pushValue(l, res)
+
+			return 1
+		},
+	},
+
+	{
+		// decodeAll returns all the documents of a stream separated by `---`, such as a set
+		// of Kubernetes manifests
+		"decodeAll",
+		func(l *lua.State) int {
+			decoder := yaml.NewDecoder(bytes.NewBufferString(lua.CheckString(l, 1)))
+			documents := []interface{}{}
+
+			for {
+				var document interface{}
+
+				if err := decoder.Decode(&document); err == io.EOF {
+					break
+				} else if err != nil {
+					lua.Errorf(l, "%s", err)
+					panic("unreachable")
+				}
+
+				documents = append(documents, document)
+			}
+
+			pushValue(l, documents)
+
+			return 1
+		},
+	},
+}
+
+func openYAMLLibrary(l *lua.State) {
+	open := func(l *lua.State) int {
+		lua.NewLibrary(l, yamlLibrary)
+		return 1
+	}
+
+	lua.Require(l, "telemetry/yaml", open, false)
+	l.Pop(1)
+}
@@ -0,0 +1,148 @@
+package lua
+
+import (
+	"github.com/telemetryapp/go-lua"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	requireRegistryKey = "telemetry.require"
+	modulesRegistryKey = "telemetry.modules"
+)
+
+// installRequire replaces `require` with a version that also loads modules from the
+// directories of the run's Lua path and, in the strict sandbox, only loads allowed modules.
+//
+// Modules found on the Lua path are compiled once per state and version of their file, and
+// run the first time they are required in each run. Like the globals, package.loaded is
+// reset between runs, so runs never share the values a module returns.
+func (s *state) installRequire() {
+	l := s.l
+
+	l.NewTable()
+	l.SetField(lua.RegistryIndex, modulesRegistryKey)
+
+	l.Global("require")
+	l.SetField(lua.RegistryIndex, requireRegistryKey)
+
+	l.PushGoFunction(s.require)
+	l.SetGlobal("require")
+}
+
+// moduleStatus returns whether a module has already been loaded, and whether it is
+// preloaded by the agent
+func moduleStatus(l *lua.State, name string) (bool, bool) {
+	l.Global("package")
+	defer l.Pop(1)
+
+	result := []bool{}
+
+	for _, table := range []string{"loaded", "preload"} {
+		l.Field(-1, table)
+		l.Field(-1, name)
+
+		result = append(result, !l.IsNil(-1))
+
+		l.Pop(2)
+	}
+
+	return result[0], result[1]
+}
+
+// findModule searches the Lua path for a module, trying `name.lua` and `name/init.lua` in
+// each directory. Dots in the name are treated as directory separators.
+func (s *state) findModule(name string) string {
+	if strings.Contains(name, "..") {
+		return ""
+	}
+
+	relative := filepath.FromSlash(strings.Replace(name, ".", "/", -1))
+
+	for _, dir := range s.luaPath {
+		for _, candidate := range []string{relative + ".lua", filepath.Join(relative, "init.lua")} {
+			path := filepath.Join(dir, candidate)
+
+			if info, err := os.Stat(path); err == nil && !info.IsDir() {
+				return path
+			}
+		}
+	}
+
+	return ""
+}
+
+func (s *state) require(l *lua.State) int {
+	name := lua.CheckString(l, 1)
+
+	if s.sandbox == SandboxStrict && !moduleAllowed(name, strictModules) && !moduleAllowed(name, s.allowedModules) {
+		lua.Errorf(l, "Module `%s` cannot be required in the strict sandbox", name)
+		panic("unreachable")
+	}
+
+	loaded, preloaded := moduleStatus(l, name)
+
+	if !loaded && !preloaded {
+		if path := s.findModule(name); path != "" {
+			return s.loadModule(l, name, path)
+		}
+	}
+
+	if !loaded && s.sandbox == SandboxStrict && s.pushRestrictedModule(name) {
+		return 1
+	}
+
+	l.Field(lua.RegistryIndex, requireRegistryKey)
+	l.PushString(name)
+	l.Call(1, 1)
+
+	return 1
+}
+
+// loadModule runs a module from the Lua path, compiling it only if the state has not seen
+// this version of its file yet
+func (s *state) loadModule(l *lua.State, name, path string) int {
+	sc, err := loadScript(path)
+
+	if err != nil {
+		lua.Errorf(l, "Unable to load module `%s`: %s", name, err)
+		panic("unreachable")
+	}
+
+	l.Field(lua.RegistryIndex, modulesRegistryKey)
+
+	if version, ok := s.moduleVersions[path]; ok && version == sc.version {
+		l.Field(-1, path)
+	} else {
+		if err := lua.LoadBuffer(l, sc.source, "@"+path, "t"); err != nil {
+			message, _ := l.ToString(-1)
+
+			lua.Errorf(l, "Unable to load module `%s`: %s", name, message)
+			panic("unreachable")
+		}
+
+		l.PushValue(-1)
+		l.SetField(-3, path)
+
+		s.moduleVersions[path] = sc.version
+	}
+
+	l.Remove(-2)
+
+	l.PushString(name)
+	l.Call(1, 1)
+
+	if l.IsNil(-1) {
+		l.Pop(1)
+		l.PushBoolean(true)
+	}
+
+	l.Global("package")
+	l.Field(-1, "loaded")
+	l.PushValue(-3)
+	l.SetField(-2, name)
+	l.Pop(2)
+
+	return 1
+}
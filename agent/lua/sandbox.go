@@ -0,0 +1,311 @@
+package lua
+
+import (
+	"fmt"
+	"github.com/telemetryapp/go-lua"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SandboxStrict is the sandbox profile that removes access to the file system and to other
+// processes, and restricts the modules that can be required
+const SandboxStrict = "strict"
+
+// Limits bounds the resources a script may use. Zero values mean no limit.
+//
+// Instructions and the deadline are checked every thousand instructions, so a script that
+// is blocked in a Go function (for example, waiting on an HTTP response) is only stopped
+// when that function returns.
+//
+// The memory limit is not a per-script limit but an opt-in, process-wide guard. The Go
+// runtime does not account memory per script, so the agent's heap is sampled once a second
+// while any script with a memory limit runs, and a script is stopped when the heap has grown
+// by more than its limit since the script started, whatever caused the growth: another job,
+// or the agent itself, can get the script stopped. It is meant as a last resort against
+// runaway scripts on hosts where the agent runs little else, and no profile sets it.
+type Limits struct {
+	Instructions int
+	Memory       uint64
+	Timeout      time.Duration
+}
+
+// StrictLimits are the limits applied in the strict sandbox unless a job overrides them. They
+// leave memory unlimited, since the memory limit is process-wide.
+var StrictLimits = Limits{
+	Instructions: 100000000,
+	Timeout:      time.Minute,
+}
+
+// strictModules are the modules that can be required in the strict sandbox without being
+// listed in the job's `lua_modules`. Modules that read or write files or reach the network,
+// such as telemetry/csv, telemetry/excel, telemetry/http, telemetry/sql, telemetry/redis,
+// telemetry/flows or telemetry/storage, are left out.
+var strictModules = []string{
+	"_G",
+	"bit32",
+	"coroutine",
+	"math",
+	"os",
+	"package",
+	"string",
+	"table",
+	"goluago/crypto/hmac",
+	"goluago/crypto/sha256",
+	"goluago/encoding/base64",
+	"goluago/encoding/json",
+	"goluago/fmt",
+	"goluago/net/url",
+	"goluago/regexp",
+	"goluago/strings",
+	"goluago/time",
+	"goluago/util",
+	"telemetry/crypto",
+	"telemetry/json",
+	"telemetry/toml",
+	"telemetry/xml",
+	"telemetry/yaml",
+}
+
+// strictSource removes the parts of the standard library that reach outside the agent, and
+// replaces the package table with a read-only view so that scripts cannot point the
+// standard module searchers at other files
+const strictSource = `
+io = nil
+package.loaded.io = nil
+debug = nil
+package.loaded.debug = nil
+dofile = nil
+loadfile = nil
+os.execute = nil
+os.exit = nil
+os.remove = nil
+os.rename = nil
+os.tmpname = nil
+os.getenv = nil
+package.path = ""
+package.cpath = ""
+package.loadlib = nil
+
+local real = package
+
+package = setmetatable({}, {
+	__index = real,
+	__newindex = function(t, k)
+		error("package." .. tostring(k) .. " cannot be changed in the strict sandbox", 2)
+	end,
+	__metatable = false,
+})
+
+real.loaded.package = package
+`
+
+const (
+	hookInterval       = 1000
+	restrictedRegistry = "telemetry.restricted"
+)
+
+// LimitError is returned when a script exceeds one of its limits
+type LimitError struct {
+	Reason string
+}
+
+func (e *LimitError) Error() string {
+	return "Script exceeded limits: " + e.Reason
+}
+
+func moduleAllowed(name string, allowed []string) bool {
+	for _, a := range allowed {
+		if a == name || (strings.HasSuffix(a, "/") && strings.HasPrefix(name, a)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// applyStrictSandbox removes the unsafe functions from a state, and moves the modules that
+// are not allowed by default out of package.loaded, so that scripts can only reach them
+// through the state's `require` function, which checks the job's allowed modules
+func (s *state) applyStrictSandbox() error {
+	l := s.l
+
+	if err := lua.DoString(l, strictSource); err != nil {
+		return err
+	}
+
+	l.NewTable()
+	l.Global("package")
+	l.Field(-1, "loaded")
+
+	restricted := []string{}
+
+	l.PushNil()
+
+	for l.Next(-2) {
+		if l.TypeOf(-2) == lua.TypeString {
+			name, _ := l.ToString(-2)
+
+			if !moduleAllowed(name, strictModules) {
+				restricted = append(restricted, name)
+				l.SetField(-5, name)
+				continue
+			}
+		}
+
+		l.Pop(1)
+	}
+
+	for _, name := range restricted {
+		l.PushNil()
+		l.SetField(-2, name)
+	}
+
+	l.Pop(2)
+	l.SetField(lua.RegistryIndex, restrictedRegistry)
+
+	return nil
+}
+
+// pushRestrictedModule loads a module that was moved out of package.loaded by the strict
+// sandbox, and returns false if there is no such module
+func (s *state) pushRestrictedModule(name string) bool {
+	l := s.l
+
+	l.Field(lua.RegistryIndex, restrictedRegistry)
+	l.Field(-1, name)
+	l.Remove(-2)
+
+	if l.IsNil(-1) {
+		l.Pop(1)
+		return false
+	}
+
+	l.Global("package")
+	l.Field(-1, "loaded")
+	l.PushValue(-3)
+	l.SetField(-2, name)
+	l.Pop(2)
+
+	return true
+}
+
+// The heap is sampled by a single goroutine while scripts with a memory limit run, since
+// reading the memory statistics stops the world
+var heapSampler = struct {
+	sync.Mutex
+	users int
+	stop  chan bool
+}{}
+
+var sampledHeap uint64
+
+func heapAlloc() uint64 {
+	m := runtime.MemStats{}
+	runtime.ReadMemStats(&m)
+
+	return m.HeapAlloc
+}
+
+// startHeapSampling returns the current size of the heap, and samples it until every call
+// has been matched by a call to stopHeapSampling
+func startHeapSampling() uint64 {
+	heapSampler.Lock()
+	defer heapSampler.Unlock()
+
+	heapSampler.users++
+
+	if heapSampler.users == 1 {
+		atomic.StoreUint64(&sampledHeap, heapAlloc())
+
+		heapSampler.stop = make(chan bool)
+
+		go func(stop chan bool) {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ticker.C:
+					atomic.StoreUint64(&sampledHeap, heapAlloc())
+
+				case <-stop:
+					return
+				}
+			}
+		}(heapSampler.stop)
+	}
+
+	return atomic.LoadUint64(&sampledHeap)
+}
+
+func stopHeapSampling() {
+	heapSampler.Lock()
+	defer heapSampler.Unlock()
+
+	heapSampler.users--
+
+	if heapSampler.users == 0 {
+		close(heapSampler.stop)
+	}
+}
+
+// exceed records that a limit was hit and aborts the script. The error is recorded so that
+// it is reported even if the script catches it with pcall.
+func (s *state) exceed(l *lua.State, format string, args ...interface{}) {
+	if s.exceeded == nil {
+		s.exceeded = &LimitError{Reason: fmt.Sprintf(format, args...)}
+	}
+
+	lua.Errorf(l, "%s", s.exceeded)
+	panic("unreachable")
+}
+
+// setLimits installs a hook that enforces the limits during the next run
+func (s *state) setLimits(limits Limits) {
+	s.exceeded = nil
+
+	if s.sampling {
+		stopHeapSampling()
+		s.sampling = false
+	}
+
+	if limits == (Limits{}) {
+		lua.SetDebugHook(s.l, nil, 0, 0)
+		return
+	}
+
+	var deadline time.Time
+	var baseline uint64
+
+	if limits.Timeout > 0 {
+		deadline = time.Now().Add(limits.Timeout)
+	}
+
+	if limits.Memory > 0 {
+		baseline = startHeapSampling()
+		s.sampling = true
+	}
+
+	instructions := 0
+
+	lua.SetDebugHook(s.l, func(l *lua.State, ar lua.Debug) {
+		instructions += hookInterval
+
+		if limits.Instructions > 0 && instructions > limits.Instructions {
+			s.exceed(l, "more than %d instructions executed", limits.Instructions)
+		}
+
+		if limits.Timeout > 0 && time.Now().After(deadline) {
+			s.exceed(l, "running for longer than %s", limits.Timeout)
+		}
+
+		if limits.Memory > 0 {
+			if current := atomic.LoadUint64(&sampledHeap); current > baseline && current-baseline > limits.Memory {
+				s.exceed(l, "more than %d MB of memory allocated", limits.Memory>>20)
+			}
+		}
+	}, lua.MaskCount, hookInterval)
+}
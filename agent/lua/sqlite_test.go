@@ -0,0 +1,131 @@
+//go:build sqlite
+// +build sqlite
+
+package lua
+
+import (
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLite(t *testing.T) {
+	script := `
+local sql = require("telemetry/sql")
+local db = sql.open("sqlite3", ":memory:", {max_open = 1, timestamps = "epoch"})
+
+db.exec("CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT, price DECIMAL(10, 2), added DATETIME)")
+
+local tx = db.begin()
+local insert = tx.prepare("INSERT INTO items (name, price, added) VALUES (?, ?, ?)")
+insert.exec("a", 1.5, "2016-02-24 14:42:45")
+local r = insert.exec("b", nil, nil)
+insert.close()
+tx.commit()
+
+tx = db.begin()
+tx.exec("DELETE FROM items")
+tx.rollback()
+
+output.last_id = r.last_insert_id
+output.affected = r.rows_affected
+
+local rows = db.query("SELECT id, name, price, added FROM items ORDER BY id")
+output.count = #rows
+output.columns = table.concat(rows.columns, ",")
+output.price = rows[1].price
+output.added = rows[1].added
+output.null = rows[2].price == nil
+
+output.missing = db.queryRow("SELECT * FROM items WHERE id = ?", 100) == nil
+
+db.close()
+`
+
+	output, err := Exec(script, nil, nil)
+
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+
+	expected := map[string]interface{}{
+		"last_id":  2.0,
+		"affected": 1.0,
+		"count":    2.0,
+		"columns":  "id,name,price,added",
+		"price":    1.5,
+		"added":    1456324965.0,
+		"null":     true,
+		"missing":  true,
+	}
+
+	if !compareValue(expected, output) {
+		t.Errorf("Unexpected output %#v", output)
+	}
+}
+
+func TestSQLConnect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent_sqlite")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	err = InitDatabases(map[string]config.DatabaseConfig{
+		"local": {Driver: "sqlite3", DSN: filepath.Join(dir, "test.db"), MaxOpen: 1},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer InitDatabases(nil)
+
+	if err := PingDatabase("local"); err != nil {
+		t.Fatalf("Unable to ping the database: %s", err)
+	}
+
+	setup := `
+local db = require("telemetry/sql").connect("local")
+
+db.exec("CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT)")
+db.exec("INSERT INTO items (name) VALUES (?)", "committed")
+
+-- Neither committed nor rolled back, nor is the connection closed
+local tx = db.begin()
+tx.exec("INSERT INTO items (name) VALUES (?)", "abandoned")
+tx.prepare("SELECT * FROM items")
+`
+
+	if _, err := Exec(setup, nil, nil); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+
+	pool, ok := sqlPools["sqlite3 "+filepath.Join(dir, "test.db")]
+
+	if !ok || pool.refs != 1 {
+		t.Fatal("The run should give its reference to the pool back, leaving the pool to the declared database")
+	}
+
+	db := pool.db
+
+	output, err := Exec(`local rows = require("telemetry/sql").connect("local").query("SELECT name FROM items"); output.count = #rows; output.name = rows[1].name`, nil, nil)
+
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+
+	if !compareValue(map[string]interface{}{"count": 1.0, "name": "committed"}, output) {
+		t.Errorf("The abandoned transaction should have been rolled back, but got %#v", output)
+	}
+
+	if sqlPools["sqlite3 "+filepath.Join(dir, "test.db")].db != db {
+		t.Error("The second run should reuse the pool of the first")
+	}
+
+	closeSQLPools()
+}
@@ -0,0 +1,263 @@
+package lua
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/telemetryapp/go-lua"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	chunksRegistryKey = "telemetry.chunks"
+	resetRegistryKey  = "telemetry.reset"
+)
+
+// resetSource snapshots every table reachable from the globals of a freshly initialized
+// state, including the library tables, the modules in package.loaded and the metatables
+// of the built-in types, and returns a function that restores their contents and their
+// metatables after a run. Only fields are restored; the snapshot holds the original
+// values, so a run can replace a library function but not change the function itself.
+//
+// The chunk receives the modules held back by the strict sandbox, which are not reachable
+// from the globals.
+const resetSource = `
+local restricted = ...
+local debug, getmetatable, next, rawget, rawset, setmetatable, type = debug, getmetatable, next, rawget, rawset, setmetatable, type
+local getmeta = debug and debug.getmetatable or getmetatable
+local setmeta = debug and debug.setmetatable or setmetatable
+local tables = {}
+
+local function snapshot(t)
+	if tables[t] then return end
+
+	local fields = {}
+	tables[t] = {fields = fields, metatable = getmeta(t)}
+
+	for k, v in next, t do
+		fields[k] = v
+		if type(v) == "table" then snapshot(v) end
+	end
+
+	if tables[t].metatable then snapshot(tables[t].metatable) end
+end
+
+snapshot(_G)
+
+-- The strict sandbox hides the package table behind a read-only view
+for _, name in next, {"loaded", "preload", "searchers"} do
+	if type(package[name]) == "table" then snapshot(package[name]) end
+end
+
+if restricted then snapshot(restricted) end
+
+-- Without the debug library, only the string metatable is reachable, and it cannot be replaced
+local types = {n = 4, "", 0, false, print}
+local typeMetatables = {}
+
+for i = 1, types.n do
+	typeMetatables[i] = getmeta(types[i])
+	if typeMetatables[i] then snapshot(typeMetatables[i]) end
+end
+
+return function()
+	for t, s in next, tables do
+		if getmeta(t) ~= s.metatable then setmeta(t, s.metatable) end
+
+		for k in next, t do
+			if s.fields[k] == nil then rawset(t, k, nil) end
+		end
+
+		for k, v in next, s.fields do
+			if rawget(t, k) ~= v then rawset(t, k, v) end
+		end
+	end
+
+	if debug then
+		for i = 1, types.n do
+			if getmeta(types[i]) ~= typeMetatables[i] then setmeta(types[i], typeMetatables[i]) end
+		end
+	end
+end
+`
+
+// scriptVersion identifies the contents of a script file
+type scriptVersion [sha256.Size]byte
+
+type script struct {
+	version scriptVersion
+	source  string
+}
+
+// cachedScript is a script as it was last read, with the size and modification time of its
+// file at the time
+type cachedScript struct {
+	script
+	modTime time.Time
+	size    int64
+}
+
+var (
+	scriptsMutex sync.Mutex
+	scripts      = map[string]cachedScript{}
+)
+
+// loadScript returns the source of a script and a hash of its contents. The file is only
+// read and hashed again when its size or modification time changes; the hash lets states
+// tell whether the script they have compiled is still current.
+func loadScript(path string) (script, error) {
+	info, err := os.Stat(path)
+
+	if err != nil {
+		return script{}, err
+	}
+
+	scriptsMutex.Lock()
+	defer scriptsMutex.Unlock()
+
+	if c, ok := scripts[path]; ok && c.modTime.Equal(info.ModTime()) && c.size == info.Size() {
+		return c.script, nil
+	}
+
+	source, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return script{}, err
+	}
+
+	sc := script{version: sha256.Sum256(source), source: string(source)}
+	scripts[path] = cachedScript{script: sc, modTime: info.ModTime(), size: info.Size()}
+
+	return sc, nil
+}
+
+// state is a Lua state with all of the agent's libraries opened. States are pooled by
+// sandbox profile and reset between runs; each one keeps the scripts it has compiled in
+// its registry.
+type state struct {
+	l              *lua.State
+	sandbox        string
+	chunks         map[string]scriptVersion
+	moduleVersions map[string]scriptVersion
+	luaPath        []string
+	allowedModules []string
+	exceeded       *LimitError
+	sampling       bool
+}
+
+var statePools = map[string]*sync.Pool{
+	"":            &sync.Pool{},
+	SandboxStrict: &sync.Pool{},
+}
+
+func newState(sandbox string) (*state, error) {
+	l := lua.NewState()
+
+	s := &state{
+		l:              l,
+		sandbox:        sandbox,
+		chunks:         map[string]scriptVersion{},
+		moduleVersions: map[string]scriptVersion{},
+	}
+
+	openLibraries(l)
+	s.installRequire()
+
+	if sandbox == SandboxStrict {
+		if err := s.applyStrictSandbox(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := lua.LoadString(l, resetSource); err != nil {
+		return nil, err
+	}
+
+	l.Field(lua.RegistryIndex, restrictedRegistry)
+
+	if err := l.ProtectedCall(1, 1, 0); err != nil {
+		return nil, err
+	}
+
+	l.SetField(lua.RegistryIndex, resetRegistryKey)
+
+	l.NewTable()
+	l.SetField(lua.RegistryIndex, chunksRegistryKey)
+
+	return s, nil
+}
+
+// acquireState returns a state for the given sandbox profile, prepared for the given options
+func acquireState(options ExecOptions) (*state, error) {
+	pool, ok := statePools[options.Sandbox]
+
+	if !ok {
+		return nil, fmt.Errorf("Unknown Lua sandbox profile `%s`", options.Sandbox)
+	}
+
+	s, ok := pool.Get().(*state)
+
+	if !ok {
+		var err error
+
+		if s, err = newState(options.Sandbox); err != nil {
+			return nil, err
+		}
+	}
+
+	s.luaPath = options.LuaPath
+	s.allowedModules = options.Modules
+	s.setLimits(options.Limits)
+
+	return s, nil
+}
+
+// releaseState resets a state and returns it to the pool. States that cannot be reset
+// are discarded.
+func releaseState(s *state) {
+	l := s.l
+
+	l.SetTop(0)
+	runContextFor(l).releaseResources()
+	clearRunContext(l)
+	s.setLimits(Limits{})
+	s.luaPath = nil
+	s.allowedModules = nil
+
+	l.Field(lua.RegistryIndex, resetRegistryKey)
+
+	if err := l.ProtectedCall(0, 0, 0); err != nil {
+		return
+	}
+
+	statePools[s.sandbox].Put(s)
+}
+
+// loadChunk pushes the compiled function for a script, compiling it if the state has not
+// seen this version of the script yet
+func (s *state) loadChunk(path string, sc script) error {
+	l := s.l
+
+	if version, ok := s.chunks[path]; ok && version == sc.version {
+		l.Field(lua.RegistryIndex, chunksRegistryKey)
+		l.Field(-1, path)
+		l.Remove(-2)
+
+		return nil
+	}
+
+	if err := lua.LoadBuffer(l, sc.source, "@"+path, "t"); err != nil {
+		return parseError(l, err)
+	}
+
+	l.Field(lua.RegistryIndex, chunksRegistryKey)
+	l.PushValue(-2)
+	l.SetField(-2, path)
+	l.Pop(1)
+
+	s.chunks[path] = sc.version
+
+	return nil
+}
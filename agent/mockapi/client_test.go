@@ -0,0 +1,162 @@
+package mockapi
+
+import (
+	"github.com/telemetryapp/gotelemetry"
+	"net/http/httptest"
+	"testing"
+)
+
+// These tests drive the Telemetry client used by the agent against the server, so that the
+// routes and payloads the server accepts are the ones the client actually sends.
+
+func newClientTest(t *testing.T) (*Server, *httptest.Server, gotelemetry.Credentials) {
+	s := NewServer("token")
+	ts := httptest.NewServer(s)
+
+	credentials, err := gotelemetry.NewCredentials("token", ts.URL)
+
+	if err != nil {
+		ts.Close()
+		t.Fatalf("Unable to create credentials: %s", err)
+	}
+
+	return s, ts, credentials
+}
+
+func TestClientBatch(t *testing.T) {
+	s, ts, credentials := newClientTest(t)
+	defer ts.Close()
+
+	b := gotelemetry.Batch{}
+	b.SetData("value", map[string]interface{}{"value": 1, "label": "A"})
+
+	if err := b.Publish(credentials, "", gotelemetry.BatchTypePOST); err != nil {
+		t.Fatalf("POST failed: %s", err)
+	}
+
+	b = gotelemetry.Batch{}
+	b.SetData("value", map[string]interface{}{"value": 2})
+
+	if err := b.Publish(credentials, "", gotelemetry.BatchTypePATCH); err != nil {
+		t.Fatalf("PATCH failed: %s", err)
+	}
+
+	b = gotelemetry.Batch{}
+	b.SetData("value", []interface{}{map[string]interface{}{"op": "remove", "path": "/label"}})
+
+	if err := b.Publish(credentials, "", gotelemetry.BatchTypeJSONPATCH); err != nil {
+		t.Fatalf("JSON-Patch failed: %s", err)
+	}
+
+	if f, ok := s.Flow("value"); !ok || f.Data["value"] != 2.0 || f.Data["label"] != nil || f.Updates != 3 {
+		t.Errorf("The updates should have been applied, but the flow is %+v", f)
+	}
+
+	b = gotelemetry.Batch{}
+	b.SetData("channel_value", map[string]interface{}{"value": 1})
+
+	if err := b.Publish(credentials, "ops", gotelemetry.BatchTypePATCH); err != nil {
+		t.Fatalf("Channel update failed: %s", err)
+	}
+
+	if f, ok := s.Flow("channel_value"); !ok || f.Channel != "ops" {
+		t.Errorf("The update should have been sent to the channel, but the flow is %+v", f)
+	}
+
+	b = gotelemetry.Batch{}
+	b.SetData("value", []interface{}{map[string]interface{}{"op": "remove", "path": "/missing"}})
+
+	if err := b.Publish(credentials, "", gotelemetry.BatchTypeJSONPATCH); err == nil {
+		t.Error("A failed JSON-Patch should be reported to the client")
+	}
+}
+
+func TestClientFlows(t *testing.T) {
+	s, ts, credentials := newClientTest(t)
+	defer ts.Close()
+
+	seeded := s.AddFlow("status", "upstatus", map[string]interface{}{"up": []interface{}{"web"}})
+
+	f, err := gotelemetry.GetFlowLayoutWithTag(credentials, "status")
+
+	if err != nil || f.Id != seeded.ID || f.Variant != "upstatus" {
+		t.Errorf("Unexpected flow %+v (%v)", f, err)
+	}
+
+	f, err = gotelemetry.GetFlowLayout(credentials, seeded.ID)
+
+	if err != nil || f.Tag != "status" {
+		t.Errorf("Unexpected flow %+v (%v)", f, err)
+	}
+
+	if err := f.Read(credentials); err != nil {
+		t.Errorf("Unable to read the data of flow %s: %s", f.Tag, err)
+	}
+
+	if _, err := gotelemetry.GetFlowLayoutWithTag(credentials, "missing"); err == nil {
+		t.Error("Looking up an unknown flow should fail")
+	}
+
+	f, err = gotelemetry.NewFlowWithLayout(credentials, "created", "value", "gotelemetry_agent", "", "")
+
+	if err != nil || f.Tag != "created" {
+		t.Errorf("Unexpected flow %+v (%v)", f, err)
+	}
+
+	if created, ok := s.Flow("created"); !ok || created.Variant != "value" {
+		t.Errorf("The flow should have been created, but found %+v", created)
+	}
+}
+
+func TestClientFlowError(t *testing.T) {
+	s, ts, credentials := newClientTest(t)
+	defer ts.Close()
+
+	s.AddFlow("status", "upstatus", nil)
+
+	if err := gotelemetry.SetFlowError(credentials, "status", map[string]interface{}{"message": "Broken"}); err != nil {
+		t.Fatalf("Unable to set the flow error: %s", err)
+	}
+
+	if f, _ := s.Flow("status"); f.Error == nil {
+		t.Errorf("The flow error should have been recorded")
+	}
+}
+
+func TestClientNotifications(t *testing.T) {
+	s, ts, credentials := newClientTest(t)
+	defer ts.Close()
+
+	s.AddFlow("status", "upstatus", nil)
+
+	n := gotelemetry.NewNotification("Hello", "World", "", 5, "")
+
+	if err := gotelemetry.NewChannel("ops").SendNotification(credentials, n); err != nil {
+		t.Errorf("Unable to send the channel notification: %s", err)
+	}
+
+	if err := gotelemetry.SendFlowChannelNotification(credentials, "status", n); err != nil {
+		t.Errorf("Unable to send the flow notification: %s", err)
+	}
+
+	if state := s.State(); len(state.Notifications) != 2 || state.Notifications[0].Channel != "ops" || state.Notifications[1].Flow != "status" {
+		t.Errorf("The notifications should have been recorded, but found %+v", state.Notifications)
+	}
+}
+
+func TestClientBoardImport(t *testing.T) {
+	s, ts, credentials := newClientTest(t)
+	defer ts.Close()
+
+	b, err := gotelemetry.ImportBoard(credentials, "Operations", "ops_", &gotelemetry.ExportedBoard{})
+
+	if err != nil || b.Name != "Operations" {
+		t.Fatalf("Unexpected board %+v (%v)", b, err)
+	}
+
+	again, err := gotelemetry.ImportBoard(credentials, "Operations", "ops_", &gotelemetry.ExportedBoard{})
+
+	if err != nil || again.Id != b.Id || len(s.State().Boards) != 1 {
+		t.Errorf("Importing a board twice should return the existing board, but returned %+v (%v)", again, err)
+	}
+}
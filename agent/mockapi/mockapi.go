@@ -0,0 +1,655 @@
+// Package mockapi implements an in-memory stand-in for the parts of the Telemetry API used
+// by the agent: batch data updates, flows, boards, channel notifications and flow errors.
+//
+// The server can be started with the `mock-api` command and targeted with `--apiurl`, or
+// embedded in Go tests through httptest:
+//
+//	s := mockapi.NewServer("")
+//	ts := httptest.NewServer(s)
+//	defer ts.Close()
+//
+// Flows that receive data without having been created first are created on the fly, so
+// that jobs can be exercised without seeding the server. The full state, including a log
+// of the requests received, is available at /_mock/state and through State(); a DELETE
+// request to the same endpoint resets it.
+package mockapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Flow is the state of a flow as stored by the server
+type Flow struct {
+	ID        string                 `json:"id"`
+	Tag       string                 `json:"tag"`
+	Variant   string                 `json:"variant,omitempty"`
+	Channel   string                 `json:"channel,omitempty"`
+	Data      map[string]interface{} `json:"data"`
+	Error     interface{}            `json:"error,omitempty"`
+	Updates   int                    `json:"updates"`
+	UpdatedAt time.Time              `json:"updated_at"`
+}
+
+// Board is a board created or imported through the API
+type Board struct {
+	ID       string      `json:"id"`
+	Name     string      `json:"name"`
+	Prefix   string      `json:"prefix,omitempty"`
+	Template interface{} `json:"template,omitempty"`
+}
+
+// Notification is a channel notification received by the server
+type Notification struct {
+	Channel string                 `json:"channel,omitempty"`
+	Flow    string                 `json:"flow,omitempty"`
+	Payload map[string]interface{} `json:"payload"`
+	SentAt  time.Time              `json:"sent_at"`
+}
+
+// Request is an entry in the server's request log
+type Request struct {
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	Status int       `json:"status"`
+	Time   time.Time `json:"time"`
+}
+
+// State is a snapshot of everything the server has received
+type State struct {
+	Flows         map[string]*Flow  `json:"flows"`
+	Boards        map[string]*Board `json:"boards"`
+	Notifications []Notification    `json:"notifications"`
+	Requests      []Request         `json:"requests"`
+}
+
+// Server is an http.Handler that emulates the Telemetry API
+type Server struct {
+	token  string
+	mutex  sync.Mutex
+	nextID int
+	state  State
+}
+
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func newAPIError(status int, format string, args ...interface{}) error {
+	return &apiError{status: status, message: fmt.Sprintf(format, args...)}
+}
+
+// NewServer creates an empty server. If token is not empty, requests must authenticate with
+// it, either as the basic auth user name (as the agent does) or as a bearer token.
+func NewServer(token string) *Server {
+	result := &Server{token: token}
+	result.Reset()
+
+	return result
+}
+
+// ListenAndServe starts a server on the given address and blocks until it fails
+func ListenAndServe(address, token string) error {
+	return http.ListenAndServe(address, NewServer(token))
+}
+
+func emptyState() State {
+	return State{
+		Flows:         map[string]*Flow{},
+		Boards:        map[string]*Board{},
+		Notifications: []Notification{},
+		Requests:      []Request{},
+	}
+}
+
+// Reset discards all flows, boards, notifications and logged requests
+func (s *Server) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.state = emptyState()
+}
+
+// State returns a deep copy of the server's state
+func (s *Server) State() State {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result := State{}
+
+	data, _ := json.Marshal(s.state)
+	json.Unmarshal(data, &result)
+
+	return result
+}
+
+// Flow returns a copy of the flow with the given tag
+func (s *Server) Flow(tag string) (*Flow, bool) {
+	f, ok := s.State().Flows[tag]
+
+	return f, ok
+}
+
+// AddFlow seeds the server with a flow
+func (s *Server) AddFlow(tag, variant string, data map[string]interface{}) *Flow {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	f := s.createFlow(tag, variant)
+
+	if data != nil {
+		f.Data = data
+	}
+
+	return f
+}
+
+func (s *Server) newID() string {
+	s.nextID++
+
+	return fmt.Sprintf("%024x", s.nextID)
+}
+
+func (s *Server) createFlow(tag, variant string) *Flow {
+	f := &Flow{
+		ID:        s.newID(),
+		Tag:       tag,
+		Variant:   variant,
+		Data:      map[string]interface{}{},
+		UpdatedAt: time.Now(),
+	}
+
+	s.state.Flows[tag] = f
+
+	return f
+}
+
+// findFlow looks up a flow by tag or ID
+func (s *Server) findFlow(key string) (*Flow, bool) {
+	if f, ok := s.state.Flows[key]; ok {
+		return f, true
+	}
+
+	for _, f := range s.state.Flows {
+		if f.ID == key {
+			return f, true
+		}
+	}
+
+	return nil, false
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if s.token == "" {
+		return true
+	}
+
+	if user, _, ok := r.BasicAuth(); ok && user == s.token {
+		return true
+	}
+
+	return r.Header.Get("Authorization") == "Bearer "+s.token
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var result interface{}
+	var err error
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.authorized(r) {
+		err = newAPIError(http.StatusUnauthorized, "Invalid API token")
+	} else {
+		result, err = s.route(r)
+	}
+
+	status := http.StatusOK
+
+	if err != nil {
+		status = http.StatusBadRequest
+
+		if e, ok := err.(*apiError); ok {
+			status = e.status
+		}
+
+		result = map[string]interface{}{
+			"code":   status,
+			"errors": []string{err.Error()},
+		}
+	}
+
+	// The response is encoded while the lock is held, since it may reference the state
+	body, _ := json.Marshal(result)
+
+	s.state.Requests = append(s.state.Requests, Request{Method: r.Method, Path: r.URL.Path, Status: status, Time: time.Now()})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func (s *Server) route(r *http.Request) (interface{}, error) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case parts[0] == "_mock" && len(parts) == 2 && parts[1] == "state":
+		return s.handleState(r)
+
+	case parts[0] == "data" && len(parts) == 1:
+		return s.handleBatch(r, "")
+
+	case parts[0] == "channels" && len(parts) == 3 && parts[2] == "data":
+		return s.handleBatch(r, parts[1])
+
+	case parts[0] == "channels" && len(parts) == 3 && parts[2] == "notifications":
+		return s.handleNotification(r, parts[1], "")
+
+	case parts[0] == "flows":
+		return s.routeFlows(r, parts[1:])
+
+	case parts[0] == "boards":
+		return s.routeBoards(r, parts[1:])
+	}
+
+	return nil, newAPIError(http.StatusNotFound, "No route matches %s %s", r.Method, r.URL.Path)
+}
+
+func (s *Server) handleState(r *http.Request) (interface{}, error) {
+	switch r.Method {
+	case "GET":
+		return s.state, nil
+
+	case "DELETE":
+		s.state = emptyState()
+
+		return map[string]interface{}{}, nil
+	}
+
+	return nil, newAPIError(http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+}
+
+func decodeBody(r *http.Request, target interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(target); err != nil {
+		return newAPIError(http.StatusBadRequest, "Invalid JSON payload: %s", err)
+	}
+
+	return nil
+}
+
+func isJSONPatch(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/json-patch+json")
+}
+
+// copyData returns a deep copy of a flow's data
+func copyData(data map[string]interface{}) (map[string]interface{}, error) {
+	result := map[string]interface{}{}
+
+	source, err := json.Marshal(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, json.Unmarshal(source, &result)
+}
+
+// updatedData computes the result of a POST, PATCH or JSON-Patch update to a flow's data,
+// leaving the data itself untouched
+func updatedData(tag string, current map[string]interface{}, method string, jsonPatch bool, data interface{}) (map[string]interface{}, error) {
+	switch {
+	case method == "PATCH" && jsonPatch:
+		ops, ok := data.([]interface{})
+
+		if !ok {
+			return nil, newAPIError(http.StatusBadRequest, "The JSON-Patch update for flow %s is not an array of operations", tag)
+		}
+
+		result, err := applyJSONPatch(current, ops)
+
+		if err != nil {
+			return nil, newAPIError(http.StatusUnprocessableEntity, "Unable to apply JSON-Patch to flow %s: %s", tag, err)
+		}
+
+		return result, nil
+
+	case method == "PATCH":
+		values, ok := data.(map[string]interface{})
+
+		if !ok {
+			return nil, newAPIError(http.StatusBadRequest, "The update for flow %s is not an object", tag)
+		}
+
+		result, err := copyData(current)
+
+		if err != nil {
+			return nil, err
+		}
+
+		mergePatch(result, values)
+
+		return result, nil
+
+	default:
+		values, ok := data.(map[string]interface{})
+
+		if !ok {
+			return nil, newAPIError(http.StatusBadRequest, "The update for flow %s is not an object", tag)
+		}
+
+		return values, nil
+	}
+}
+
+// setData replaces the data of a flow with the result of an update
+func (f *Flow) setData(data map[string]interface{}) {
+	f.Data = data
+	f.Updates++
+	f.UpdatedAt = time.Now()
+}
+
+// handleBatch applies a batch update. Every update is checked before any is applied, so
+// that a batch the API rejects leaves all flows untouched.
+func (s *Server) handleBatch(r *http.Request, channelTag string) (interface{}, error) {
+	if r.Method != "POST" && r.Method != "PATCH" {
+		return nil, newAPIError(http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+	}
+
+	payload := struct {
+		Data map[string]interface{} `json:"data"`
+	}{}
+
+	if err := decodeBody(r, &payload); err != nil {
+		return nil, err
+	}
+
+	if payload.Data == nil {
+		return nil, newAPIError(http.StatusBadRequest, "The batch payload must contain a `data` object")
+	}
+
+	tags := []string{}
+
+	for tag := range payload.Data {
+		tags = append(tags, tag)
+	}
+
+	sort.Strings(tags)
+
+	results := map[string]map[string]interface{}{}
+
+	for _, tag := range tags {
+		// Flows that do not exist yet are created with empty data
+		current := map[string]interface{}{}
+
+		if f, ok := s.findFlow(tag); ok {
+			current = f.Data
+		}
+
+		data, err := updatedData(tag, current, r.Method, isJSONPatch(r), payload.Data[tag])
+
+		if err != nil {
+			return nil, err
+		}
+
+		results[tag] = data
+	}
+
+	for _, tag := range tags {
+		f, ok := s.findFlow(tag)
+
+		if !ok {
+			f = s.createFlow(tag, "")
+		}
+
+		if channelTag != "" {
+			f.Channel = channelTag
+		}
+
+		f.setData(results[tag])
+	}
+
+	return map[string]interface{}{"updated": tags, "skipped": []string{}}, nil
+}
+
+func (s *Server) handleNotification(r *http.Request, channelTag, flowTag string) (interface{}, error) {
+	if r.Method != "POST" {
+		return nil, newAPIError(http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+	}
+
+	payload := map[string]interface{}{}
+
+	if err := decodeBody(r, &payload); err != nil {
+		return nil, err
+	}
+
+	if flowTag != "" {
+		f, ok := s.findFlow(flowTag)
+
+		if !ok {
+			return nil, newAPIError(http.StatusNotFound, "Flow %s not found", flowTag)
+		}
+
+		channelTag = f.Channel
+	}
+
+	s.state.Notifications = append(s.state.Notifications, Notification{
+		Channel: channelTag,
+		Flow:    flowTag,
+		Payload: payload,
+		SentAt:  time.Now(),
+	})
+
+	return payload, nil
+}
+
+func (s *Server) routeFlows(r *http.Request, parts []string) (interface{}, error) {
+	if len(parts) == 0 || parts[0] == "" {
+		switch r.Method {
+		case "GET":
+			result := []*Flow{}
+
+			for _, f := range s.state.Flows {
+				if tag := r.URL.Query().Get("tag"); tag == "" || tag == f.Tag {
+					result = append(result, f)
+				}
+			}
+
+			sort.Sort(flowsByTag(result))
+
+			return result, nil
+
+		case "POST":
+			payload := struct {
+				Tag     string                 `json:"tag"`
+				Variant string                 `json:"variant"`
+				Data    map[string]interface{} `json:"data"`
+			}{}
+
+			if err := decodeBody(r, &payload); err != nil {
+				return nil, err
+			}
+
+			if payload.Tag == "" {
+				return nil, newAPIError(http.StatusBadRequest, "A tag is required to create a flow")
+			}
+
+			if _, ok := s.state.Flows[payload.Tag]; ok {
+				return nil, newAPIError(http.StatusConflict, "Flow %s already exists", payload.Tag)
+			}
+
+			f := s.createFlow(payload.Tag, payload.Variant)
+
+			if payload.Data != nil {
+				f.Data = payload.Data
+			}
+
+			return f, nil
+		}
+
+		return nil, newAPIError(http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+	}
+
+	f, ok := s.findFlow(parts[0])
+
+	if !ok {
+		return nil, newAPIError(http.StatusNotFound, "Flow %s not found", parts[0])
+	}
+
+	if len(parts) == 1 {
+		switch r.Method {
+		case "GET":
+			return f, nil
+
+		case "DELETE":
+			delete(s.state.Flows, f.Tag)
+			return map[string]interface{}{}, nil
+		}
+
+		return nil, newAPIError(http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+	}
+
+	switch parts[1] {
+	case "data":
+		if r.Method == "GET" {
+			return f.Data, nil
+		}
+
+		var data interface{}
+
+		if err := decodeBody(r, &data); err != nil {
+			return nil, err
+		}
+
+		result, err := updatedData(f.Tag, f.Data, r.Method, isJSONPatch(r), data)
+
+		if err != nil {
+			return nil, err
+		}
+
+		f.setData(result)
+
+		return f.Data, nil
+
+	case "error":
+		switch r.Method {
+		case "POST":
+			var body interface{}
+
+			if err := decodeBody(r, &body); err != nil {
+				return nil, err
+			}
+
+			f.Error = body
+
+		case "DELETE":
+			f.Error = nil
+
+		default:
+			return f.Error, nil
+		}
+
+		return map[string]interface{}{}, nil
+
+	case "notifications":
+		return s.handleNotification(r, "", f.Tag)
+	}
+
+	return nil, newAPIError(http.StatusNotFound, "No route matches %s %s", r.Method, r.URL.Path)
+}
+
+func (s *Server) findBoard(key string) (*Board, bool) {
+	for _, b := range s.state.Boards {
+		if b.ID == key || b.Name == key {
+			return b, true
+		}
+	}
+
+	return nil, false
+}
+
+func (s *Server) routeBoards(r *http.Request, parts []string) (interface{}, error) {
+	if len(parts) == 0 || parts[0] == "" {
+		if r.Method != "GET" {
+			return nil, newAPIError(http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+		}
+
+		result := []*Board{}
+
+		for _, b := range s.state.Boards {
+			if name := r.URL.Query().Get("name"); name == "" || name == b.Name {
+				result = append(result, b)
+			}
+		}
+
+		return result, nil
+	}
+
+	if parts[0] == "import" && len(parts) == 1 {
+		if r.Method != "POST" {
+			return nil, newAPIError(http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+		}
+
+		payload := map[string]interface{}{}
+
+		if err := decodeBody(r, &payload); err != nil {
+			return nil, err
+		}
+
+		name, _ := payload["name"].(string)
+		prefix, _ := payload["prefix"].(string)
+
+		if name == "" {
+			return nil, errors.New("A name is required to import a board")
+		}
+
+		// Importing a board that already exists returns the existing board
+		if b, ok := s.findBoard(name); ok {
+			return b, nil
+		}
+
+		b := &Board{
+			ID:       s.newID(),
+			Name:     name,
+			Prefix:   prefix,
+			Template: payload,
+		}
+
+		s.state.Boards[b.ID] = b
+
+		return b, nil
+	}
+
+	b, ok := s.findBoard(parts[0])
+
+	if !ok {
+		return nil, newAPIError(http.StatusNotFound, "Board %s not found", parts[0])
+	}
+
+	switch r.Method {
+	case "GET":
+		return b, nil
+
+	case "DELETE":
+		delete(s.state.Boards, b.ID)
+		return map[string]interface{}{}, nil
+	}
+
+	return nil, newAPIError(http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+}
+
+type flowsByTag []*Flow
+
+func (f flowsByTag) Len() int           { return len(f) }
+func (f flowsByTag) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f flowsByTag) Less(i, j int) bool { return f[i].Tag < f[j].Tag }
@@ -0,0 +1,143 @@
+package mockapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func send(t *testing.T, ts *httptest.Server, method, path, contentType string, body interface{}) int {
+	payload, _ := json.Marshal(body)
+
+	req, err := http.NewRequest(method, ts.URL+path, bytes.NewReader(payload))
+
+	if err != nil {
+		t.Fatalf("Unable to create request: %s", err)
+	}
+
+	req.SetBasicAuth("token", "")
+	req.Header.Set("Content-Type", contentType)
+
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatalf("Request to %s failed: %s", path, err)
+	}
+
+	res.Body.Close()
+
+	return res.StatusCode
+}
+
+func TestBatchUpdates(t *testing.T) {
+	s := NewServer("token")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	send(t, ts, "POST", "/data", "application/json", map[string]interface{}{
+		"data": map[string]interface{}{"value": map[string]interface{}{"value": 1, "label": map[string]interface{}{"text": "A"}}},
+	})
+
+	send(t, ts, "PATCH", "/channels/ops/data", "application/json", map[string]interface{}{
+		"data": map[string]interface{}{"value": map[string]interface{}{"label": map[string]interface{}{"color": "red"}}},
+	})
+
+	f, ok := s.Flow("value")
+
+	if !ok {
+		t.Fatalf("The flow should have been created on the first update")
+	}
+
+	if label := f.Data["label"].(map[string]interface{}); label["text"] != "A" || label["color"] != "red" || f.Channel != "ops" || f.Updates != 2 {
+		t.Errorf("PATCH updates should be merged, but the flow is %+v", f)
+	}
+
+	status := send(t, ts, "PATCH", "/data", "application/json-patch+json", map[string]interface{}{
+		"data": map[string]interface{}{"value": []interface{}{
+			map[string]interface{}{"op": "replace", "path": "/value", "value": 2},
+			map[string]interface{}{"op": "remove", "path": "/label/color"},
+		}},
+	})
+
+	f, _ = s.Flow("value")
+
+	if status != http.StatusOK || f.Data["value"] != 2.0 || len(f.Data["label"].(map[string]interface{})) != 1 {
+		t.Errorf("The JSON-Patch should have been applied, but the flow is %+v", f)
+	}
+
+	status = send(t, ts, "PATCH", "/data", "application/json-patch+json", map[string]interface{}{
+		"data": map[string]interface{}{"value": []interface{}{
+			map[string]interface{}{"op": "replace", "path": "/value", "value": 3},
+			map[string]interface{}{"op": "remove", "path": "/missing"},
+		}},
+	})
+
+	if f, _ = s.Flow("value"); status != http.StatusUnprocessableEntity || f.Data["value"] != 2.0 {
+		t.Errorf("A failed JSON-Patch should leave the flow untouched, but returned %d with %+v", status, f)
+	}
+}
+
+func TestBatchIsAtomic(t *testing.T) {
+	s := NewServer("")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	s.AddFlow("a", "value", map[string]interface{}{"value": 1})
+
+	// The update to `b` is checked after the one to `a`, and is invalid
+	status := send(t, ts, "PATCH", "/data", "application/json", map[string]interface{}{
+		"data": map[string]interface{}{"a": map[string]interface{}{"value": 2}, "b": 12},
+	})
+
+	if f, _ := s.Flow("a"); status != http.StatusBadRequest || f.Data["value"] != 1.0 || f.Updates != 0 {
+		t.Errorf("A rejected batch should leave every flow untouched, but returned %d with %+v", status, f)
+	}
+
+	if _, ok := s.Flow("b"); ok {
+		t.Errorf("A rejected batch should not create flows")
+	}
+}
+
+func TestErrorsAndNotifications(t *testing.T) {
+	s := NewServer("token")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	s.AddFlow("status", "upstatus", nil)
+
+	send(t, ts, "POST", "/flows/status/error", "application/json", map[string]interface{}{"message": "Broken"})
+	send(t, ts, "POST", "/channels/ops/notifications", "application/json", map[string]interface{}{"title": "Hello"})
+
+	if status := send(t, ts, "POST", "/flows/missing/notifications", "application/json", map[string]interface{}{}); status != http.StatusNotFound {
+		t.Errorf("Notifications for unknown flows should fail, but returned %d", status)
+	}
+
+	state := s.State()
+
+	if state.Flows["status"].Error == nil {
+		t.Errorf("The flow error should have been recorded")
+	}
+
+	if len(state.Notifications) != 1 || state.Notifications[0].Channel != "ops" {
+		t.Errorf("The notification should have been recorded, but found %+v", state.Notifications)
+	}
+
+	if len(state.Requests) != 3 {
+		t.Errorf("All requests should have been logged, but found %+v", state.Requests)
+	}
+
+	req, _ := http.NewRequest("GET", ts.URL+"/_mock/state", nil)
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Unauthenticated requests should be rejected, but returned %d", res.StatusCode)
+	}
+}
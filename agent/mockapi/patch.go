@@ -0,0 +1,306 @@
+package mockapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// mergePatch merges a Rails-style PATCH into a flow's data. Objects are merged recursively;
+// every other value, including arrays, replaces the existing one.
+func mergePatch(target, patch map[string]interface{}) {
+	for key, value := range patch {
+		if patchObject, ok := value.(map[string]interface{}); ok {
+			if targetObject, ok := target[key].(map[string]interface{}); ok {
+				mergePatch(targetObject, patchObject)
+				continue
+			}
+		}
+
+		target[key] = value
+	}
+}
+
+func parsePointer(path string) ([]string, error) {
+	if path == "" {
+		return []string{}, nil
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("Invalid JSON pointer `%s`", path)
+	}
+
+	result := strings.Split(path[1:], "/")
+
+	for index, token := range result {
+		result[index] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+
+	return result, nil
+}
+
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if token == "-" && allowEnd {
+		return length, nil
+	}
+
+	index, err := strconv.Atoi(token)
+
+	if err != nil || index < 0 || index > length || (index == length && !allowEnd) {
+		return 0, fmt.Errorf("Invalid array index `%s`", token)
+	}
+
+	return index, nil
+}
+
+func getValue(doc interface{}, tokens []string) (interface{}, error) {
+	for _, token := range tokens {
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			value, ok := d[token]
+
+			if !ok {
+				return nil, fmt.Errorf("Path component `%s` not found", token)
+			}
+
+			doc = value
+
+		case []interface{}:
+			index, err := arrayIndex(token, len(d), false)
+
+			if err != nil {
+				return nil, err
+			}
+
+			doc = d[index]
+
+		default:
+			return nil, fmt.Errorf("Path component `%s` not found", token)
+		}
+	}
+
+	return doc, nil
+}
+
+// setValue adds or replaces the value at the given location and returns the updated
+// document. Arrays are returned as new slices when an element is inserted.
+func setValue(doc interface{}, tokens []string, value interface{}, insert bool) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	token := tokens[0]
+
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		if len(tokens) == 1 {
+			if _, ok := d[token]; !ok && !insert {
+				return nil, fmt.Errorf("Path component `%s` not found", token)
+			}
+
+			d[token] = value
+
+			return d, nil
+		}
+
+		child, ok := d[token]
+
+		if !ok {
+			return nil, fmt.Errorf("Path component `%s` not found", token)
+		}
+
+		child, err := setValue(child, tokens[1:], value, insert)
+
+		if err != nil {
+			return nil, err
+		}
+
+		d[token] = child
+
+		return d, nil
+
+	case []interface{}:
+		index, err := arrayIndex(token, len(d), len(tokens) == 1 && insert)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(tokens) > 1 {
+			child, err := setValue(d[index], tokens[1:], value, insert)
+
+			if err != nil {
+				return nil, err
+			}
+
+			d[index] = child
+
+			return d, nil
+		}
+
+		if !insert {
+			d[index] = value
+			return d, nil
+		}
+
+		result := append([]interface{}{}, d[:index]...)
+		result = append(result, value)
+
+		return append(result, d[index:]...), nil
+	}
+
+	return nil, fmt.Errorf("Path component `%s` not found", token)
+}
+
+func removeValue(doc interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, errors.New("Cannot remove the root of the document")
+	}
+
+	token := tokens[0]
+
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		child, ok := d[token]
+
+		if !ok {
+			return nil, fmt.Errorf("Path component `%s` not found", token)
+		}
+
+		if len(tokens) == 1 {
+			delete(d, token)
+			return d, nil
+		}
+
+		child, err := removeValue(child, tokens[1:])
+
+		if err != nil {
+			return nil, err
+		}
+
+		d[token] = child
+
+		return d, nil
+
+	case []interface{}:
+		index, err := arrayIndex(token, len(d), false)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(tokens) == 1 {
+			return append(append([]interface{}{}, d[:index]...), d[index+1:]...), nil
+		}
+
+		child, err := removeValue(d[index], tokens[1:])
+
+		if err != nil {
+			return nil, err
+		}
+
+		d[index] = child
+
+		return d, nil
+	}
+
+	return nil, fmt.Errorf("Path component `%s` not found", token)
+}
+
+func applyOperation(doc interface{}, op map[string]interface{}) (interface{}, error) {
+	name, _ := op["op"].(string)
+	path, _ := op["path"].(string)
+
+	tokens, err := parsePointer(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch name {
+	case "add":
+		return setValue(doc, tokens, op["value"], true)
+
+	case "replace":
+		return setValue(doc, tokens, op["value"], false)
+
+	case "remove":
+		return removeValue(doc, tokens)
+
+	case "test":
+		value, err := getValue(doc, tokens)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !reflect.DeepEqual(value, op["value"]) {
+			return nil, fmt.Errorf("Test failed for path `%s`", path)
+		}
+
+		return doc, nil
+
+	case "copy", "move":
+		from, _ := op["from"].(string)
+		fromTokens, err := parsePointer(from)
+
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := getValue(doc, fromTokens)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if name == "move" {
+			if doc, err = removeValue(doc, fromTokens); err != nil {
+				return nil, err
+			}
+		}
+
+		return setValue(doc, tokens, value, true)
+	}
+
+	return nil, fmt.Errorf("Unknown JSON-Patch operation `%s`", name)
+}
+
+// applyJSONPatch applies a list of RFC 6902 operations to a copy of the data. The original
+// data is left untouched if any operation fails.
+func applyJSONPatch(data map[string]interface{}, ops []interface{}) (map[string]interface{}, error) {
+	var doc interface{}
+
+	source, err := json.Marshal(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(source, &doc); err != nil {
+		return nil, err
+	}
+
+	for _, o := range ops {
+		op, ok := o.(map[string]interface{})
+
+		if !ok {
+			return nil, errors.New("JSON-Patch operations must be objects")
+		}
+
+		if doc, err = applyOperation(doc, op); err != nil {
+			return nil, err
+		}
+	}
+
+	result, ok := doc.(map[string]interface{})
+
+	if !ok {
+		return nil, errors.New("The patched document is not an object")
+	}
+
+	return result, nil
+}
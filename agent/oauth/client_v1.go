@@ -7,6 +7,7 @@ import (
 	"github.com/garyburd/go-oauth/oauth"
 	"github.com/telemetryapp/gotelemetry_agent/agent/aggregations"
 	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"github.com/telemetryapp/gotelemetry_agent/agent/httpclient"
 	"net/http"
 )
 
@@ -18,8 +19,9 @@ type v1ClientData struct {
 }
 
 type v1Client struct {
-	name string
-	data v1ClientData
+	name       string
+	data       v1ClientData
+	httpClient *http.Client
 }
 
 var _ Client = &v1Client{}
@@ -56,6 +58,12 @@ func getV1Client(name string, entry config.OAuthConfigEntry) (Client, error) {
 		return nil, fmt.Errorf("Invalid oAuth1 signature format %s", entry.SignatureMethod)
 	}
 
+	httpClient, err := httpclient.Get(entry.HTTPProfile)
+
+	if err != nil {
+		return nil, err
+	}
+
 	client := &oauth.Client{
 		Credentials:                   credentials,
 		TemporaryCredentialRequestURI: entry.CredentialsURL,
@@ -71,6 +79,7 @@ func getV1Client(name string, entry config.OAuthConfigEntry) (Client, error) {
 		data: v1ClientData{
 			Client: client,
 		},
+		httpClient: httpClient,
 	}
 
 	aggregations.ReadOAuthToken(res.name, &res.data)
@@ -79,7 +88,7 @@ func getV1Client(name string, entry config.OAuthConfigEntry) (Client, error) {
 }
 
 func (v *v1Client) GetAuthorizationURL() (string, error) {
-	cred, err := v.data.Client.RequestTemporaryCredentials(nil, TelemetryOAuthClientResponseURL, nil)
+	cred, err := v.data.Client.RequestTemporaryCredentials(v.httpClient, TelemetryOAuthClientResponseURL, nil)
 
 	if err != nil {
 		return "", err
@@ -93,7 +102,7 @@ func (v *v1Client) GetAuthorizationURL() (string, error) {
 }
 
 func (v *v1Client) ExchangeToken(code, verifier, realm string) error {
-	cred, _, err := v.data.Client.RequestToken(nil, v.data.TemporaryCredentials, verifier)
+	cred, _, err := v.data.Client.RequestToken(v.httpClient, v.data.TemporaryCredentials, verifier)
 
 	if err != nil {
 		return err
@@ -110,5 +119,5 @@ func (v *v1Client) Do(req *http.Request) (*http.Response, error) {
 		return nil, errors.New("Only GET transactions are supported for oAuth1 clients.")
 	}
 
-	return v.data.Client.Get(nil, v.data.PermanentCredentials, req.URL.String(), req.Form)
+	return v.data.Client.Get(v.httpClient, v.data.PermanentCredentials, req.URL.String(), req.Form)
 }
@@ -1,9 +1,11 @@
 package oauth
 
 import (
+	"context"
 	"errors"
 	"github.com/telemetryapp/gotelemetry_agent/agent/aggregations"
 	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"github.com/telemetryapp/gotelemetry_agent/agent/httpclient"
 	"golang.org/x/oauth2"
 	"net/http"
 )
@@ -12,6 +14,7 @@ type v2Client struct {
 	name string
 	cfg  *oauth2.Config
 	t    *oauth2.Token
+	ctx  context.Context // Carries the client of the entry's HTTP profile
 }
 
 var _ Client = &v2Client{}
@@ -30,13 +33,20 @@ func getV2Client(name string, entry config.OAuthConfigEntry) (Client, error) {
 		RedirectURL:  TelemetryOAuthClientResponseURL,
 	}
 
+	httpClient, err := httpclient.Get(entry.HTTPProfile)
+
+	if err != nil {
+		return nil, err
+	}
+
 	res := &v2Client{
 		name: name,
 		cfg:  cfg,
 		t:    &oauth2.Token{},
+		ctx:  context.WithValue(oauth2.NoContext, oauth2.HTTPClient, httpClient),
 	}
 
-	err := aggregations.ReadOAuthToken(res.name, &res.t)
+	err = aggregations.ReadOAuthToken(res.name, &res.t)
 
 	return res, err
 }
@@ -50,7 +60,7 @@ func (v *v2Client) ExchangeToken(code, verifier, realm string) error {
 		return errors.New("No authorization code found. Please provide one with -c.")
 	}
 
-	token, err := v.cfg.Exchange(oauth2.NoContext, code)
+	token, err := v.cfg.Exchange(v.ctx, code)
 
 	if err == nil {
 		aggregations.WriteOAuthToken(v.name, token)
@@ -61,7 +71,7 @@ func (v *v2Client) ExchangeToken(code, verifier, realm string) error {
 }
 
 func (v *v2Client) Do(req *http.Request) (*http.Response, error) {
-	client := v.cfg.Client(oauth2.NoContext, v.t)
+	client := v.cfg.Client(v.ctx, v.t)
 
 	res, err := client.Do(req)
 
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"github.com/telemetryapp/gotelemetry"
 	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"github.com/telemetryapp/gotelemetry_agent/agent/sink"
 	"strings"
 )
 
@@ -23,7 +24,9 @@ func ProcessPipeRequest(configFile *config.ConfigFile, errorChannel chan error,
 		errorChannel <- gotelemetry.NewDebugError("Will perform a Rails-style HTTP PATCH operation")
 	}
 
-	apiToken, err := configFile.APIToken()
+	updates := map[string]interface{}{}
+
+	err := json.Unmarshal(data, &updates)
 
 	if err != nil {
 		errorChannel <- err
@@ -32,7 +35,13 @@ func ProcessPipeRequest(configFile *config.ConfigFile, errorChannel chan error,
 		return
 	}
 
-	credentials, err := gotelemetry.NewCredentials(apiToken, configFile.APIURL())
+	sinkNames := config.CLIConfig.Sinks
+
+	if len(sinkNames) == 0 {
+		sinkNames = configFile.SinksForChannel(configFile.ChannelTag())
+	}
+
+	registry, err := sink.NewRegistry(configFile.SinkConfig(), errorChannel)
 
 	if err != nil {
 		errorChannel <- err
@@ -41,13 +50,11 @@ func ProcessPipeRequest(configFile *config.ConfigFile, errorChannel chan error,
 		return
 	}
 
-	credentials.SetDebugChannel(errorChannel)
-
-	updates := map[string]interface{}{}
-
-	err = json.Unmarshal(data, &updates)
+	sinks, useAPI, err := registry.Resolve(sinkNames)
 
 	if err != nil {
+		registry.Close()
+
 		errorChannel <- err
 		completionChannel <- true
 
@@ -58,15 +65,40 @@ func ProcessPipeRequest(configFile *config.ConfigFile, errorChannel chan error,
 
 	for tag, update := range updates {
 		b.SetData(tag, update)
-	}
 
-	err = b.Publish(credentials, configFile.ChannelTag(), submissionType)
+		if err := sink.WriteAll(sinks, sink.NewUpdate("", configFile.ChannelTag(), tag, update, submissionType)); err != nil {
+			errorChannel <- err
+		}
+	}
 
-	if err != nil {
-		errorChannel <- err
+	if useAPI {
+		if err := publishPipeRequest(configFile, errorChannel, b, submissionType); err != nil {
+			errorChannel <- err
+		}
 	}
 
+	// Wait for the sinks to deliver the updates before exiting
+	registry.Close()
+
 	errorChannel <- gotelemetry.NewLogError("Processing complete. Exiting.")
 
 	completionChannel <- true
 }
+
+func publishPipeRequest(configFile *config.ConfigFile, errorChannel chan error, b gotelemetry.Batch, submissionType gotelemetry.BatchType) error {
+	apiToken, err := configFile.APIToken()
+
+	if err != nil {
+		return err
+	}
+
+	credentials, err := gotelemetry.NewCredentials(apiToken, configFile.APIURL())
+
+	if err != nil {
+		return err
+	}
+
+	credentials.SetDebugChannel(errorChannel)
+
+	return b.Publish(credentials, configFile.ChannelTag(), submissionType)
+}
@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/telemetryapp/gotelemetry"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"github.com/telemetryapp/gotelemetry_agent/agent/job"
+	"github.com/telemetryapp/gotelemetry_agent/agent/sink"
+	"io"
+	"net/http"
+)
+
+type receiver struct {
+	configFile   config.ConfigInterface
+	manager      *job.JobManager
+	errorChannel chan error
+}
+
+// StartReceiver accepts updates forwarded by other agents through an `agent` sink. Updates
+// are posted as lines of JSON and delivered to the sinks configured for their channel, which
+// by default means the Telemetry API. Updates bound for the API are queued by the job
+// manager, just like those produced by the agent's own jobs.
+func StartReceiver(configFile config.ConfigInterface, manager *job.JobManager, errorChannel chan error) error {
+	cfg := configFile.ReceiverConfig()
+
+	if cfg.Listen == "" {
+		return nil
+	}
+
+	r := &receiver{
+		configFile:   configFile,
+		manager:      manager,
+		errorChannel: errorChannel,
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/updates", r)
+
+	go func() {
+		errorChannel <- gotelemetry.NewLogError("Receiver -> Listening for updates from other agents on %s", cfg.Listen)
+
+		if err := http.ListenAndServe(cfg.Listen, mux); err != nil {
+			errorChannel <- fmt.Errorf("Receiver -> %s", err)
+		}
+	}()
+
+	return nil
+}
+
+func (r *receiver) publish(u sink.Update) error {
+	updateType, err := sink.ParseType(u.Type)
+
+	if err != nil {
+		return err
+	}
+
+	sinks, useAPI, err := r.manager.Sinks().Resolve(r.configFile.SinksForChannel(u.Channel))
+
+	if err != nil {
+		return err
+	}
+
+	if err := sink.WriteAll(sinks, u); err != nil {
+		return err
+	}
+
+	if !useAPI {
+		return nil
+	}
+
+	return r.manager.QueueDataUpdate(u.Channel, u.Tag, u.Data, updateType)
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Only POST requests are accepted", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := r.configFile.ReceiverConfig().Token
+
+	if token != "" && req.Header.Get("Authorization") != "Bearer "+token {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	decoder := json.NewDecoder(req.Body)
+
+	for {
+		u := sink.Update{}
+
+		if err := decoder.Decode(&u); err == io.EOF {
+			break
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		r.errorChannel <- gotelemetry.NewDebugError("Receiver -> Update for flow %s received from job %s", u.Tag, u.Job)
+
+		if err := r.publish(u); err != nil {
+			r.errorChannel <- fmt.Errorf("Receiver -> %s", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,270 @@
+// Package record captures the inputs of a job run so that it can be replayed later.
+//
+// When the agent runs with `--record dir/`, each run of a process job is recorded to its
+// own file in that directory. The recording contains the script and its arguments, every
+// HTTP response, SQL and MongoDB result set and notification outcome the script received,
+// and the output of `exec` and `url` jobs. The `replay` command runs the script again,
+// serving each call from the recording instead of the network.
+//
+// Results are recorded as JSON. While recording, the script receives the original values;
+// a replayed run receives their JSON form, which callers convert as they see fit.
+package record
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Event is a single call captured during a run
+type Event struct {
+	Kind   string          `json:"kind"`
+	Key    string          `json:"key"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// Recording holds everything needed to replay a run
+type Recording struct {
+	Job    string                 `json:"job"`
+	Time   time.Time              `json:"time"`
+	Script string                 `json:"script,omitempty"`
+	Source string                 `json:"source,omitempty"`
+	Args   map[string]interface{} `json:"args,omitempty"`
+
+	// The Lua options of the job, so that the script is replayed as it ran
+	LuaPath []string `json:"lua_path,omitempty"`
+	Sandbox string   `json:"sandbox,omitempty"`
+	Modules []string `json:"modules,omitempty"`
+
+	Events []Event `json:"events"`
+	Output string  `json:"output"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// Tape records calls, or serves them back from a recording. All methods can be called on a
+// nil tape, in which case calls are simply performed.
+type Tape struct {
+	recording *Recording
+	replaying bool
+	queues    map[string][]Event
+	mutex     sync.Mutex
+}
+
+var fileNameRegex = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+func queueKey(kind, key string) string {
+	return kind + "\x00" + key
+}
+
+// NewRecorder creates a tape that records the calls made by a run of the given job
+func NewRecorder(job string) *Tape {
+	return &Tape{
+		recording: &Recording{
+			Job:    job,
+			Time:   time.Now(),
+			Events: []Event{},
+		},
+	}
+}
+
+// NewPlayer creates a tape that serves calls from a recording. Calls with the same kind
+// and key are served in the order in which they were recorded.
+func NewPlayer(r *Recording) *Tape {
+	result := &Tape{
+		recording: r,
+		replaying: true,
+		queues:    map[string][]Event{},
+	}
+
+	for _, e := range r.Events {
+		k := queueKey(e.Kind, e.Key)
+		result.queues[k] = append(result.queues[k], e)
+	}
+
+	return result
+}
+
+// Load reads a recording from disk
+func Load(path string) (*Recording, error) {
+	source, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Recording{}
+
+	if err := json.Unmarshal(source, result); err != nil {
+		return nil, fmt.Errorf("Unable to parse recording %s: %s", path, err)
+	}
+
+	return result, nil
+}
+
+// Replaying returns true if calls are served from a recording
+func (t *Tape) Replaying() bool {
+	return t != nil && t.replaying
+}
+
+// Recording returns the recording behind the tape
+func (t *Tape) Recording() *Recording {
+	if t == nil {
+		return nil
+	}
+
+	return t.recording
+}
+
+// SetScript records the script that is about to run
+func (t *Tape) SetScript(path, source string, args map[string]interface{}) {
+	if t == nil || t.replaying {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.recording.Script = path
+	t.recording.Source = source
+	t.recording.Args = args
+}
+
+// SetLuaOptions records the sandbox profile, the additional modules and the Lua path with
+// which the script runs
+func (t *Tape) SetLuaOptions(sandbox string, modules, luaPath []string) {
+	if t == nil || t.replaying {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.recording.Sandbox = sandbox
+	t.recording.Modules = modules
+	t.recording.LuaPath = luaPath
+}
+
+// SetOutput records the output of the run
+func (t *Tape) SetOutput(output string, err error) {
+	if t == nil || t.replaying {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.recording.Output = output
+
+	if err != nil {
+		t.recording.Error = err.Error()
+	}
+}
+
+// Do performs a call, identified by its kind and key, through the tape. While recording,
+// the value returned by fn is handed back unchanged and only a JSON copy is recorded.
+func (t *Tape) Do(kind, key string, fn func() (interface{}, error)) (interface{}, error) {
+	if t == nil {
+		return fn()
+	}
+
+	if t.replaying {
+		return t.next(kind, key)
+	}
+
+	value, err := fn()
+
+	e := Event{Kind: kind, Key: key}
+
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	if value != nil {
+		result, marshalErr := json.Marshal(value)
+
+		if marshalErr != nil {
+			return nil, fmt.Errorf("Unable to record the %s result for `%s`: %s", kind, key, marshalErr)
+		}
+
+		e.Result = result
+	}
+
+	t.mutex.Lock()
+	t.recording.Events = append(t.recording.Events, e)
+	t.mutex.Unlock()
+
+	return value, err
+}
+
+// DoString performs a call whose result is a string
+func (t *Tape) DoString(kind, key string, fn func() (string, error)) (string, error) {
+	value, err := t.Do(kind, key, func() (interface{}, error) {
+		return fn()
+	})
+
+	result, _ := value.(string)
+
+	return result, err
+}
+
+func (t *Tape) next(kind, key string) (interface{}, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	k := queueKey(kind, key)
+	queue := t.queues[k]
+
+	if len(queue) == 0 {
+		return nil, fmt.Errorf("No recorded %s result for `%s`", kind, key)
+	}
+
+	e := queue[0]
+	t.queues[k] = queue[1:]
+
+	var value interface{}
+
+	if len(e.Result) > 0 {
+		if err := json.Unmarshal(e.Result, &value); err != nil {
+			return nil, err
+		}
+	}
+
+	if e.Error != "" {
+		return value, errors.New(e.Error)
+	}
+
+	return value, nil
+}
+
+// Save writes the recording to a new file in the given directory and returns its path
+func (t *Tape) Save(dir string) (string, error) {
+	if t == nil || t.replaying {
+		return "", nil
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	data, err := json.MarshalIndent(t.recording, "", "  ")
+
+	if err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("%s-%d.json", fileNameRegex.ReplaceAllString(t.recording.Job, "_"), t.recording.Time.UnixNano())
+	path := filepath.Join(dir, name)
+
+	// Recordings hold the script's arguments, which may include credentials
+	return path, ioutil.WriteFile(path, data, 0600)
+}
@@ -0,0 +1,98 @@
+package record
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent_recordings")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	tape := NewRecorder("job/1")
+	tape.SetScript("test.lua", "output.value = 1", map[string]interface{}{"a": "b"})
+	tape.SetLuaOptions("strict", []string{"mycompany/"}, []string{"/opt/lua"})
+
+	calls := 0
+
+	for _, body := range []string{"first", "second"} {
+		b := body
+
+		tape.DoString("http", "GET http://example.com", func() (string, error) {
+			calls++
+			return b, nil
+		})
+	}
+
+	rows, _ := tape.Do("sql", "SELECT 1", func() (interface{}, error) {
+		return []map[string]interface{}{{"value": 1}}, nil
+	})
+
+	if _, ok := rows.([]map[string]interface{}); !ok {
+		t.Errorf("Recorded results should be returned unchanged, but got %#v", rows)
+	}
+
+	tape.Do("mongo", "broken", func() (interface{}, error) {
+		return nil, errors.New("Connection refused")
+	})
+
+	tape.SetOutput(`{"value":1}`, nil)
+
+	path, err := tape.Save(dir)
+
+	if err != nil {
+		t.Fatalf("Unable to save the recording: %s", err)
+	}
+
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("Recordings should only be readable by their owner, but got %v", info.Mode())
+	}
+
+	r, err := Load(path)
+
+	if err != nil {
+		t.Fatalf("Unable to load the recording: %s", err)
+	}
+
+	player := NewPlayer(r)
+
+	for _, expected := range []string{"first", "second"} {
+		body, err := player.DoString("http", "GET http://example.com", func() (string, error) {
+			calls++
+			return "", nil
+		})
+
+		if err != nil || body != expected {
+			t.Errorf("Expected the recorded body `%s`, got `%s` (%v)", expected, body, err)
+		}
+	}
+
+	if calls != 2 {
+		t.Errorf("Replayed calls should not be performed")
+	}
+
+	if _, err := player.Do("mongo", "broken", nil); err == nil || err.Error() != "Connection refused" {
+		t.Errorf("Recorded errors should be replayed, got %v", err)
+	}
+
+	if _, err := player.Do("http", "GET http://example.com", nil); err == nil {
+		t.Errorf("Calls beyond the recording should fail")
+	}
+
+	if r.Job != "job/1" || r.Source != "output.value = 1" || r.Args["a"] != "b" || r.Output != `{"value":1}` {
+		t.Errorf("Unexpected recording %+v", r)
+	}
+
+	if r.Sandbox != "strict" || len(r.Modules) != 1 || len(r.LuaPath) != 1 || r.LuaPath[0] != "/opt/lua" {
+		t.Errorf("The Lua options should be recorded, but got %+v", r)
+	}
+}
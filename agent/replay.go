@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/telemetryapp/gotelemetry"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"github.com/telemetryapp/gotelemetry_agent/agent/lua"
+	"github.com/telemetryapp/gotelemetry_agent/agent/record"
+)
+
+// replayRecording runs a recorded script again with the Lua options of its job. The job's
+// Lua path is searched before the agent-wide one.
+func replayRecording(r *record.Recording, luaPath []string) (string, error) {
+	tape := record.NewPlayer(r)
+
+	if r.Source == "" {
+		// For `exec` and `url` jobs, the recorded response is the job's output
+
+		if len(r.Events) == 0 {
+			return "", errors.New("The recording contains neither a script nor a process output")
+		}
+
+		return tape.DoString(r.Events[0].Kind, r.Events[0].Key, nil)
+	}
+
+	options := lua.ExecOptions{
+		Tape:    tape,
+		Sandbox: r.Sandbox,
+		Modules: r.Modules,
+		LuaPath: append(append([]string{}, r.LuaPath...), luaPath...),
+		Name:    r.Script,
+		JobID:   r.Job,
+	}
+
+	if options.Sandbox == lua.SandboxStrict {
+		options.Limits = lua.StrictLimits
+	}
+
+	output, err := lua.ExecWithOptions(r.Source, nil, r.Args, options)
+
+	if err != nil {
+		return "", err
+	}
+
+	out, err := json.Marshal(config.MapTemplate(output))
+
+	return string(out), err
+}
+
+func ProcessReplayRequest(configFile *config.ConfigFile, errorChannel chan error, completionChannel chan bool, path string) {
+	errorChannel <- gotelemetry.NewLogError("Replay mode is on.")
+
+	r, err := record.Load(path)
+
+	if err != nil {
+		errorChannel <- err
+		completionChannel <- true
+
+		return
+	}
+
+	errorChannel <- gotelemetry.NewLogError("Replaying job %s, recorded on %s, with %d recorded calls", r.Job, r.Time, len(r.Events))
+
+	output, err := replayRecording(r, configFile.LuaPath())
+
+	if err != nil {
+		if err.Error() == r.Error {
+			errorChannel <- gotelemetry.NewLogError("The replay reproduced the recorded error: %s", err)
+		} else {
+			errorChannel <- fmt.Errorf("Replay failed: %s", err)
+		}
+
+		completionChannel <- true
+
+		return
+	}
+
+	fmt.Println(output)
+
+	if r.Error != "" {
+		errorChannel <- gotelemetry.NewLogError("The replay did not reproduce the recorded error: %s", r.Error)
+	} else if output != r.Output {
+		errorChannel <- gotelemetry.NewLogError("The replayed output differs from the recorded output: %s", r.Output)
+	} else {
+		errorChannel <- gotelemetry.NewLogError("The replayed output matches the recording.")
+	}
+
+	completionChannel <- true
+}
@@ -0,0 +1,43 @@
+package agent
+
+import (
+	"github.com/telemetryapp/gotelemetry_agent/agent/lua"
+	"github.com/telemetryapp/gotelemetry_agent/agent/record"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplayLuaOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent_replay")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "mycompany"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "mycompany", "values.lua"), []byte(`return {value = 1}`), 0644)
+
+	r := &record.Recording{
+		Job:     "job",
+		Source:  `output.value = require("mycompany/values").value; output.sandboxed = io == nil`,
+		LuaPath: []string{dir},
+		Sandbox: lua.SandboxStrict,
+		Modules: []string{"mycompany/"},
+	}
+
+	output, err := replayRecording(r, nil)
+
+	if err != nil || output != `{"sandboxed":true,"value":1}` {
+		t.Errorf("The recording should be replayed with the Lua options of its job, but got %s (%v)", output, err)
+	}
+
+	r.Modules = nil
+
+	if _, err := replayRecording(r, nil); err == nil {
+		t.Error("Modules that the job did not allow should not be available when replaying")
+	}
+}
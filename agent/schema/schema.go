@@ -0,0 +1,244 @@
+// Package schema provides client-side validation of flow payloads. Each flow variant is
+// described by a schema that lists the properties the Telemetry API understands and the
+// type of data they expect, so that malformed payloads can be caught before they are
+// queued for submission.
+//
+// Validation is deliberately lenient: properties that a schema does not describe are
+// accepted as-is, and null values are allowed everywhere except for required properties.
+package schema
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type FieldType int
+
+const (
+	TypeAny FieldType = iota
+	TypeNumber
+	TypeString
+	TypeBoolean
+	TypeArray
+	TypeObject
+)
+
+func (t FieldType) String() string {
+	switch t {
+	case TypeNumber:
+		return "number"
+
+	case TypeString:
+		return "string"
+
+	case TypeBoolean:
+		return "boolean"
+
+	case TypeArray:
+		return "array"
+
+	case TypeObject:
+		return "object"
+
+	default:
+		return "any"
+	}
+}
+
+// Field describes a property of a payload. Items describes the elements of an array, and
+// Fields the properties of an object.
+type Field struct {
+	Type     FieldType
+	Required bool
+	Items    *Field
+	Fields   map[string]*Field
+}
+
+// Schema describes the top-level properties of the payload of a flow variant
+type Schema map[string]*Field
+
+// FieldError reports a problem with a single property of a payload
+type FieldError struct {
+	Path    string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// ValidationErrors collects all the problems found in a payload
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+
+	for index, err := range e {
+		messages[index] = err.Error()
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+// ForVariant returns the schema associated with a flow variant, if one exists
+func ForVariant(variant string) (Schema, bool) {
+	s, ok := variants[variant]
+
+	return s, ok
+}
+
+// Validate checks a payload against the schema of the given variant. Partial payloads,
+// such as those submitted with a PATCH operation, are not required to contain all the
+// required properties. Payloads for variants that have no schema are always valid.
+func Validate(variant string, data map[string]interface{}, partial bool) error {
+	s, ok := ForVariant(variant)
+
+	if !ok {
+		return nil
+	}
+
+	errs := s.Validate(data, partial)
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// Validate checks a payload against the schema. Errors are sorted by path.
+func (s Schema) Validate(data map[string]interface{}, partial bool) ValidationErrors {
+	errs := validateFields(s, data, "", partial)
+
+	sort.Sort(byPath(errs))
+
+	return errs
+}
+
+type byPath ValidationErrors
+
+func (b byPath) Len() int           { return len(b) }
+func (b byPath) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byPath) Less(i, j int) bool { return b[i].Path < b[j].Path }
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+func validateFields(fields map[string]*Field, data map[string]interface{}, path string, partial bool) ValidationErrors {
+	errs := ValidationErrors{}
+
+	for name, field := range fields {
+		value, found := data[name]
+
+		if !found || value == nil {
+			if field.Required && !partial {
+				errs = append(errs, FieldError{joinPath(path, name), "is required"})
+			}
+
+			continue
+		}
+
+		errs = append(errs, validateValue(field, value, joinPath(path, name))...)
+	}
+
+	return errs
+}
+
+func isNumber(value interface{}) bool {
+	switch value.(type) {
+	case float64, float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return true
+
+	default:
+		return false
+	}
+}
+
+func validateValue(field *Field, value interface{}, path string) ValidationErrors {
+	switch field.Type {
+	case TypeNumber:
+		if !isNumber(value) {
+			return ValidationErrors{{path, fmt.Sprintf("must be a number, got %s", describe(value))}}
+		}
+
+	case TypeString:
+		if _, ok := value.(string); !ok {
+			return ValidationErrors{{path, fmt.Sprintf("must be a string, got %s", describe(value))}}
+		}
+
+	case TypeBoolean:
+		if _, ok := value.(bool); !ok {
+			return ValidationErrors{{path, fmt.Sprintf("must be a boolean, got %s", describe(value))}}
+		}
+
+	case TypeArray:
+		items, ok := value.([]interface{})
+
+		if !ok {
+			return ValidationErrors{{path, fmt.Sprintf("must be an array, got %s", describe(value))}}
+		}
+
+		if field.Items == nil {
+			return nil
+		}
+
+		errs := ValidationErrors{}
+
+		for index, item := range items {
+			itemPath := path + "[" + strconv.Itoa(index) + "]"
+
+			if item == nil {
+				if field.Items.Required {
+					errs = append(errs, FieldError{itemPath, "must not be null"})
+				}
+
+				continue
+			}
+
+			errs = append(errs, validateValue(field.Items, item, itemPath)...)
+		}
+
+		return errs
+
+	case TypeObject:
+		object, ok := value.(map[string]interface{})
+
+		if !ok {
+			return ValidationErrors{{path, fmt.Sprintf("must be an object, got %s", describe(value))}}
+		}
+
+		return validateFields(field.Fields, object, path, false)
+	}
+
+	return nil
+}
+
+func describe(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return fmt.Sprintf("string %q", value)
+
+	case bool:
+		return "boolean"
+
+	case []interface{}:
+		return "array"
+
+	case map[string]interface{}:
+		return "object"
+
+	default:
+		if isNumber(value) {
+			return "number"
+		}
+
+		return fmt.Sprintf("%T", value)
+	}
+}
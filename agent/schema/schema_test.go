@@ -0,0 +1,58 @@
+package schema
+
+import (
+	"testing"
+)
+
+type validationTest struct {
+	name    string
+	variant string
+	data    map[string]interface{}
+	partial bool
+	errors  []string
+}
+
+func TestValidate(t *testing.T) {
+	tests := []validationTest{
+		{"Valid value", "value", map[string]interface{}{"value": 12.0, "label": "Test"}, false, nil},
+		{"Numeric string", "value", map[string]interface{}{"value": "12"}, false, []string{`value: must be a number, got string "12"`}},
+		{"Missing required property", "value", map[string]interface{}{"label": "Test"}, false, []string{"value: is required"}},
+		{"Missing required property in patch", "value", map[string]interface{}{"label": "Test"}, true, nil},
+		{"Wrong type", "value", map[string]interface{}{"value": "abc", "label": 1.0}, false, []string{"label: must be a string, got number", `value: must be a number, got string "abc"`}},
+		{"Nested error", "graph", map[string]interface{}{"series": []interface{}{map[string]interface{}{"values": []interface{}{1.0, "x"}}}}, false, []string{`series[0].values[1]: must be a number, got string "x"`}},
+		{"Nested required property in patch", "graph", map[string]interface{}{"series": []interface{}{map[string]interface{}{"label": "a"}}}, true, []string{"series[0].values: is required"}},
+		{"Table", "table", map[string]interface{}{"cells": []interface{}{[]interface{}{"a", 1.0}}, "headers": []interface{}{"A", "B"}}, false, nil},
+		{"Unknown property", "text", map[string]interface{}{"text": "Hello", "whatever": true}, false, nil},
+		{"Unknown variant", "nonexistent", map[string]interface{}{"value": "abc"}, false, nil},
+	}
+
+	for _, tt := range tests {
+		err := Validate(tt.variant, tt.data, tt.partial)
+
+		if tt.errors == nil {
+			if err != nil {
+				t.Errorf("Test %s should not return an error, but returned `%s`.", tt.name, err)
+			}
+
+			continue
+		}
+
+		errs, ok := err.(ValidationErrors)
+
+		if !ok {
+			t.Errorf("Test %s should return validation errors, but returned `%#v`.", tt.name, err)
+			continue
+		}
+
+		if len(errs) != len(tt.errors) {
+			t.Errorf("Test %s should return %d errors, but returned `%s`.", tt.name, len(tt.errors), err)
+			continue
+		}
+
+		for index, e := range errs {
+			if e.Error() != tt.errors[index] {
+				t.Errorf("Test %s: expected error `%s`, but got `%s` instead.", tt.name, tt.errors[index], e)
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package schema
+
+func number() *Field            { return &Field{Type: TypeNumber} }
+func str() *Field               { return &Field{Type: TypeString} }
+func boolean() *Field           { return &Field{Type: TypeBoolean} }
+func array(items *Field) *Field { return &Field{Type: TypeArray, Items: items} }
+
+func object(fields map[string]*Field) *Field {
+	return &Field{Type: TypeObject, Fields: fields}
+}
+
+func required(f *Field) *Field {
+	f.Required = true
+	return f
+}
+
+// variants maps each flow variant to the schema of its payload
+var variants = map[string]Schema{
+	"value": {
+		"value":      required(number()),
+		"label":      str(),
+		"value_type": str(),
+		"delta":      number(),
+		"delta_type": str(),
+		"color":      str(),
+		"icon":       str(),
+		"sparkline":  array(number()),
+	},
+
+	"gauge": {
+		"value":       required(number()),
+		"value_type":  str(),
+		"value_color": str(),
+		"max":         number(),
+		"range":       array(number()),
+	},
+
+	"graph": {
+		"series": required(array(object(map[string]*Field{
+			"values": required(array(number())),
+			"label":  str(),
+			"color":  str(),
+		}))),
+		"renderer": str(),
+		"min":      number(),
+		"max":      number(),
+		"x_labels": array(str()),
+		"y_labels": array(str()),
+	},
+
+	"table": {
+		"cells":    required(array(array(nil))),
+		"headers":  array(str()),
+		"colors":   array(array(str())),
+		"sortable": boolean(),
+	},
+
+	"text": {
+		"text":      required(str()),
+		"alignment": str(),
+	},
+
+	"barchart": {
+		"bars": required(array(object(map[string]*Field{
+			"value": required(number()),
+			"label": str(),
+			"color": str(),
+		}))),
+	},
+
+	"piechart": {
+		"values": required(array(object(map[string]*Field{
+			"value": required(number()),
+			"label": str(),
+			"color": str(),
+		}))),
+	},
+
+	"multivalue": {
+		"values": required(array(object(map[string]*Field{
+			"value":      required(number()),
+			"label":      str(),
+			"value_type": str(),
+			"color":      str(),
+		}))),
+	},
+
+	"tickertape": {
+		"values": required(array(str())),
+	},
+
+	"log": {
+		"messages": required(array(object(map[string]*Field{
+			"text":      required(str()),
+			"timestamp": number(),
+			"color":     str(),
+		}))),
+	},
+
+	"upstatus": {
+		"up":   array(str()),
+		"down": array(str()),
+	},
+}
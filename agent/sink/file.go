@@ -0,0 +1,58 @@
+package sink
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"io"
+	"os"
+	"sync"
+)
+
+// streamSink writes each update as a line of JSON (NDJSON)
+type streamSink struct {
+	w      io.Writer
+	closer io.Closer
+	mutex  sync.Mutex
+}
+
+func newFileSink(name string, cfg config.SinkConfig, errorChannel chan error) (Sink, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("The `path` property is required for file sinks")
+	}
+
+	f, err := os.OpenFile(cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamSink{w: f, closer: f}, nil
+}
+
+func newStdoutSink(name string, cfg config.SinkConfig, errorChannel chan error) (Sink, error) {
+	return &streamSink{w: os.Stdout}, nil
+}
+
+func (s *streamSink) Write(u Update) error {
+	line, err := json.Marshal(u)
+
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err = s.w.Write(append(line, '\n'))
+
+	return err
+}
+
+func (s *streamSink) Close() error {
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,172 @@
+// Package sink provides destinations for flow updates other than the Telemetry API. A sink
+// can archive every update to a file, print it, post it to a webhook, or forward it to
+// another agent. Sinks are declared in the `sinks` section of the configuration file and
+// selected by name, either for the whole agent, for a channel, or for a single job.
+//
+// The name `api` is reserved and refers to the Telemetry API itself, which is handled
+// by the job manager rather than by this package.
+package sink
+
+import (
+	"errors"
+	"fmt"
+	"github.com/telemetryapp/gotelemetry"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"strings"
+	"time"
+)
+
+// API is the name of the sink that represents the Telemetry API
+const API = "api"
+
+// Update is a flow update as it is delivered to a sink
+type Update struct {
+	Job       string      `json:"job,omitempty"`
+	Channel   string      `json:"channel,omitempty"`
+	Tag       string      `json:"tag"`
+	Type      string      `json:"type"`
+	Data      interface{} `json:"data"`
+	Timestamp int64       `json:"ts"`
+}
+
+// Sink receives flow updates
+type Sink interface {
+	Write(u Update) error
+	Close() error
+}
+
+type factory func(name string, cfg config.SinkConfig, errorChannel chan error) (Sink, error)
+
+var factories = map[string]factory{
+	"file":    newFileSink,
+	"stdout":  newStdoutSink,
+	"webhook": newWebhookSink,
+	"agent":   newAgentSink,
+}
+
+// NewUpdate creates an update for the given flow
+func NewUpdate(job, channelTag, tag string, data interface{}, updateType gotelemetry.BatchType) Update {
+	return Update{
+		Job:       job,
+		Channel:   channelTag,
+		Tag:       tag,
+		Type:      TypeName(updateType),
+		Data:      data,
+		Timestamp: time.Now().Unix(),
+	}
+}
+
+// TypeName returns the name under which an update type is recorded by sinks
+func TypeName(t gotelemetry.BatchType) string {
+	switch t {
+	case gotelemetry.BatchTypePOST:
+		return "post"
+
+	case gotelemetry.BatchTypeJSONPATCH:
+		return "jsonpatch"
+
+	default:
+		return "patch"
+	}
+}
+
+// ParseType converts the name of an update type back into a batch type
+func ParseType(name string) (gotelemetry.BatchType, error) {
+	switch strings.ToLower(name) {
+	case "post":
+		return gotelemetry.BatchTypePOST, nil
+
+	case "jsonpatch":
+		return gotelemetry.BatchTypeJSONPATCH, nil
+
+	case "patch", "":
+		return gotelemetry.BatchTypePATCH, nil
+
+	default:
+		return gotelemetry.BatchTypePATCH, fmt.Errorf("Unknown update type `%s`", name)
+	}
+}
+
+// Registry holds the sinks declared in the configuration file
+type Registry struct {
+	sinks map[string]Sink
+}
+
+// NewRegistry creates all the sinks declared in the configuration. Sinks that deliver updates
+// in the background report their errors to errorChannel.
+func NewRegistry(cfg map[string]config.SinkConfig, errorChannel chan error) (*Registry, error) {
+	result := &Registry{
+		sinks: map[string]Sink{},
+	}
+
+	for name, sinkConfig := range cfg {
+		if name == API {
+			return nil, errors.New("The sink name `api` is reserved for the Telemetry API")
+		}
+
+		f, ok := factories[sinkConfig.Type]
+
+		if !ok {
+			return nil, fmt.Errorf("Sink `%s` has an unknown type `%s`", name, sinkConfig.Type)
+		}
+
+		s, err := f(name, sinkConfig, errorChannel)
+
+		if err != nil {
+			result.Close()
+			return nil, fmt.Errorf("Unable to create sink `%s`: %s", name, err)
+		}
+
+		result.sinks[name] = s
+	}
+
+	return result, nil
+}
+
+// Resolve converts a list of sink names into sinks. The second return value indicates
+// whether the Telemetry API was among the names. An empty list selects the API only.
+func (r *Registry) Resolve(names []string) ([]Sink, bool, error) {
+	if len(names) == 0 {
+		return []Sink{}, true, nil
+	}
+
+	result := []Sink{}
+	useAPI := false
+
+	for _, name := range names {
+		if name == API {
+			useAPI = true
+			continue
+		}
+
+		s, ok := r.sinks[name]
+
+		if !ok {
+			return nil, false, fmt.Errorf("Sink `%s` not found", name)
+		}
+
+		result = append(result, s)
+	}
+
+	return result, useAPI, nil
+}
+
+// Close closes all the sinks
+func (r *Registry) Close() {
+	for _, s := range r.sinks {
+		s.Close()
+	}
+}
+
+// WriteAll delivers an update to each of the given sinks, returning the first error encountered
+func WriteAll(sinks []Sink, u Update) error {
+	var result error
+
+	for _, s := range sinks {
+		if err := s.Write(u); err != nil && result == nil {
+			result = err
+		}
+	}
+
+	return result
+}
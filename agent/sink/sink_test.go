@@ -0,0 +1,119 @@
+package sink
+
+import (
+	"encoding/json"
+	"github.com/telemetryapp/gotelemetry"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResolve(t *testing.T) {
+	r, err := NewRegistry(map[string]config.SinkConfig{"out": {Type: "stdout"}}, nil)
+
+	if err != nil {
+		t.Fatalf("Unable to create the registry: %s", err)
+	}
+
+	if sinks, useAPI, err := r.Resolve(nil); err != nil || !useAPI || len(sinks) != 0 {
+		t.Errorf("An empty list should select the API only")
+	}
+
+	if sinks, useAPI, err := r.Resolve([]string{"out"}); err != nil || useAPI || len(sinks) != 1 {
+		t.Errorf("A list without `api` should not select the API")
+	}
+
+	if _, _, err := r.Resolve([]string{"api", "missing"}); err == nil {
+		t.Errorf("Unknown sinks should cause an error")
+	}
+
+	if _, err := NewRegistry(map[string]config.SinkConfig{"api": {Type: "stdout"}}, nil); err == nil {
+		t.Errorf("The `api` name should be reserved")
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent_sink")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "archive.ndjson")
+
+	r, err := NewRegistry(map[string]config.SinkConfig{"archive": {Type: "file", Path: path}}, nil)
+
+	if err != nil {
+		t.Fatalf("Unable to create the registry: %s", err)
+	}
+
+	sinks, _, _ := r.Resolve([]string{"archive"})
+
+	WriteAll(sinks, NewUpdate("job", "", "flow", map[string]interface{}{"value": 1}, gotelemetry.BatchTypePOST))
+	r.Close()
+
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		t.Fatalf("Unable to read the archive: %s", err)
+	}
+
+	u := Update{}
+
+	if err := json.Unmarshal(data, &u); err != nil || u.Tag != "flow" || u.Type != "post" || u.Job != "job" {
+		t.Errorf("Unexpected archived update %s", data)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	release := make(chan bool)
+	received := make(chan Update, 2)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+
+		u := Update{}
+		json.NewDecoder(req.Body).Decode(&u)
+		received <- u
+	}))
+
+	defer ts.Close()
+
+	r, err := NewRegistry(map[string]config.SinkConfig{"hook": {Type: "webhook", URL: ts.URL}}, nil)
+
+	if err != nil {
+		t.Fatalf("Unable to create the registry: %s", err)
+	}
+
+	sinks, _, _ := r.Resolve([]string{"hook"})
+	start := time.Now()
+
+	for _, tag := range []string{"a", "b"} {
+		if err := WriteAll(sinks, NewUpdate("job", "", tag, map[string]interface{}{"value": 1}, gotelemetry.BatchTypePATCH)); err != nil {
+			t.Errorf("Unable to queue an update: %s", err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Writing to a webhook should not wait for it to respond, but took %s", elapsed)
+	}
+
+	close(release)
+	r.Close()
+
+	// Closing the sink waits for the queued updates to be delivered, in order
+	if len(received) != 2 || (<-received).Tag != "a" || (<-received).Tag != "b" {
+		t.Errorf("The queued updates should have been delivered in order")
+	}
+
+	if err := sinks[0].Write(NewUpdate("job", "", "c", nil, gotelemetry.BatchTypePATCH)); err == nil {
+		t.Error("A closed sink should not accept updates")
+	}
+}
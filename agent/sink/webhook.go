@@ -0,0 +1,175 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWebhookTimeout = 10 * time.Second
+	webhookQueueSize      = 1000
+)
+
+// webhookSink posts each update to a URL. Agent sinks are webhooks that target the
+// receiver of another agent.
+//
+// Updates are posted in the background, in the order in which they are written, so that a
+// slow endpoint does not hold up the jobs that produce them. Should the endpoint fall too far
+// behind, new updates are dropped until it catches up.
+type webhookSink struct {
+	name         string
+	url          string
+	contentType  string
+	headers      map[string]string
+	client       *http.Client
+	queue        chan Update
+	errorChannel chan error
+	mutex        sync.RWMutex
+	closed       bool
+	done         chan bool
+}
+
+func newWebhook(name string, cfg config.SinkConfig, contentType string, errorChannel chan error) (*webhookSink, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("The `url` property is required for " + cfg.Type + " sinks")
+	}
+
+	timeout := defaultWebhookTimeout
+
+	if cfg.Timeout != "" {
+		t, err := config.ParseTimeInterval(cfg.Timeout)
+
+		if err != nil {
+			return nil, err
+		}
+
+		timeout = t
+	}
+
+	headers := map[string]string{}
+
+	for key, value := range cfg.Headers {
+		headers[key] = value
+	}
+
+	result := &webhookSink{
+		name:         name,
+		url:          cfg.URL,
+		contentType:  contentType,
+		headers:      headers,
+		client:       &http.Client{Timeout: timeout},
+		queue:        make(chan Update, webhookQueueSize),
+		errorChannel: errorChannel,
+		done:         make(chan bool),
+	}
+
+	go result.run()
+
+	return result, nil
+}
+
+func newWebhookSink(name string, cfg config.SinkConfig, errorChannel chan error) (Sink, error) {
+	return newWebhook(name, cfg, "application/json", errorChannel)
+}
+
+func newAgentSink(name string, cfg config.SinkConfig, errorChannel chan error) (Sink, error) {
+	s, err := newWebhook(name, cfg, "application/x-ndjson", errorChannel)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Token != "" {
+		s.headers["Authorization"] = "Bearer " + cfg.Token
+	}
+
+	return s, nil
+}
+
+// Write queues an update for delivery. It only fails if the queue is full.
+func (s *webhookSink) Write(u Update) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.closed {
+		return fmt.Errorf("Sink %s is closed; the update to flow %s has been dropped", s.name, u.Tag)
+	}
+
+	select {
+	case s.queue <- u:
+		return nil
+
+	default:
+		return fmt.Errorf("Sink %s is falling behind; the update to flow %s has been dropped", s.name, u.Tag)
+	}
+}
+
+func (s *webhookSink) run() {
+	defer close(s.done)
+
+	for u := range s.queue {
+		if err := s.post(u); err != nil && s.errorChannel != nil {
+			s.errorChannel <- fmt.Errorf("Sink %s -> Unable to deliver the update to flow %s: %s", s.name, u.Tag, err)
+		}
+	}
+}
+
+func (s *webhookSink) post(u Update) error {
+	body, err := json.Marshal(u)
+
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", s.contentType)
+
+	for key, value := range s.headers {
+		req.Header.Set(key, value)
+	}
+
+	res, err := s.client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode > 399 {
+		return fmt.Errorf("Sink %s responded with status %d", s.url, res.StatusCode)
+	}
+
+	return nil
+}
+
+// Close waits for the updates already queued to be delivered
+func (s *webhookSink) Close() error {
+	s.mutex.Lock()
+
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+
+	s.mutex.Unlock()
+
+	<-s.done
+
+	return nil
+}
@@ -0,0 +1,666 @@
+// Package spool provides a durable, disk-backed queue that sits between jobs and the
+// Telemetry API. Updates are written to a Bolt database as soon as they are queued and
+// are only removed once the API has accepted them, so that they survive API outages
+// and agent restarts.
+//
+// While updates wait in the spool, successive Rails-style PATCH updates to the same flow
+// are coalesced into a single update, and POST updates supersede any update to the same
+// flow that is still pending.
+//
+// Updates that the API rejects outright, for example because they fail validation, are
+// discarded and reported rather than retried, so that they do not hold up the updates
+// queued after them.
+package spool
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/telemetryapp/gotelemetry"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DropPolicy determines which update is discarded when the spool is full
+type DropPolicy string
+
+const (
+	DropOldest DropPolicy = "oldest"
+	DropNewest DropPolicy = "newest"
+)
+
+const (
+	bucketName   = "_spool"
+	maxBatchSize = 100
+	maxBackoff   = time.Minute
+)
+
+// ErrFull is returned by Enqueue when the spool is full and the new update is the one discarded:
+// either the drop policy says so, or every other update is being submitted
+var ErrFull = errors.New("The spool is full")
+
+// Stats describes the backlog of the spool. It is served as JSON at the address given by the
+// `spool.stats_listen` setting.
+type Stats struct {
+	Pending   int       `json:"pending"`   // The number of updates waiting to be submitted
+	Oldest    time.Time `json:"oldest"`    // When the oldest pending update was queued
+	Coalesced uint64    `json:"coalesced"` // The number of updates merged into, or superseding, a pending update
+	Dropped   uint64    `json:"dropped"`   // The number of updates discarded because the spool was full
+	Submitted uint64    `json:"submitted"` // The number of updates accepted by the API
+	Rejected  uint64    `json:"rejected"`  // The number of updates the API refused, which were discarded
+	Failed    uint64    `json:"failed"`    // The number of failed submission attempts
+}
+
+type entry struct {
+	Channel  string                `json:"channel"`
+	Tag      string                `json:"tag"`
+	Type     gotelemetry.BatchType `json:"type"`
+	Data     interface{}           `json:"data"`
+	QueuedAt int64                 `json:"queued_at"`
+}
+
+func (e *entry) flowKey() string {
+	return e.Channel + "\x00" + e.Tag
+}
+
+type Spool struct {
+	conn         *bolt.DB
+	credentials  gotelemetry.Credentials
+	interval     time.Duration
+	maxEntries   int
+	dropPolicy   DropPolicy
+	errorChannel chan error
+	mutex        sync.Mutex
+	drainMutex   sync.Mutex
+	pending      map[string][]uint64 // The pending entries of each flow, in order
+	inFlight     map[uint64]bool     // Entries that are being submitted and must not be modified
+	count        int
+	stats        Stats
+	listener     net.Listener
+	publish      func(entries []*entry) error
+	done         chan bool
+}
+
+// Open opens (or creates) the spool described by cfg and starts submitting its contents
+// to the API every interval. Updates left over by a previous run are replayed.
+func Open(cfg config.SpoolConfig, credentials gotelemetry.Credentials, interval time.Duration, errorChannel chan error) (*Spool, error) {
+	if cfg.Path == nil {
+		return nil, errors.New("No `spool.path` property provided.")
+	}
+
+	policy := DropPolicy(cfg.DropPolicy)
+
+	switch policy {
+	case "":
+		policy = DropOldest
+
+	case DropOldest, DropNewest:
+
+	default:
+		return nil, fmt.Errorf("Invalid `spool.drop_policy` value `%s`. Must be either `oldest` or `newest`.", cfg.DropPolicy)
+	}
+
+	if cfg.MaxEntries < 0 {
+		return nil, errors.New("Invalid `spool.max_entries` value.")
+	}
+
+	var listener net.Listener
+
+	if cfg.StatsListen != "" {
+		var err error
+
+		if listener, err = net.Listen("tcp", cfg.StatsListen); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := bolt.Open(*cfg.Path, 0644, &bolt.Options{Timeout: time.Second})
+
+	if err != nil {
+		if listener != nil {
+			listener.Close()
+		}
+
+		return nil, err
+	}
+
+	s := &Spool{
+		conn:         conn,
+		credentials:  credentials,
+		interval:     interval,
+		maxEntries:   cfg.MaxEntries,
+		dropPolicy:   policy,
+		errorChannel: errorChannel,
+		pending:      map[string][]uint64{},
+		inFlight:     map[uint64]bool{},
+		listener:     listener,
+		done:         make(chan bool),
+	}
+
+	s.publish = s.publishBatch
+
+	err = conn.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+
+		if err != nil {
+			return err
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			e := &entry{}
+
+			if err := json.Unmarshal(v, e); err != nil {
+				return err
+			}
+
+			s.pending[e.flowKey()] = append(s.pending[e.flowKey()], binary.BigEndian.Uint64(k))
+			s.count++
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		conn.Close()
+
+		if listener != nil {
+			listener.Close()
+		}
+
+		return nil, err
+	}
+
+	if s.count > 0 {
+		s.Logf("Replaying %d updates left over from a previous run", s.count)
+	}
+
+	if listener != nil {
+		s.Logf("Serving statistics on http://%s/spool", listener.Addr())
+
+		mux := http.NewServeMux()
+		mux.Handle("/spool", s)
+
+		go http.Serve(listener, mux)
+	}
+
+	go s.run()
+
+	return s, nil
+}
+
+// Logf sends a formatted string to the agent's global log. It works like log.Logf
+func (s *Spool) Logf(format string, v ...interface{}) {
+	if s.errorChannel != nil {
+		s.errorChannel <- gotelemetry.NewLogError("Spool -> %#s", fmt.Sprintf(format, v...))
+	}
+}
+
+// Debugf sends a formatted string to the agent's debug log, if it exists. It works like log.Logf
+func (s *Spool) Debugf(format string, v ...interface{}) {
+	if s.errorChannel != nil {
+		s.errorChannel <- gotelemetry.NewDebugError("Spool -> %#s", fmt.Sprintf(format, v...))
+	}
+}
+
+func (s *Spool) Errorf(format string, v ...interface{}) {
+	if s.errorChannel != nil {
+		s.errorChannel <- errors.New(fmt.Sprintf("Spool -> "+format, v...))
+	}
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// removeLocked deletes an entry from the spool. It must be called with the mutex held, from
+// within a write transaction.
+func (s *Spool) removeLocked(bucket *bolt.Bucket, seq uint64) error {
+	v := bucket.Get(itob(seq))
+
+	if v == nil {
+		return nil
+	}
+
+	e := &entry{}
+
+	if err := json.Unmarshal(v, e); err != nil {
+		return err
+	}
+
+	if err := bucket.Delete(itob(seq)); err != nil {
+		return err
+	}
+
+	key := e.flowKey()
+	seqs := s.pending[key]
+
+	for index, pendingSeq := range seqs {
+		if pendingSeq == seq {
+			seqs = append(seqs[:index], seqs[index+1:]...)
+			break
+		}
+	}
+
+	if len(seqs) == 0 {
+		delete(s.pending, key)
+	} else {
+		s.pending[key] = seqs
+	}
+
+	s.count--
+
+	return nil
+}
+
+// coalesceLocked attempts to fold a new update into the updates that are already pending
+// for the same flow. It returns true if the new update no longer needs to be stored.
+func (s *Spool) coalesceLocked(bucket *bolt.Bucket, e *entry) (bool, error) {
+	seqs := s.pending[e.flowKey()]
+
+	if len(seqs) == 0 {
+		return false, nil
+	}
+
+	switch e.Type {
+	case gotelemetry.BatchTypePOST:
+		// A POST replaces the contents of the flow, making anything still pending irrelevant
+		for _, seq := range append([]uint64{}, seqs...) {
+			if s.inFlight[seq] {
+				continue
+			}
+
+			if err := s.removeLocked(bucket, seq); err != nil {
+				return false, err
+			}
+
+			s.stats.Coalesced++
+		}
+
+		return false, nil
+
+	case gotelemetry.BatchTypePATCH:
+		last := seqs[len(seqs)-1]
+
+		if s.inFlight[last] {
+			return false, nil
+		}
+
+		previous := &entry{}
+
+		if err := json.Unmarshal(bucket.Get(itob(last)), previous); err != nil {
+			return false, err
+		}
+
+		previousData, ok := previous.Data.(map[string]interface{})
+		data, dataOK := e.Data.(map[string]interface{})
+
+		if !ok || !dataOK || previous.Type == gotelemetry.BatchTypeJSONPATCH {
+			return false, nil
+		}
+
+		// A PATCH following a POST still yields a POST of the merged payload
+		for key, value := range data {
+			previousData[key] = value
+		}
+
+		v, err := json.Marshal(previous)
+
+		if err != nil {
+			return false, err
+		}
+
+		s.stats.Coalesced++
+
+		return true, bucket.Put(itob(last), v)
+	}
+
+	return false, nil
+}
+
+// Enqueue stores an update in the spool. The update will be submitted to the API the next
+// time the spool is drained.
+func (s *Spool) Enqueue(channelTag, tag string, data interface{}, updateType gotelemetry.BatchType) error {
+	e := &entry{
+		Channel:  channelTag,
+		Tag:      tag,
+		Type:     updateType,
+		Data:     data,
+		QueuedAt: time.Now().Unix(),
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.conn.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketName))
+
+		coalesced, err := s.coalesceLocked(bucket, e)
+
+		if err != nil || coalesced {
+			return err
+		}
+
+		if s.maxEntries > 0 && s.count >= s.maxEntries {
+			s.stats.Dropped++
+
+			if s.dropPolicy == DropNewest {
+				return ErrFull
+			}
+
+			// Updates that are being submitted cannot be dropped; if there are no others, the
+			// new update is dropped instead so that the spool never exceeds its size
+			dropped := false
+			c := bucket.Cursor()
+
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				seq := binary.BigEndian.Uint64(k)
+
+				if !s.inFlight[seq] {
+					s.Debugf("The spool is full; dropping its oldest update")
+
+					if err := s.removeLocked(bucket, seq); err != nil {
+						return err
+					}
+
+					dropped = true
+					break
+				}
+			}
+
+			if !dropped {
+				return ErrFull
+			}
+		}
+
+		v, err := json.Marshal(e)
+
+		if err != nil {
+			return err
+		}
+
+		seq, err := bucket.NextSequence()
+
+		if err != nil {
+			return err
+		}
+
+		if err := bucket.Put(itob(seq), v); err != nil {
+			return err
+		}
+
+		s.pending[e.flowKey()] = append(s.pending[e.flowKey()], seq)
+		s.count++
+
+		return nil
+	})
+}
+
+// nextBatch collects the oldest pending updates that can be submitted with a single
+// request: they must share their channel and update type, and address different flows.
+func (s *Spool) nextBatch() ([]uint64, []*entry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	seqs := []uint64{}
+	entries := []*entry{}
+	tags := map[string]bool{}
+
+	var first *entry
+
+	err := s.conn.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(bucketName)).Cursor()
+
+		for k, v := c.First(); k != nil && len(seqs) < maxBatchSize; k, v = c.Next() {
+			e := &entry{}
+
+			if err := json.Unmarshal(v, e); err != nil {
+				return err
+			}
+
+			if first == nil {
+				first = e
+			} else if e.Channel != first.Channel || e.Type != first.Type {
+				break
+			}
+
+			if tags[e.Tag] {
+				break
+			}
+
+			tags[e.Tag] = true
+			entries = append(entries, e)
+			seqs = append(seqs, binary.BigEndian.Uint64(k))
+		}
+
+		return nil
+	})
+
+	for _, seq := range seqs {
+		s.inFlight[seq] = true
+	}
+
+	return seqs, entries, err
+}
+
+// complete removes submitted updates from the spool
+func (s *Spool) complete(seqs []uint64, submitted bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, seq := range seqs {
+		delete(s.inFlight, seq)
+	}
+
+	if !submitted {
+		s.stats.Failed++
+		return nil
+	}
+
+	s.stats.Submitted += uint64(len(seqs))
+
+	return s.conn.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketName))
+
+		for _, seq := range seqs {
+			if err := s.removeLocked(bucket, seq); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// reject discards an update that the API refused
+func (s *Spool) reject(seq uint64, e *entry, reason error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.inFlight, seq)
+
+	s.stats.Rejected++
+	s.Errorf("The API rejected the update to flow %s, which has been discarded: %s", e.Tag, reason)
+
+	return s.conn.Update(func(tx *bolt.Tx) error {
+		return s.removeLocked(tx.Bucket([]byte(bucketName)), seq)
+	})
+}
+
+// isPermanent reports whether a submission failed because the API refused its content, in
+// which case submitting it again cannot succeed. Network errors, server errors, timeouts
+// and rate limiting are transient.
+func isPermanent(err error) bool {
+	e, ok := err.(*gotelemetry.Error)
+
+	if !ok {
+		return false
+	}
+
+	switch e.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+
+	return e.StatusCode >= 400 && e.StatusCode < 500
+}
+
+// publishBatch submits updates that share their channel and type with a single request
+func (s *Spool) publishBatch(entries []*entry) error {
+	batch := gotelemetry.Batch{}
+
+	for _, e := range entries {
+		batch.SetData(e.Tag, e.Data)
+	}
+
+	return batch.Publish(s.credentials, entries[0].Channel, entries[0].Type)
+}
+
+// submitEach submits the updates of a batch that the API refused one by one, so that only
+// the updates at fault are discarded
+func (s *Spool) submitEach(seqs []uint64, entries []*entry) error {
+	for index, seq := range seqs {
+		err := s.publish(entries[index : index+1])
+
+		if err == nil || !isPermanent(err) {
+			if completeErr := s.complete([]uint64{seq}, err == nil); completeErr != nil {
+				err = completeErr
+			}
+		} else {
+			err = s.reject(seq, entries[index], err)
+		}
+
+		if err != nil {
+			s.complete(seqs[index+1:], false)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Drain submits pending updates to the API, in the order in which they were queued, until
+// the spool is empty or a submission fails with a transient error.
+func (s *Spool) Drain() error {
+	s.drainMutex.Lock()
+	defer s.drainMutex.Unlock()
+
+	for {
+		seqs, entries, err := s.nextBatch()
+
+		if err != nil {
+			s.complete(seqs, false)
+			return err
+		}
+
+		if len(seqs) == 0 {
+			return nil
+		}
+
+		err = s.publish(entries)
+
+		if isPermanent(err) {
+			if err := s.submitEach(seqs, entries); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if completeErr := s.complete(seqs, err == nil); completeErr != nil {
+			return completeErr
+		}
+
+		if err != nil {
+			return err
+		}
+
+		s.Debugf("Submitted %d updates", len(seqs))
+	}
+}
+
+func (s *Spool) run() {
+	delay := s.interval
+
+	for {
+		select {
+		case <-s.done:
+			return
+
+		case <-time.After(delay):
+		}
+
+		if err := s.Drain(); err != nil {
+			stats := s.Stats()
+
+			s.Errorf("Unable to submit updates: %s. %d updates are pending; the oldest was queued %s ago.", err, stats.Pending, time.Since(stats.Oldest))
+
+			// Back off while the API is unreachable
+			delay *= 2
+
+			if delay > maxBackoff {
+				delay = maxBackoff
+			}
+
+			continue
+		}
+
+		delay = s.interval
+	}
+}
+
+// Stats returns a snapshot of the state of the spool
+func (s *Spool) Stats() Stats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result := s.stats
+	result.Pending = s.count
+
+	s.conn.View(func(tx *bolt.Tx) error {
+		_, v := tx.Bucket([]byte(bucketName)).Cursor().First()
+
+		if v != nil {
+			e := &entry{}
+
+			if err := json.Unmarshal(v, e); err == nil {
+				result.Oldest = time.Unix(e.QueuedAt, 0)
+			}
+		}
+
+		return nil
+	})
+
+	return result
+}
+
+// ServeHTTP serves the statistics of the spool as JSON
+func (s *Spool) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Stats())
+}
+
+// Close stops submitting updates and closes the spool. Pending updates are kept on
+// disk and replayed the next time the spool is opened.
+func (s *Spool) Close() error {
+	close(s.done)
+
+	if s.listener != nil {
+		s.listener.Close()
+	}
+
+	s.drainMutex.Lock()
+	defer s.drainMutex.Unlock()
+
+	stats := s.Stats()
+
+	s.Logf("Closing with %d updates pending (%d submitted, %d coalesced, %d dropped, %d rejected, %d failed attempts)", stats.Pending, stats.Submitted, stats.Coalesced, stats.Dropped, stats.Rejected, stats.Failed)
+
+	return s.conn.Close()
+}
@@ -0,0 +1,208 @@
+package spool
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/telemetryapp/gotelemetry"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestSpool(t *testing.T, dir string, cfg config.SpoolConfig) *Spool {
+	path := filepath.Join(dir, "spool.bolt")
+	cfg.Path = &path
+
+	s, err := Open(cfg, gotelemetry.Credentials{}, time.Hour, nil)
+
+	if err != nil {
+		t.Fatalf("Unable to open the spool: %s", err)
+	}
+
+	return s
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "agent_spool")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func TestCoalescing(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := openTestSpool(t, dir, config.SpoolConfig{})
+	defer s.Close()
+
+	s.Enqueue("", "a", map[string]interface{}{"value": 1}, gotelemetry.BatchTypePATCH)
+	s.Enqueue("", "a", map[string]interface{}{"label": "A"}, gotelemetry.BatchTypePATCH)
+	s.Enqueue("", "b", []interface{}{map[string]interface{}{"op": "remove", "path": "/value"}}, gotelemetry.BatchTypeJSONPATCH)
+	s.Enqueue("", "b", map[string]interface{}{"value": 2}, gotelemetry.BatchTypePATCH)
+
+	if stats := s.Stats(); stats.Pending != 3 || stats.Coalesced != 1 {
+		t.Errorf("Consecutive PATCHes should be coalesced, but the spool reports %+v", stats)
+	}
+
+	s.Enqueue("", "b", map[string]interface{}{"value": 3}, gotelemetry.BatchTypePOST)
+
+	if stats := s.Stats(); stats.Pending != 2 || stats.Coalesced != 3 {
+		t.Errorf("A POST should supersede pending updates, but the spool reports %+v", stats)
+	}
+
+	s.Enqueue("other_channel", "b", map[string]interface{}{"value": 4}, gotelemetry.BatchTypePATCH)
+
+	if stats := s.Stats(); stats.Pending != 3 {
+		t.Errorf("Updates sent to different channels should not be coalesced, but the spool reports %+v", stats)
+	}
+}
+
+func TestDropPolicy(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := openTestSpool(t, dir, config.SpoolConfig{MaxEntries: 2, DropPolicy: string(DropNewest)})
+
+	s.Enqueue("", "a", map[string]interface{}{"value": 1}, gotelemetry.BatchTypePOST)
+	s.Enqueue("", "b", map[string]interface{}{"value": 1}, gotelemetry.BatchTypePOST)
+
+	if err := s.Enqueue("", "c", map[string]interface{}{"value": 1}, gotelemetry.BatchTypePOST); err != ErrFull {
+		t.Errorf("A full spool should reject new updates, but returned `%v`", err)
+	}
+
+	s.Close()
+
+	dir = tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s = openTestSpool(t, dir, config.SpoolConfig{MaxEntries: 2, DropPolicy: string(DropOldest)})
+	defer s.Close()
+
+	s.Enqueue("", "a", map[string]interface{}{"value": 1}, gotelemetry.BatchTypePOST)
+	s.Enqueue("", "b", map[string]interface{}{"value": 1}, gotelemetry.BatchTypePOST)
+
+	if err := s.Enqueue("", "c", map[string]interface{}{"value": 1}, gotelemetry.BatchTypePOST); err != nil {
+		t.Errorf("A full spool should drop its oldest update, but returned `%s`", err)
+	}
+
+	if stats := s.Stats(); stats.Pending != 2 || stats.Dropped != 1 || len(s.pending[(&entry{Tag: "a"}).flowKey()]) != 0 {
+		t.Errorf("The oldest update should have been dropped, but the spool reports %+v", stats)
+	}
+
+	// Updates that are being submitted cannot be dropped, so the new one is
+	if seqs, _, err := s.nextBatch(); err != nil || len(seqs) != 2 {
+		t.Fatalf("Unexpected batch %v (%v)", seqs, err)
+	}
+
+	if err := s.Enqueue("", "d", map[string]interface{}{"value": 1}, gotelemetry.BatchTypePOST); err != ErrFull {
+		t.Errorf("A spool whose updates are all being submitted should reject new updates, but returned `%v`", err)
+	}
+
+	if stats := s.Stats(); stats.Pending != 2 || stats.Dropped != 2 {
+		t.Errorf("The spool should not exceed its size, but reports %+v", stats)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := openTestSpool(t, dir, config.SpoolConfig{})
+	defer s.Close()
+
+	submitted := []string{}
+	available := true
+
+	s.publish = func(entries []*entry) error {
+		if !available {
+			return errors.New("connection refused")
+		}
+
+		for _, e := range entries {
+			if e.Tag == "invalid" {
+				return &gotelemetry.Error{StatusCode: http.StatusUnprocessableEntity, Message: "Invalid data"}
+			}
+		}
+
+		for _, e := range entries {
+			submitted = append(submitted, e.Tag)
+		}
+
+		return nil
+	}
+
+	for _, tag := range []string{"a", "invalid", "b"} {
+		s.Enqueue("", tag, map[string]interface{}{"value": 1}, gotelemetry.BatchTypePATCH)
+	}
+
+	if err := s.Drain(); err != nil {
+		t.Errorf("A rejected update should not stop the spool, but Drain returned `%s`", err)
+	}
+
+	if stats := s.Stats(); stats.Pending != 0 || stats.Rejected != 1 || stats.Submitted != 2 || len(submitted) != 2 {
+		t.Errorf("The valid updates should have been submitted and the invalid one discarded, but the spool reports %+v (%v)", stats, submitted)
+	}
+
+	available = false
+
+	s.Enqueue("", "c", map[string]interface{}{"value": 1}, gotelemetry.BatchTypePATCH)
+
+	if err := s.Drain(); err == nil {
+		t.Error("A transient error should stop the spool")
+	}
+
+	if stats := s.Stats(); stats.Pending != 1 || stats.Failed != 1 {
+		t.Errorf("An update that could not be submitted should be kept, but the spool reports %+v", stats)
+	}
+}
+
+func TestPermanentErrors(t *testing.T) {
+	tests := map[error]bool{
+		errors.New("connection refused"):                                         false,
+		&gotelemetry.Error{StatusCode: http.StatusBadRequest}:                    true,
+		&gotelemetry.Error{StatusCode: http.StatusUnprocessableEntity}:           true,
+		&gotelemetry.Error{StatusCode: http.StatusTooManyRequests}:               false,
+		&gotelemetry.Error{StatusCode: http.StatusRequestTimeout}:                false,
+		&gotelemetry.Error{StatusCode: http.StatusInternalServerError}:           false,
+		&gotelemetry.Error{StatusCode: http.StatusServiceUnavailable}:            false,
+		&gotelemetry.Error{StatusCode: 0, Message: "Unable to reach the server"}: false,
+	}
+
+	for err, expected := range tests {
+		if isPermanent(err) != expected {
+			t.Errorf("Error %#v should be permanent: %v", err, expected)
+		}
+	}
+}
+
+func TestStatsEndpoint(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := openTestSpool(t, dir, config.SpoolConfig{StatsListen: "127.0.0.1:0"})
+	defer s.Close()
+
+	s.Enqueue("", "a", map[string]interface{}{"value": 1}, gotelemetry.BatchTypePATCH)
+
+	res, err := http.Get("http://" + s.listener.Addr().String() + "/spool")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	stats := Stats{}
+
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil || stats.Pending != 1 {
+		t.Errorf("Unexpected statistics %+v (%v)", stats, err)
+	}
+}
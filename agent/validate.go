@@ -0,0 +1,52 @@
+package agent
+
+import (
+	"fmt"
+	"github.com/telemetryapp/gotelemetry"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"github.com/telemetryapp/gotelemetry_agent/agent/lua"
+)
+
+// ProcessValidateRequest tests the connections to the databases and Redis servers declared in
+// the configuration file. The file itself has already been parsed by the time this runs. If
+// any connection fails, false is sent on the completion channel, and the agent exits with a
+// non-zero status.
+func ProcessValidateRequest(configFile *config.ConfigFile, errorChannel chan error, completionChannel chan bool) {
+	errorChannel <- gotelemetry.NewLogError("Validation mode is on.")
+
+	failures := validateConnections(errorChannel)
+
+	if failures == 0 {
+		errorChannel <- gotelemetry.NewLogError("The configuration file is valid, and declares %d jobs.", len(configFile.Jobs()))
+	} else {
+		errorChannel <- fmt.Errorf("Unable to connect to %d of the databases and Redis servers.", failures)
+	}
+
+	completionChannel <- failures == 0
+}
+
+// validateConnections pings every database and Redis server, and returns the number that
+// could not be reached
+func validateConnections(errorChannel chan error) int {
+	failures := 0
+
+	for _, name := range lua.DatabaseNames() {
+		if err := lua.PingDatabase(name); err != nil {
+			errorChannel <- fmt.Errorf("Unable to connect to the database %s: %s", name, err)
+			failures++
+		} else {
+			errorChannel <- gotelemetry.NewLogError("Connected to the database %s.", name)
+		}
+	}
+
+	for _, name := range lua.RedisNames() {
+		if err := lua.PingRedis(name); err != nil {
+			errorChannel <- fmt.Errorf("Unable to connect to the Redis server %s: %s", name, err)
+			failures++
+		} else {
+			errorChannel <- gotelemetry.NewLogError("Connected to the Redis server %s.", name)
+		}
+	}
+
+	return failures
+}
@@ -0,0 +1,40 @@
+package agent
+
+import (
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"github.com/telemetryapp/gotelemetry_agent/agent/lua"
+	"testing"
+)
+
+func validate(t *testing.T) bool {
+	errorChannel := make(chan error, 10)
+	completionChannel := make(chan bool, 1)
+
+	ProcessValidateRequest(&config.ConfigFile{}, errorChannel, completionChannel)
+
+	return <-completionChannel
+}
+
+func TestValidate(t *testing.T) {
+	defer lua.InitDatabases(nil)
+
+	if err := lua.InitDatabases(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if !validate(t) {
+		t.Error("Validation should succeed when there is nothing to connect to")
+	}
+
+	err := lua.InitDatabases(map[string]config.DatabaseConfig{
+		"unreachable": {Driver: "mysql", DSN: "user:password@tcp(127.0.0.1:1)/test"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if validate(t) {
+		t.Error("Validation should fail when a database cannot be reached")
+	}
+}
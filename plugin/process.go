@@ -7,8 +7,11 @@ import (
 	"github.com/telemetryapp/gotelemetry"
 	"github.com/telemetryapp/gotelemetry_agent/agent/aggregations"
 	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"github.com/telemetryapp/gotelemetry_agent/agent/httpclient"
 	"github.com/telemetryapp/gotelemetry_agent/agent/job"
 	"github.com/telemetryapp/gotelemetry_agent/agent/lua"
+	"github.com/telemetryapp/gotelemetry_agent/agent/record"
+	"github.com/telemetryapp/gotelemetry_agent/agent/schema"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -16,6 +19,7 @@ import (
 	"os/exec"
 	"path"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -38,16 +42,22 @@ func ProcessPluginFactory() job.PluginInstance {
 // For configuration parameters, see the Init() function
 type ProcessPlugin struct {
 	*job.PluginHelper
-	args         []string
-	batch        bool
-	expiration   time.Duration
-	flow         *gotelemetry.Flow
-	flowTag      string
-	path         string
-	scriptArgs   map[string]interface{}
-	template     map[string]interface{}
-	templateFile string
-	url          string
+	args          []string
+	batch         bool
+	expiration    time.Duration
+	flow          *gotelemetry.Flow
+	flowTag       string
+	httpClient    *http.Client
+	luaOptions    lua.ExecOptions
+	outputFormat  string
+	path          string
+	scriptArgs    map[string]interface{}
+	template      map[string]interface{}
+	templateFile  string
+	url           string
+	variant       string
+	variants      map[string]string
+	variantsMutex sync.Mutex
 }
 
 // Function Init initializes the plugin.
@@ -72,12 +82,41 @@ type ProcessPlugin struct {
 // - expiration										The number of seconds after which flow data is set to expire.
 //                                Default: interval * 3; 0 = never.
 //
-// - variant                      The variant of the flow
+// - variant                      The variant of the flow. When specified, the output of the plugin is
+//                                validated against the schema of the variant before it is submitted.
+//                                Updates to other flows are validated against the variants the API
+//                                reports for them
 //
 // - template                     A template that will be used to populate the flow when it is created
 //
 // - batch												Whether the output of this script should be considered a batch update
 //
+// - output_format								The format of the output produced by `exec` or `url`: `json`, `csv`,
+//                                `kv`, or `prometheus`. Default: json
+//
+// - http_profile                 The HTTP profile, from the agent's `[http]` section, used to retrieve `url`.
+//                                Default: the `default` profile, if there is one
+//
+// - lua_path                     A directory, or an array of directories, in which `require` looks for Lua
+//                                modules before the directories listed in the agent-wide `lua_path`
+//
+// - lua_sandbox                  The sandbox profile of a Lua script. The only profile is `strict`, which
+//                                removes `io`, `debug`, `os.execute` and the other functions that reach the
+//                                file system or other processes, and only allows requiring the standard,
+//                                `telemetry/` and `goluago/` modules
+//
+// - lua_modules                  Additional modules that can be required in the sandbox
+//
+// - lua_max_instructions         The number of instructions a Lua script may execute. Default: none, or
+//                                100,000,000 in the sandbox
+//
+// - lua_max_memory               An opt-in guard against runaway scripts: the script is stopped when the
+//                                agent's heap grows by more than this number of megabytes while it runs.
+//                                The agent cannot measure a single script, so growth caused by other jobs
+//                                counts too. Default: none, in the sandbox as well
+//
+// - lua_timeout                  How long a Lua script may run. Default: none, or one minute in the sandbox
+//
 // If `variant` and `template` are both specified, the plugin will verify that the flow exists and is of the
 // correct variant on startup. In that case, if the flow is found but is of the wrong variant, an error is
 // output to log and the plugin is not allowed to run. If the flow does not exist, it is created using
@@ -92,6 +131,31 @@ type ProcessPlugin struct {
 //
 // - Output the text REPLACE, followed by a newline, followed by a payload that is used to replace the contents of the flow.
 //
+// More generally, the output can be divided into sections by printing one of these directives on a line of its
+// own, optionally followed by a flow tag. Each directive applies to the lines that follow it, up to the next
+// directive; without a tag, it applies to the job's flow or, in batch mode, to the flows named in its payload:
+//
+// - PATCH [tag]                  Update the flow using a top-level property replacement operation
+//
+// - REPLACE [tag]                Replace the contents of the flow
+//
+// - JSONPATCH [tag]              Apply JSON-Patch operations, given as arrays or individual objects, to the flow.
+//                                In batch mode, the payload maps flow tags to arrays of operations
+//
+// - DELETE [tag]                 Clear the contents of the flow by replacing them with an empty payload.
+//                                This directive takes no payload
+//
+// For example, this output appends to the `requests` timeseries, replaces `status` and patches the job's flow:
+//
+//   JSONPATCH requests
+//   [{"op": "add", "path": "/values/-", "value": 42}]
+//   REPLACE status
+//   {"value": "OK", "color": "green"}
+//   PATCH
+//   {"value": 12}
+//
+// The output is only submitted if every section in it can be parsed.
+//
 // For example:
 //
 //  jobs:
@@ -129,6 +193,22 @@ type ProcessPlugin struct {
 //
 //   It is a user error to specify both a `url` and `exec` property, or to provide an `args` property
 //   without a `exec` property.
+//
+//   Processes that cannot output JSON can use `output_format` to have their output converted
+//   into a payload. The REPLACE prefix is honoured by all formats:
+//
+//   - csv: the first record is a header that names the properties of the payload. Without
+//     `batch`, exactly one further record is allowed. With `batch`, each record updates the
+//     flow whose tag is in its first column.
+//
+//   - kv: one or more whitespace-separated `key=value` pairs per line. With `batch`, keys take
+//     the form `flow_tag.property`.
+//
+//   - prometheus: Prometheus text exposition format. Each sample is named after its metric, followed
+//     by its label values joined by underscores. Without `batch`, each sample becomes a property of the
+//     payload; with `batch`, it sets the `value` property of the flow with the same tag.
+//
+//   Numeric and boolean values found in non-JSON output are converted to the appropriate type.
 
 func (p *ProcessPlugin) Init(job *job.Job) error {
 	c := job.Config()
@@ -190,6 +270,14 @@ func (p *ProcessPlugin) Init(job *job.Job) error {
 		return errors.New("You must specify a `script`, `exec`, or `url` property.")
 	}
 
+	p.outputFormat, _ = c["output_format"].(string)
+
+	if p.outputFormat != "" {
+		if _, ok := outputParsers[p.outputFormat]; !ok {
+			return errors.New("Invalid `output_format` value `" + p.outputFormat + "`. Must be one of `json`, `csv`, `kv`, or `prometheus`.")
+		}
+	}
+
 	if p.path != "" && p.url != "" {
 		return errors.New("You cannot provide both `script` or `exec` and `url` properties.")
 	}
@@ -243,12 +331,43 @@ func (p *ProcessPlugin) Init(job *job.Job) error {
 			if _, err := os.Stat(p.templateFile); os.IsNotExist(err) {
 				return errors.New("Template " + p.templateFile + " does not exist.")
 			}
+
+			if p.outputFormat != "" && p.outputFormat != outputFormatJSON {
+				return errors.New("The `output_format` property can only be used with `exec` or `url`.")
+			}
+
+			var agentLuaPath []string
+
+			if agentConfig := job.AgentConfig(); agentConfig != nil {
+				agentLuaPath = agentConfig.LuaPath()
+			}
+
+			if p.luaOptions, err = parseLuaOptions(c, agentLuaPath); err != nil {
+				return err
+			}
+
+			p.luaOptions.JobID = job.ID
+		}
+	}
+
+	if p.url != "" && p.templateFile == "" {
+		profile, _ := c["http_profile"].(string)
+		client, err := httpclient.Get(profile)
+
+		if err != nil {
+			return err
 		}
+
+		p.httpClient = client
+	} else if _, ok := c["http_profile"]; ok {
+		return errors.New("The `http_profile` property can only be used with `url`.")
 	}
 
 	template, templateOK := c["template"]
 	variant, variantOK := c["variant"].(string)
 
+	p.variant = variant
+
 	if variantOK && templateOK {
 		if p.flowTag == "" {
 			return errors.New("The required `flow_tag` property (`string`) is either missing or of the wrong type.")
@@ -311,133 +430,196 @@ func (p *ProcessPlugin) Init(job *job.Job) error {
 	return nil
 }
 
-func (p *ProcessPlugin) performDataUpdate(j *job.Job, flowTag string, isReplace bool, data map[string]interface{}) {
+// variantOf returns the variant of a flow the job updates. The variant of the job's own flow
+// comes from its configuration; those of other flows, which batch output can update, are
+// looked up once and remembered. Flows that cannot be found have no known variant.
+func (p *ProcessPlugin) variantOf(j *job.Job, tag string) string {
+	if tag == p.flowTag {
+		return p.variant
+	}
+
+	p.variantsMutex.Lock()
+	defer p.variantsMutex.Unlock()
+
+	variant, ok := p.variants[tag]
+
+	if !ok {
+		if f, err := j.GetFlowTagLayout(tag); err == nil {
+			variant = f.Variant
+		} else {
+			j.Debugf("Unable to find the variant of flow %s, its data will not be validated: %s", tag, err)
+		}
+
+		if p.variants == nil {
+			p.variants = map[string]string{}
+		}
+
+		p.variants[tag] = variant
+	}
+
+	return variant
+}
+
+// validateDataUpdate checks an update against the schema of its flow's variant. Only
+// updates that carry a payload are validated; JSON-Patch operations are submitted as-is.
+func (p *ProcessPlugin) validateDataUpdate(variant string, update processUpdate) error {
+	if variant == "" {
+		return nil
+	}
+
+	data, ok := update.data.(map[string]interface{})
+
+	if !ok || (update.directive != directivePATCH && update.directive != directiveREPLACE) {
+		return nil
+	}
 
+	return schema.Validate(variant, data, update.directive == directivePATCH)
+}
+
+// validateDataUpdates checks every update and reports those that are invalid, both in the
+// log and on their flows. It returns false if any update is invalid.
+func (p *ProcessPlugin) validateDataUpdates(j *job.Job, updates []processUpdate) bool {
+	valid := true
+
+	for _, update := range updates {
+		variant := p.variantOf(j, update.tag)
+
+		if err := p.validateDataUpdate(variant, update); err != nil {
+			message := fmt.Sprintf("Invalid data for %s flow %s: %s", variant, update.tag, err)
+
+			j.ReportError(errors.New(message))
+
+			if config.CLIConfig.DebugMode == false {
+				j.SetFlowError(update.tag, map[string]interface{}{"message": message})
+			}
+
+			valid = false
+		}
+	}
+
+	return valid
+}
+
+func (p *ProcessPlugin) performDataUpdate(j *job.Job, update processUpdate) {
 	if config.CLIConfig.DebugMode == true {
 		// Debug Mode. Print data dump. Do not send API update
-		jsonOutput, err := json.MarshalIndent(data, "", "  ")
+		jsonOutput, err := json.MarshalIndent(update.data, "", "  ")
 
 		if err != nil {
 			return
 		}
 
-		fmt.Printf("\nPrinting the output results of \"%s\":\n", flowTag)
+		fmt.Printf("\nPrinting the output results of \"%s\" (%s):\n", update.tag, update.directive)
 		fmt.Println(string(jsonOutput))
 		return
 	}
 
-	if isReplace {
-		if p.expiration > 0 {
-			newExpiration := time.Now().Add(p.expiration)
-			newUnixExpiration := newExpiration.Unix()
+	if update.directive == directiveDELETE {
+		// An empty replacement, without the expiration that would otherwise be added
+		j.QueueDataUpdate(update.tag, update.data, gotelemetry.BatchTypePOST)
+		return
+	}
 
-			j.Debugf("Forcing expiration to %d (%s)", newUnixExpiration, newExpiration)
+	var newUnixExpiration int64
 
-			data["expires_at"] = newUnixExpiration
-		}
+	if p.expiration > 0 {
+		newExpiration := time.Now().Add(p.expiration)
+		newUnixExpiration = newExpiration.Unix()
 
-		j.QueueDataUpdate(flowTag, data, gotelemetry.BatchTypePOST)
-	} else {
-		if p.expiration > 0 {
-			newExpiration := time.Now().Add(p.expiration)
-			newUnixExpiration := newExpiration.Unix()
+		j.Debugf("Forcing expiration to %d (%s)", newUnixExpiration, newExpiration)
+	}
 
-			j.Debugf("Forcing expiration to %d (%s)", newUnixExpiration, newExpiration)
+	switch update.directive {
+	case directiveJSONPATCH:
+		operations := update.data.([]interface{})
 
-			data["expires_at"] = newUnixExpiration
+		if newUnixExpiration > 0 {
+			operations = append(operations, map[string]interface{}{"op": "add", "path": "/expires_at", "value": newUnixExpiration})
 		}
 
-		j.QueueDataUpdate(flowTag, data, gotelemetry.BatchTypePATCH)
-	}
-}
+		j.QueueDataUpdate(update.tag, operations, gotelemetry.BatchTypeJSONPATCH)
 
-func (p *ProcessPlugin) analyzeAndSubmitProcessResponse(j *job.Job, response string) error {
-	isReplace := false
+	case directiveREPLACE:
+		data := update.data.(map[string]interface{})
 
-	if strings.HasPrefix(response, "REPLACE\n") {
-		isReplace = true
-		response = strings.TrimPrefix(response, "REPLACE\n")
-	}
+		if newUnixExpiration > 0 {
+			data["expires_at"] = newUnixExpiration
+		}
 
-	data := map[string]interface{}{}
+		j.QueueDataUpdate(update.tag, data, gotelemetry.BatchTypePOST)
 
-	for _, command := range strings.Split(response, "\n") {
-		command = strings.TrimSpace(command)
+	default:
+		data := update.data.(map[string]interface{})
 
-		if command == "" {
-			continue
+		if newUnixExpiration > 0 {
+			data["expires_at"] = newUnixExpiration
 		}
 
-		if err := json.Unmarshal([]byte(command), &data); err != nil {
-			return err
-		}
+		j.QueueDataUpdate(update.tag, data, gotelemetry.BatchTypePATCH)
 	}
+}
 
-	if p.batch {
-		for key, value := range data {
-			if valueMap, ok := value.(map[string]interface{}); ok {
-				p.performDataUpdate(j, key, isReplace, valueMap)
-			} else {
-				return errors.New(fmt.Sprintf("Invalid data for flow %s", key))
-			}
-		}
+func (p *ProcessPlugin) analyzeAndSubmitProcessResponse(j *job.Job, response string) error {
+	updates, err := p.parseProcessUpdates(j, response)
 
-		return nil
+	if err != nil {
+		return err
 	}
 
-	if p.flowTag == "" {
-		if j.ID != "" {
-			// Flow-less job
-			return nil
-		}
-		return errors.New("The required `flow_tag` property (`string`) is either missing or of the wrong type.")
+	// Like a malformed section, a single invalid update prevents the whole output from
+	// being submitted
+	if !p.validateDataUpdates(j, updates) {
+		return errors.New("Nothing was submitted because the output contains invalid data")
 	}
 
-	p.performDataUpdate(j, p.flowTag, isReplace, data)
+	for _, update := range updates {
+		p.performDataUpdate(j, update)
+	}
 
 	return nil
 }
 
-func (p *ProcessPlugin) performScriptTask(j *job.Job) (string, error) {
+func (p *ProcessPlugin) performScriptTask(j *job.Job, tape *record.Tape) (string, error) {
 	if len(p.args) > 0 {
 		j.Debugf("Executing `%s` with arguments %#v", p.path, p.args)
 	} else {
 		j.Debugf("Executing `%s` with no arguments", p.path)
 	}
 
-	out, err := exec.Command(p.path, p.args...).Output()
+	return tape.DoString("exec", strings.Join(append([]string{p.path}, p.args...), " "), func() (string, error) {
+		out, err := exec.Command(p.path, p.args...).Output()
 
-	return string(out), err
+		return string(out), err
+	})
 }
 
-func (p *ProcessPlugin) performHTTPTask(j *job.Job) (string, error) {
+func (p *ProcessPlugin) performHTTPTask(j *job.Job, tape *record.Tape) (string, error) {
 	j.Debugf("Retrieving expression from URL `%s`", p.url)
 
-	r, err := http.Get(p.url)
+	return tape.DoString("http", "GET "+p.url, func() (string, error) {
+		r, err := p.httpClient.Get(p.url)
 
-	if err != nil {
-		return "", err
-	}
+		if err != nil {
+			return "", err
+		}
 
-	defer r.Body.Close()
+		defer r.Body.Close()
 
-	out, err := ioutil.ReadAll(r.Body)
+		out, err := ioutil.ReadAll(r.Body)
 
-	if r.StatusCode > 399 {
-		return string(out), gotelemetry.NewErrorWithFormat(r.StatusCode, "HTTP request failed with status %d", nil, r.StatusCode)
-	}
+		if r.StatusCode > 399 {
+			return string(out), gotelemetry.NewErrorWithFormat(r.StatusCode, "HTTP request failed with status %d", nil, r.StatusCode)
+		}
 
-	return string(out), nil
+		return string(out), nil
+	})
 }
 
-func (p *ProcessPlugin) performTemplateTaskLua(j *job.Job) (string, error) {
-	source, err := ioutil.ReadFile(p.templateFile)
-
-	if err != nil {
-		return "", err
-	}
+func (p *ProcessPlugin) performTemplateTaskLua(j *job.Job, tape *record.Tape) (string, error) {
+	options := p.luaOptions
+	options.Tape = tape
 
-	output, err := lua.Exec(string(source), j, p.scriptArgs)
+	output, err := lua.ExecFile(p.templateFile, j, p.scriptArgs, options)
 
 	if err != nil {
 		return "", err
@@ -448,10 +630,10 @@ func (p *ProcessPlugin) performTemplateTaskLua(j *job.Job) (string, error) {
 	return string(out), err
 }
 
-func (p *ProcessPlugin) performTemplateTask(j *job.Job) (string, error) {
+func (p *ProcessPlugin) performTemplateTask(j *job.Job, tape *record.Tape) (string, error) {
 
 	if strings.HasSuffix(p.templateFile, ".lua") {
-		return p.performTemplateTaskLua(j)
+		return p.performTemplateTaskLua(j, tape)
 	}
 
 	return "", fmt.Errorf("Unknown script type for file `%s`", p.templateFile)
@@ -464,26 +646,45 @@ func (p *ProcessPlugin) performAllTasks(j *job.Job) {
 
 	var response string
 	var err error
+	var tape *record.Tape
+
+	if config.CLIConfig.RecordDir != "" {
+		tape = record.NewRecorder(j.ID)
+	}
 
 	if p.path != "" {
-		response, err = p.performScriptTask(j)
+		response, err = p.performScriptTask(j, tape)
 	} else if p.templateFile != "" {
-		response, err = p.performTemplateTask(j)
+		response, err = p.performTemplateTask(j, tape)
 	} else if p.url != "" {
-		response, err = p.performHTTPTask(j)
+		response, err = p.performHTTPTask(j, tape)
 	} else {
 		err = errors.New("Nothing to do!")
 	}
 
+	if tape != nil {
+		tape.SetOutput(response, err)
+
+		if path, err := tape.Save(config.CLIConfig.RecordDir); err != nil {
+			j.ReportError(fmt.Errorf("Unable to save the recording of this run: %s", err))
+		} else {
+			j.Debugf("Run recorded to %s", path)
+		}
+	}
+
 	if err != nil {
 		if p.flowTag != "" {
-			res := err.Error() + " : " + strings.TrimSpace(string(response))
+			if scriptErr, ok := err.(*lua.ScriptError); ok {
+				j.SetFlowError(p.flowTag, scriptErr.Fields())
+			} else {
+				res := err.Error() + " : " + strings.TrimSpace(string(response))
 
-			if res == "" {
-				res = "No output detected."
-			}
+				if res == "" {
+					res = "No output detected."
+				}
 
-			j.SetFlowError(p.flowTag, map[string]interface{}{"message": res})
+				j.SetFlowError(p.flowTag, map[string]interface{}{"message": res})
+			}
 		}
 
 		j.ReportError(err)
@@ -0,0 +1,227 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/telemetryapp/gotelemetry_agent/agent/job"
+	"regexp"
+	"strings"
+)
+
+// Directives that a process can print on a line of its own to change how the lines
+// that follow are submitted. A directive can optionally be followed by a flow tag.
+const (
+	directivePATCH     = "PATCH"
+	directiveREPLACE   = "REPLACE"
+	directiveJSONPATCH = "JSONPATCH"
+	directiveDELETE    = "DELETE"
+)
+
+var directiveRegex = regexp.MustCompile(`^(PATCH|REPLACE|JSONPATCH|DELETE)(?:\s+(\S+))?$`)
+
+// outputSection is a portion of a process' output that is governed by a directive
+type outputSection struct {
+	directive string
+	tag       string
+	explicit  bool
+	lines     []string
+}
+
+func (s *outputSection) body() string {
+	return strings.Join(s.lines, "\n")
+}
+
+func (s *outputSection) isEmpty() bool {
+	return strings.TrimSpace(s.body()) == ""
+}
+
+// processUpdate is a single update, ready to be queued, that was extracted from a process' output
+type processUpdate struct {
+	directive string
+	tag       string
+	data      interface{}
+}
+
+// splitOutputSections breaks a process' output into sections delimited by directives. Any
+// output that precedes the first directive is treated as a PATCH, which preserves the
+// behaviour of processes that print a plain payload.
+func splitOutputSections(response string) []*outputSection {
+	sections := []*outputSection{}
+	current := &outputSection{directive: directivePATCH}
+
+	for _, line := range strings.Split(response, "\n") {
+		if matches := directiveRegex.FindStringSubmatch(strings.TrimSpace(line)); matches != nil {
+			if current.explicit || !current.isEmpty() {
+				sections = append(sections, current)
+			}
+
+			current = &outputSection{directive: matches[1], tag: matches[2], explicit: true}
+			continue
+		}
+
+		current.lines = append(current.lines, line)
+	}
+
+	if current.explicit || !current.isEmpty() || len(sections) == 0 {
+		sections = append(sections, current)
+	}
+
+	return sections
+}
+
+// parseJSONPatchOperations reads one JSON value per line. Arrays are treated as lists of
+// operations and objects as individual operations; in batch mode, objects map flow tags
+// to lists of operations instead.
+func parseJSONPatchOperations(body string, batch bool) (interface{}, error) {
+	operations := []interface{}{}
+	batchOperations := map[string]interface{}{}
+
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+
+		if line == "" {
+			continue
+		}
+
+		var value interface{}
+
+		if err := json.Unmarshal([]byte(line), &value); err != nil {
+			return nil, err
+		}
+
+		switch v := value.(type) {
+		case []interface{}:
+			if batch {
+				return nil, errors.New("JSON-Patch operations in batch mode must be keyed by flow tag")
+			}
+
+			operations = append(operations, v...)
+
+		case map[string]interface{}:
+			if !batch {
+				operations = append(operations, v)
+				continue
+			}
+
+			for tag, ops := range v {
+				ops, ok := ops.([]interface{})
+
+				if !ok {
+					return nil, fmt.Errorf("Invalid JSON-Patch operations for flow %s", tag)
+				}
+
+				existing, _ := batchOperations[tag].([]interface{})
+				batchOperations[tag] = append(existing, ops...)
+			}
+
+		default:
+			return nil, fmt.Errorf("Invalid JSON-Patch operation `%s`", line)
+		}
+	}
+
+	if batch {
+		return batchOperations, nil
+	}
+
+	return operations, nil
+}
+
+// parseSection converts a section of output into zero or more updates
+func (p *ProcessPlugin) parseSection(j *job.Job, section *outputSection) ([]processUpdate, error) {
+	var data interface{}
+	var err error
+
+	// A section that names its flow always carries the payload of that flow, even in batch mode
+	batch := p.batch && section.tag == ""
+
+	switch section.directive {
+	case directiveDELETE:
+		if !section.isEmpty() {
+			return nil, errors.New("The DELETE directive does not accept a payload")
+		}
+
+		if batch {
+			return nil, errors.New("The DELETE directive requires a flow tag in batch mode")
+		}
+
+		// The batch API has no delete operation, but replacing a flow's data removes every
+		// property that is not in the new payload, so an empty one clears the flow
+		data = map[string]interface{}{}
+
+	case directiveJSONPATCH:
+		data, err = parseJSONPatchOperations(section.body(), batch)
+
+	default:
+		data, err = p.parseProcessOutput(section.body(), batch)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if batch {
+		result := []processUpdate{}
+
+		for tag, value := range data.(map[string]interface{}) {
+			switch value.(type) {
+			case map[string]interface{}:
+				if section.directive == directiveJSONPATCH {
+					return nil, fmt.Errorf("Invalid data for flow %s", tag)
+				}
+
+			case []interface{}:
+				if section.directive != directiveJSONPATCH {
+					return nil, fmt.Errorf("Invalid data for flow %s", tag)
+				}
+
+			default:
+				return nil, fmt.Errorf("Invalid data for flow %s", tag)
+			}
+
+			result = append(result, processUpdate{section.directive, tag, value})
+		}
+
+		return result, nil
+	}
+
+	tag := section.tag
+
+	if tag == "" {
+		tag = p.flowTag
+	}
+
+	if tag == "" {
+		if j.ID != "" {
+			// Flow-less job
+			return []processUpdate{}, nil
+		}
+
+		return nil, errors.New("The required `flow_tag` property (`string`) is either missing or of the wrong type.")
+	}
+
+	return []processUpdate{{section.directive, tag, data}}, nil
+}
+
+// parseProcessUpdates extracts all the updates contained in a process' output. Nothing is
+// returned unless the whole output can be parsed, so that a malformed section does not
+// result in a partial submission.
+func (p *ProcessPlugin) parseProcessUpdates(j *job.Job, response string) ([]processUpdate, error) {
+	result := []processUpdate{}
+
+	for _, section := range splitOutputSections(response) {
+		updates, err := p.parseSection(j, section)
+
+		if err != nil {
+			if section.explicit {
+				return nil, fmt.Errorf("%s: %s", strings.TrimSpace(section.directive+" "+section.tag), err)
+			}
+
+			return nil, err
+		}
+
+		result = append(result, updates...)
+	}
+
+	return result, nil
+}
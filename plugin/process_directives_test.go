@@ -0,0 +1,136 @@
+package plugin
+
+import (
+	"github.com/telemetryapp/gotelemetry_agent/agent/job"
+	"reflect"
+	"testing"
+)
+
+type directivesTest struct {
+	name     string
+	batch    bool
+	response string
+	expected []processUpdate
+}
+
+func TestSplitOutputSections(t *testing.T) {
+	sections := splitOutputSections("{\"value\": 1}\nREPLACE status\n{\"value\": \"OK\"}\n  DELETE  \nJSONPATCH\n")
+
+	expected := []outputSection{
+		{directivePATCH, "", false, []string{`{"value": 1}`}},
+		{directiveREPLACE, "status", true, []string{`{"value": "OK"}`}},
+		{directiveDELETE, "", true, nil},
+		{directiveJSONPATCH, "", true, []string{""}},
+	}
+
+	if len(sections) != len(expected) {
+		t.Fatalf("Expected %d sections, but got %d instead.", len(expected), len(sections))
+	}
+
+	for index, section := range sections {
+		if !reflect.DeepEqual(*section, expected[index]) {
+			t.Errorf("Section %d: expected `%#v`, but got `%#v` instead.", index, expected[index], *section)
+		}
+	}
+
+	if sections := splitOutputSections(""); len(sections) != 1 || sections[0].directive != directivePATCH || !sections[0].isEmpty() {
+		t.Errorf("Empty output should produce a single empty PATCH section, but got `%#v`.", sections)
+	}
+}
+
+func TestParseJSONPatchOperations(t *testing.T) {
+	add := map[string]interface{}{"op": "add", "path": "/values/-", "value": 1.0}
+	remove := map[string]interface{}{"op": "remove", "path": "/label"}
+
+	operations, err := parseJSONPatchOperations(`[{"op": "add", "path": "/values/-", "value": 1}]`+"\n\n"+`{"op": "remove", "path": "/label"}`, false)
+
+	if err != nil || !reflect.DeepEqual(operations, []interface{}{add, remove}) {
+		t.Errorf("Unexpected operations `%#v` (%v)", operations, err)
+	}
+
+	operations, err = parseJSONPatchOperations(`{"requests": [{"op": "add", "path": "/values/-", "value": 1}]}`+"\n"+`{"requests": [{"op": "remove", "path": "/label"}]}`, true)
+
+	if err != nil || !reflect.DeepEqual(operations, map[string]interface{}{"requests": []interface{}{add, remove}}) {
+		t.Errorf("Unexpected batch operations `%#v` (%v)", operations, err)
+	}
+
+	for _, body := range []string{`"add"`, `[{"op": "add"`} {
+		if _, err := parseJSONPatchOperations(body, false); err == nil {
+			t.Errorf("Operations `%s` should be rejected", body)
+		}
+	}
+
+	for _, body := range []string{`[{"op": "add", "path": "/value", "value": 1}]`, `{"requests": {"op": "add"}}`} {
+		if _, err := parseJSONPatchOperations(body, true); err == nil {
+			t.Errorf("Batch operations `%s` should be rejected", body)
+		}
+	}
+}
+
+func TestParseProcessUpdates(t *testing.T) {
+	tests := []directivesTest{
+		// Output that predates directives
+		{"Plain payload", false, `{"value": 12}`, []processUpdate{{directivePATCH, "job", map[string]interface{}{"value": 12.0}}}},
+		{"Plain payload over several lines", false, "{\"value\": 12}\n{\"label\": \"Test\"}\n", []processUpdate{{directivePATCH, "job", map[string]interface{}{"value": 12.0, "label": "Test"}}}},
+		{"Leading REPLACE", false, "REPLACE\n{\"value\": 12}", []processUpdate{{directiveREPLACE, "job", map[string]interface{}{"value": 12.0}}}},
+		{"Leading REPLACE in batch mode", true, "REPLACE\n{\"status\": {\"value\": \"OK\"}}", []processUpdate{{directiveREPLACE, "status", map[string]interface{}{"value": "OK"}}}},
+		{"Directive text inside a payload", false, `{"label": "REPLACE"}`, []processUpdate{{directivePATCH, "job", map[string]interface{}{"label": "REPLACE"}}}},
+
+		// Directives anywhere in the output
+		{
+			"Directives after a payload",
+			false,
+			"{\"value\": 12}\nREPLACE status\n{\"value\": \"OK\"}\nJSONPATCH requests\n[{\"op\": \"add\", \"path\": \"/values/-\", \"value\": 42}]\nDELETE old",
+			[]processUpdate{
+				{directivePATCH, "job", map[string]interface{}{"value": 12.0}},
+				{directiveREPLACE, "status", map[string]interface{}{"value": "OK"}},
+				{directiveJSONPATCH, "requests", []interface{}{map[string]interface{}{"op": "add", "path": "/values/-", "value": 42.0}}},
+				{directiveDELETE, "old", map[string]interface{}{}},
+			},
+		},
+		{"Directive with surrounding whitespace", false, "  PATCH status  \n{\"value\": 1}", []processUpdate{{directivePATCH, "status", map[string]interface{}{"value": 1.0}}}},
+		{"Tagged section in batch mode", true, "PATCH status\n{\"value\": 1}", []processUpdate{{directivePATCH, "status", map[string]interface{}{"value": 1.0}}}},
+		{"DELETE without a tag", false, "DELETE", []processUpdate{{directiveDELETE, "job", map[string]interface{}{}}}},
+
+		// Nothing is returned if any section is invalid
+		{"Lowercase directive", false, "replace\n{\"value\": 12}", nil},
+		{"Malformed section after a valid one", false, "{\"value\": 12}\nREPLACE status\n{\"value\": ", nil},
+		{"DELETE with a payload", false, "DELETE status\n{\"value\": 1}", nil},
+		{"DELETE without a tag in batch mode", true, "DELETE", nil},
+		{"Non-object flow in batch mode", true, `{"status": 12}`, nil},
+	}
+
+	for _, tt := range tests {
+		p := &ProcessPlugin{flowTag: "job", batch: tt.batch, outputFormat: outputFormatJSON}
+		updates, err := p.parseProcessUpdates(&job.Job{ID: "test"}, tt.response)
+
+		if tt.expected == nil {
+			if err == nil {
+				t.Errorf("Test %s should fail, but returned `%#v`.", tt.name, updates)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Test %s should not fail, but returned `%s`.", tt.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(updates, tt.expected) {
+			t.Errorf("Test %s: expected `%#v`, but got `%#v` instead.", tt.name, tt.expected, updates)
+		}
+	}
+}
+
+func TestParseProcessUpdatesWithoutFlow(t *testing.T) {
+	p := &ProcessPlugin{outputFormat: outputFormatJSON}
+
+	if updates, err := p.parseProcessUpdates(&job.Job{ID: "test"}, `{"value": 1}`); err != nil || len(updates) != 0 {
+		t.Errorf("Flow-less jobs should not submit updates, but returned `%#v` (%v)", updates, err)
+	}
+
+	if _, err := p.parseProcessUpdates(&job.Job{}, `{"value": 1}`); err == nil {
+		t.Error("Updates without a flow tag should be rejected")
+	}
+}
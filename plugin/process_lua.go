@@ -0,0 +1,131 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"github.com/telemetryapp/gotelemetry_agent/agent/lua"
+	"time"
+)
+
+func configInteger(c map[string]interface{}, key string) (int64, bool, error) {
+	switch v := c[key].(type) {
+	case nil:
+		return 0, false, nil
+
+	case int:
+		return int64(v), true, nil
+
+	case int64:
+		return v, true, nil
+
+	case float64:
+		return int64(v), true, nil
+	}
+
+	return 0, false, fmt.Errorf("The `%s` property must be a number", key)
+}
+
+func configStrings(c map[string]interface{}, key string) ([]string, error) {
+	switch v := c[key].(type) {
+	case nil:
+		return []string{}, nil
+
+	case string:
+		return []string{v}, nil
+
+	case []interface{}:
+		result := []string{}
+
+		for _, item := range v {
+			s, ok := item.(string)
+
+			if !ok {
+				return nil, fmt.Errorf("The `%s` property must be a string or an array of strings", key)
+			}
+
+			result = append(result, s)
+		}
+
+		return result, nil
+	}
+
+	return nil, fmt.Errorf("The `%s` property must be a string or an array of strings", key)
+}
+
+// parseLuaOptions reads the module path and sandbox configuration of a Lua job. The
+// job's own `lua_path` is searched before the agent-wide one.
+func parseLuaOptions(c map[string]interface{}, agentLuaPath []string) (lua.ExecOptions, error) {
+	result := lua.ExecOptions{}
+
+	luaPath, err := configStrings(c, "lua_path")
+
+	if err != nil {
+		return result, err
+	}
+
+	result.LuaPath = append(luaPath, agentLuaPath...)
+
+	if sandbox, ok := c["lua_sandbox"]; ok {
+		s, _ := sandbox.(string)
+
+		if s != lua.SandboxStrict {
+			return result, errors.New("Invalid `lua_sandbox` value. The only supported profile is `strict`.")
+		}
+
+		result.Sandbox = s
+		result.Limits = lua.StrictLimits
+	}
+
+	if _, ok := c["lua_modules"]; ok {
+		if result.Sandbox == "" {
+			return result, errors.New("The `lua_modules` property can only be used with `lua_sandbox`.")
+		}
+
+		if result.Modules, err = configStrings(c, "lua_modules"); err != nil {
+			return result, err
+		}
+	}
+
+	instructions, ok, err := configInteger(c, "lua_max_instructions")
+
+	if err != nil {
+		return result, err
+	} else if ok {
+		result.Limits.Instructions = int(instructions)
+	}
+
+	memory, ok, err := configInteger(c, "lua_max_memory")
+
+	if err != nil {
+		return result, err
+	} else if ok && memory < 0 {
+		return result, errors.New("The `lua_max_memory` property cannot be negative.")
+	} else if ok {
+		result.Limits.Memory = uint64(memory) << 20
+	}
+
+	switch timeout := c["lua_timeout"].(type) {
+	case nil:
+
+	case string:
+		t, err := config.ParseTimeInterval(timeout)
+
+		if err != nil {
+			return result, err
+		}
+
+		result.Limits.Timeout = t
+
+	default:
+		seconds, _, err := configInteger(c, "lua_timeout")
+
+		if err != nil {
+			return result, errors.New("Invalid `lua_timeout` value. Must be either a number of seconds or a time interval string.")
+		}
+
+		result.Limits.Timeout = time.Duration(seconds) * time.Second
+	}
+
+	return result, nil
+}
@@ -0,0 +1,39 @@
+package plugin
+
+import (
+	"github.com/telemetryapp/gotelemetry_agent/agent/lua"
+	"testing"
+	"time"
+)
+
+func TestParseLuaOptions(t *testing.T) {
+	options, err := parseLuaOptions(map[string]interface{}{
+		"lua_sandbox":    "strict",
+		"lua_modules":    "telemetry/http",
+		"lua_max_memory": 64,
+		"lua_timeout":    "10s",
+	}, nil)
+
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+
+	if options.Sandbox != lua.SandboxStrict || len(options.Modules) != 1 || options.Limits.Memory != 64<<20 || options.Limits.Timeout != 10*time.Second {
+		t.Errorf("Unexpected options %#v", options)
+	}
+
+	if options, err := parseLuaOptions(map[string]interface{}{"lua_sandbox": "strict"}, nil); err != nil || options.Limits.Memory != 0 {
+		t.Errorf("The sandbox should not limit memory unless asked to, but got %#v (%v)", options, err)
+	}
+
+	for _, c := range []map[string]interface{}{
+		{"lua_sandbox": "loose"},
+		{"lua_modules": "telemetry/http"},
+		{"lua_sandbox": "strict", "lua_max_memory": -1},
+		{"lua_max_memory": "a lot"},
+	} {
+		if _, err := parseLuaOptions(c, nil); err == nil {
+			t.Errorf("Options %#v should be rejected", c)
+		}
+	}
+}
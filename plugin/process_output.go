@@ -0,0 +1,300 @@
+package plugin
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Output formats understood by the process plugin. Each parser converts the output of a
+// process into the same structure the JSON format produces: a flow payload or, in batch
+// mode, a map of flow tags to payloads.
+const (
+	outputFormatJSON       = "json"
+	outputFormatCSV        = "csv"
+	outputFormatKeyValue   = "kv"
+	outputFormatPrometheus = "prometheus"
+)
+
+type outputParser func(response string, batch bool) (map[string]interface{}, error)
+
+var outputParsers = map[string]outputParser{
+	outputFormatJSON:       parseJSONOutput,
+	outputFormatCSV:        parseCSVOutput,
+	outputFormatKeyValue:   parseKeyValueOutput,
+	outputFormatPrometheus: parsePrometheusOutput,
+}
+
+// parseOutputValue converts a textual value into a number or boolean whenever possible,
+// so that scripts printing plain text can still feed numeric flow properties.
+func parseOutputValue(value string) interface{} {
+	if f, err := strconv.ParseFloat(value, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+		return f
+	}
+
+	switch strings.ToLower(value) {
+	case "true":
+		return true
+
+	case "false":
+		return false
+	}
+
+	return value
+}
+
+// setBatchValue stores a property of a flow payload inside a batch update
+func setBatchValue(data map[string]interface{}, tag, key string, value interface{}) {
+	payload, ok := data[tag].(map[string]interface{})
+
+	if !ok {
+		payload = map[string]interface{}{}
+		data[tag] = payload
+	}
+
+	payload[key] = value
+}
+
+// parseJSONOutput merges one or more lines of JSON into a single payload.
+func parseJSONOutput(response string, batch bool) (map[string]interface{}, error) {
+	data := map[string]interface{}{}
+
+	for _, command := range strings.Split(response, "\n") {
+		command = strings.TrimSpace(command)
+
+		if command == "" {
+			continue
+		}
+
+		if err := json.Unmarshal([]byte(command), &data); err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
+// parseCSVOutput interprets the first record as a header. In batch mode, every subsequent
+// record is an update whose first column is the flow tag; otherwise, exactly one record
+// is expected and is used as the payload of the job's flow. Empty cells are ignored.
+func parseCSVOutput(response string, batch bool) (map[string]interface{}, error) {
+	r := csv.NewReader(strings.NewReader(response))
+	r.Comment = '#'
+	r.TrimLeadingSpace = true
+
+	records, err := r.ReadAll()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) == 0 {
+		return map[string]interface{}{}, nil
+	}
+
+	header := records[0]
+	rows := records[1:]
+	data := map[string]interface{}{}
+
+	if batch {
+		for index, row := range rows {
+			if len(row) == 0 || row[0] == "" {
+				return nil, fmt.Errorf("CSV record %d does not specify a flow tag in its first column", index+1)
+			}
+
+			for i := 1; i < len(row) && i < len(header); i++ {
+				if row[i] != "" {
+					setBatchValue(data, row[0], header[i], parseOutputValue(row[i]))
+				}
+			}
+		}
+
+		return data, nil
+	}
+
+	if len(rows) > 1 {
+		return nil, fmt.Errorf("CSV output contains %d records, but only one can be used to update a single flow. Set the `batch` property to update multiple flows.", len(rows))
+	}
+
+	for _, row := range rows {
+		for i := 0; i < len(row) && i < len(header); i++ {
+			if row[i] != "" {
+				data[header[i]] = parseOutputValue(row[i])
+			}
+		}
+	}
+
+	return data, nil
+}
+
+// splitKeyValuePairs splits a line into whitespace-separated key=value pairs. Values
+// may be enclosed in double quotes, in which case they can contain whitespace.
+func splitKeyValuePairs(line string) ([][2]string, error) {
+	result := [][2]string{}
+
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimSpace(line) {
+		eq := strings.Index(line, "=")
+
+		if eq < 1 {
+			return nil, fmt.Errorf("Invalid key=value pair `%s`", line)
+		}
+
+		key := line[:eq]
+
+		if strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("Invalid key `%s`", key)
+		}
+
+		line = line[eq+1:]
+
+		var value string
+
+		if strings.HasPrefix(line, `"`) {
+			prefix, err := strconv.QuotedPrefix(line)
+
+			if err != nil {
+				return nil, fmt.Errorf("Invalid quoted value for key `%s`", key)
+			}
+
+			value, _ = strconv.Unquote(prefix)
+			line = line[len(prefix):]
+		} else if end := strings.IndexAny(line, " \t"); end >= 0 {
+			value = line[:end]
+			line = line[end:]
+		} else {
+			value = line
+			line = ""
+		}
+
+		result = append(result, [2]string{key, value})
+	}
+
+	return result, nil
+}
+
+// parseKeyValueOutput reads lines of key=value pairs. In batch mode, each key takes the
+// form `flow_tag.property`.
+func parseKeyValueOutput(response string, batch bool) (map[string]interface{}, error) {
+	data := map[string]interface{}{}
+
+	scanner := bufio.NewScanner(strings.NewReader(response))
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		pairs, err := splitKeyValuePairs(line)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, pair := range pairs {
+			if !batch {
+				data[pair[0]] = parseOutputValue(pair[1])
+				continue
+			}
+
+			dot := strings.Index(pair[0], ".")
+
+			if dot < 1 || dot == len(pair[0])-1 {
+				return nil, fmt.Errorf("Key `%s` must take the form `flow_tag.property` in batch mode", pair[0])
+			}
+
+			setBatchValue(data, pair[0][:dot], pair[0][dot+1:], parseOutputValue(pair[1]))
+		}
+	}
+
+	return data, scanner.Err()
+}
+
+var prometheusSampleRegex = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{.*\})?\s+(\S+)(\s+-?[0-9]+)?$`)
+var prometheusLabelRegex = regexp.MustCompile(`([a-zA-Z_][a-zA-Z0-9_]*)\s*=\s*"((?:[^"\\]|\\.)*)"`)
+var prometheusKeyRegex = regexp.MustCompile(`[^a-zA-Z0-9_:]+`)
+
+// prometheusSampleKey derives a property (or flow tag) name from a sample by appending
+// its label values, in order, to the metric name.
+func prometheusSampleKey(name, labels string) string {
+	result := name
+
+	for _, match := range prometheusLabelRegex.FindAllStringSubmatch(labels, -1) {
+		value := strings.Trim(prometheusKeyRegex.ReplaceAllString(match[2], "_"), "_")
+
+		if value != "" {
+			result += "_" + value
+		}
+	}
+
+	return result
+}
+
+// parsePrometheusOutput reads samples in the Prometheus text exposition format. Each sample
+// becomes a property of the flow payload or, in batch mode, an update that sets the `value`
+// property of the flow whose tag matches the sample. Samples whose value is not finite are
+// skipped, since they cannot be represented in JSON.
+func parsePrometheusOutput(response string, batch bool) (map[string]interface{}, error) {
+	data := map[string]interface{}{}
+
+	scanner := bufio.NewScanner(strings.NewReader(response))
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		matches := prometheusSampleRegex.FindStringSubmatch(line)
+
+		if matches == nil {
+			return nil, fmt.Errorf("Invalid Prometheus sample `%s`", line)
+		}
+
+		value, err := strconv.ParseFloat(matches[3], 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for Prometheus sample `%s`", line)
+		}
+
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+
+		key := prometheusSampleKey(matches[1], matches[2])
+
+		if batch {
+			setBatchValue(data, key, "value", value)
+		} else {
+			data[key] = value
+		}
+	}
+
+	return data, scanner.Err()
+}
+
+// parseProcessOutput converts the output of a process into a payload according to the
+// output format configured for the job.
+func (p *ProcessPlugin) parseProcessOutput(response string, batch bool) (map[string]interface{}, error) {
+	format := p.outputFormat
+
+	if format == "" {
+		format = outputFormatJSON
+	}
+
+	parser, ok := outputParsers[format]
+
+	if !ok {
+		return nil, errors.New("Unknown output format `" + format + "`")
+	}
+
+	return parser(response, batch)
+}
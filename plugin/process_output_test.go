@@ -0,0 +1,87 @@
+package plugin
+
+import (
+	"reflect"
+	"testing"
+)
+
+type outputTest struct {
+	name     string
+	format   string
+	response string
+	batch    bool
+	expected map[string]interface{}
+}
+
+// shouldFail marks output that the parser must reject
+var shouldFail = map[string]interface{}{"error": "expected"}
+
+func TestParseProcessOutput(t *testing.T) {
+	tests := []outputTest{
+		{"JSON", outputFormatJSON, `{"value": 12, "label": "Test"}`, false, map[string]interface{}{"value": 12.0, "label": "Test"}},
+		{"JSON lines", outputFormatJSON, "{\"value\": 1}\n\n{\"label\": \"Test\"}\n", false, map[string]interface{}{"value": 1.0, "label": "Test"}},
+		{"JSON duplicate keys", outputFormatJSON, "{\"value\": 1}\n{\"value\": 2}", false, map[string]interface{}{"value": 2.0}},
+		{"JSON malformed line", outputFormatJSON, "{\"value\": 1}\nvalue=2", false, shouldFail},
+
+		{"CSV", outputFormatCSV, "value,label,up\n12,Test,true", false, map[string]interface{}{"value": 12.0, "label": "Test", "up": true}},
+		{"CSV quoting", outputFormatCSV, "label,text\n\"a, b\",\"say \"\"hi\"\"\"", false, map[string]interface{}{"label": "a, b", "text": `say "hi"`}},
+		{"CSV comments and empty cells", outputFormatCSV, "# generated\nvalue,label\n12,", false, map[string]interface{}{"value": 12.0}},
+		{"CSV duplicate columns", outputFormatCSV, "value,value\n1,2", false, map[string]interface{}{"value": 2.0}},
+		{"CSV ragged record", outputFormatCSV, "value\n1,2", false, shouldFail},
+		{"CSV header only", outputFormatCSV, "value,label", false, map[string]interface{}{}},
+		{"CSV several records", outputFormatCSV, "value\n1\n2", false, shouldFail},
+		{"CSV malformed quoting", outputFormatCSV, "value\n\"1", false, shouldFail},
+		{"CSV batch", outputFormatCSV, "tag,value,label\ncpu,12,\nmemory,40,RAM", true, map[string]interface{}{"cpu": map[string]interface{}{"value": 12.0}, "memory": map[string]interface{}{"value": 40.0, "label": "RAM"}}},
+		{"CSV batch without tag", outputFormatCSV, "tag,value\n,12", true, shouldFail},
+
+		{"Key/value", outputFormatKeyValue, "value=12 label=Test\nup=false", false, map[string]interface{}{"value": 12.0, "label": "Test", "up": false}},
+		{"Key/value quoting", outputFormatKeyValue, `label="two words" text="say \"hi\"" empty=""`, false, map[string]interface{}{"label": "two words", "text": `say "hi"`, "empty": ""}},
+		{"Key/value comments", outputFormatKeyValue, "# value=1\n\n  value=2", false, map[string]interface{}{"value": 2.0}},
+		{"Key/value duplicate keys", outputFormatKeyValue, "value=1 value=2\nvalue=3", false, map[string]interface{}{"value": 3.0}},
+		{"Key/value missing equals sign", outputFormatKeyValue, "value", false, shouldFail},
+		{"Key/value missing key", outputFormatKeyValue, "=12", false, shouldFail},
+		{"Key/value unterminated quote", outputFormatKeyValue, `label="abc`, false, shouldFail},
+		{"Key/value batch", outputFormatKeyValue, "cpu.value=12 cpu.label=CPU memory.value=40", true, map[string]interface{}{"cpu": map[string]interface{}{"value": 12.0, "label": "CPU"}, "memory": map[string]interface{}{"value": 40.0}}},
+		{"Key/value batch without tag", outputFormatKeyValue, "value=12", true, shouldFail},
+		{"Key/value batch without property", outputFormatKeyValue, "cpu.=12", true, shouldFail},
+
+		{"Prometheus", outputFormatPrometheus, "# HELP up Whether the target is up\n# TYPE up gauge\nup 1\nrequests_total 1027 1395066363000", false, map[string]interface{}{"up": 1.0, "requests_total": 1027.0}},
+		{"Prometheus labels", outputFormatPrometheus, `http_requests{method="post",code="200"} 3` + "\n" + `http_requests{method="get", code="5\"00"} 4`, false, map[string]interface{}{"http_requests_post_200": 3.0, "http_requests_get_5_00": 4.0}},
+		{"Prometheus empty label value", outputFormatPrometheus, `queue_length{queue=""} 7`, false, map[string]interface{}{"queue_length": 7.0}},
+		{"Prometheus duplicate samples", outputFormatPrometheus, "up 0\nup 1", false, map[string]interface{}{"up": 1.0}},
+		{"Prometheus special values", outputFormatPrometheus, "a NaN\nb +Inf\nc -Inf\nd 1e3", false, map[string]interface{}{"d": 1000.0}},
+		{"Prometheus malformed sample", outputFormatPrometheus, "up", false, shouldFail},
+		{"Prometheus malformed value", outputFormatPrometheus, "up one", false, shouldFail},
+		{"Prometheus batch", outputFormatPrometheus, `temperature{room="kitchen"} 21.5`, true, map[string]interface{}{"temperature_kitchen": map[string]interface{}{"value": 21.5}}},
+	}
+
+	for _, tt := range tests {
+		p := &ProcessPlugin{outputFormat: tt.format}
+		data, err := p.parseProcessOutput(tt.response, tt.batch)
+
+		if reflect.DeepEqual(tt.expected, shouldFail) {
+			if err == nil {
+				t.Errorf("Test %s should fail, but returned `%#v`.", tt.name, data)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Test %s should not fail, but returned `%s`.", tt.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(data, tt.expected) {
+			t.Errorf("Test %s: expected `%#v`, but got `%#v` instead.", tt.name, tt.expected, data)
+		}
+	}
+}
+
+func TestUnknownOutputFormat(t *testing.T) {
+	p := &ProcessPlugin{outputFormat: "xml"}
+
+	if _, err := p.parseProcessOutput("<value>1</value>", false); err == nil {
+		t.Error("Unknown output formats should be rejected")
+	}
+}
@@ -0,0 +1,39 @@
+package plugin
+
+import (
+	"github.com/telemetryapp/gotelemetry_agent/agent/config"
+	"github.com/telemetryapp/gotelemetry_agent/agent/job"
+	"testing"
+)
+
+func TestValidateDataUpdates(t *testing.T) {
+	// Keep invalid updates from being reported to the API
+	debugMode := config.CLIConfig.DebugMode
+	config.CLIConfig.DebugMode = true
+	defer func() { config.CLIConfig.DebugMode = debugMode }()
+
+	p := &ProcessPlugin{flowTag: "job", variant: "value", variants: map[string]string{"status": "text", "unknown": ""}}
+	j := &job.Job{ID: "test"}
+
+	valid := []processUpdate{
+		{directivePATCH, "job", map[string]interface{}{"value": 12.0}},
+		{directiveREPLACE, "status", map[string]interface{}{"text": "OK"}},
+		{directiveREPLACE, "unknown", map[string]interface{}{"anything": true}},
+		{directiveJSONPATCH, "job", []interface{}{map[string]interface{}{"op": "remove", "path": "/value"}}},
+	}
+
+	if !p.validateDataUpdates(j, valid) {
+		t.Error("Valid updates should pass validation")
+	}
+
+	// The invalid update to another flow comes last, after updates that are valid
+	invalid := append(valid, processUpdate{directivePATCH, "status", map[string]interface{}{"text": 12.0}})
+
+	if p.validateDataUpdates(j, invalid) {
+		t.Error("An invalid update to a flow other than the job's should fail validation")
+	}
+
+	if p.validateDataUpdates(j, []processUpdate{{directiveREPLACE, "job", map[string]interface{}{"label": "Test"}}}) {
+		t.Error("A replacement without required properties should fail validation")
+	}
+}